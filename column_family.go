@@ -0,0 +1,137 @@
+package lsm
+
+import (
+	"cmp"
+	"errors"
+	"lsm/pkg/memtable"
+	"lsm/pkg/version"
+	"lsm/pkg/wal"
+	"slices"
+)
+
+const DefaultColumnFamilyName = "default"
+
+var (
+	ErrColumnFamilyExists   = errors.New("column family already exists")
+	ErrColumnFamilyNotFound = errors.New("column family not found")
+)
+
+// ColumnFamilyHandle 表示 db 中的一个 column family
+//
+// 每个 column family 拥有独立的 memtable 与 level, 以及各自的 memtable 大小、compaction 策略等选项,
+// 所有 column family 共享同一个 wal、manifest 与 seq, 通过 WriteBatch 可以原子地写入多个 column family
+type ColumnFamilyHandle struct {
+	id     uint32
+	name   string
+	option ColumnFamilyOptions
+
+	// 以下字段由 db.mu 保护
+	mem     *memtable.Memtable
+	imm     *memtable.Memtable
+	current *version.Version
+	// mem 与 imm 中最早的记录在 wal 中的位置, 为 nil 表示没有记录
+	// 之前的 wal 记录都已刷入该 column family 的 sstable
+	memLogStart *wal.ChunkPosition
+	immLogStart *wal.ChunkPosition
+}
+
+func (cf *ColumnFamilyHandle) ID() uint32 {
+	return cf.id
+}
+
+func (cf *ColumnFamilyHandle) Name() string {
+	return cf.name
+}
+
+// 创建新的 column family, 写入 manifest 后返回
+func (db *Db) CreateColumnFamily(name string, opts ColumnFamilyOptions) (*ColumnFamilyHandle, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if db.findColumnFamily(name) != nil {
+		return nil, ErrColumnFamilyExists
+	}
+
+	cf := &ColumnFamilyHandle{
+		id:     db.columnFamilies[len(db.columnFamilies)-1].id + 1,
+		name:   name,
+		option: opts,
+	}
+	cf.current = db.defaultCF.current.NewSibling(db.versionOption(opts))
+	cf.mem = db.newMemtable(cf)
+
+	db.columnFamilies = append(db.columnFamilies, cf)
+	if err := db.saveManifest(); err != nil {
+		db.columnFamilies = db.columnFamilies[:len(db.columnFamilies)-1]
+		return nil, err
+	}
+	return cf, nil
+}
+
+// 返回名为 name 的 column family, 用于获取 Open 时从 manifest 恢复的 column family
+func (db *Db) ColumnFamily(name string) (*ColumnFamilyHandle, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	cf := db.findColumnFamily(name)
+	return cf, cf != nil
+}
+
+func (db *Db) DefaultColumnFamily() *ColumnFamilyHandle {
+	return db.defaultCF
+}
+
+// 调用前需持有 db.mu
+func (db *Db) findColumnFamily(name string) *ColumnFamilyHandle {
+	for _, cf := range db.columnFamilies {
+		if cf.name == name {
+			return cf
+		}
+	}
+	return nil
+}
+
+// 调用前需持有 db.mu
+func (db *Db) columnFamilyByID(id uint32) *ColumnFamilyHandle {
+	i, ok := slices.BinarySearchFunc(db.columnFamilies, id, func(cf *ColumnFamilyHandle, id uint32) int {
+		return cmp.Compare(cf.id, id)
+	})
+	if !ok {
+		return nil
+	}
+	return db.columnFamilies[i]
+}
+
+func (db *Db) versionOption(opts ColumnFamilyOptions) version.Option {
+	return version.Option{
+		CompactionPicker:  opts.CompactionPicker,
+		MaxSubcompactions: opts.MaxSubcompactions,
+		CompactionFilter:  opts.CompactionFilter,
+		MergeOperator:     opts.MergeOperator,
+		Clock:             db.option.Clock,
+		KeyProvider:       db.option.KeyProvider,
+		FS:                db.option.FS,
+		Comparator:        opts.Comparator,
+	}
+}
+
+// 将所有 column family 的 current 写入新的 manifest, 并更新 CURRENT
+// 调用前需持有 db.mu
+func (db *Db) saveManifest() error {
+	families := make([]version.Family, 0, len(db.columnFamilies))
+	for _, cf := range db.columnFamilies {
+		families = append(families, version.Family{
+			ID:      cf.id,
+			Name:    cf.name,
+			Version: cf.current,
+		})
+	}
+	descriptorNumber, err := version.SaveManifest(db.name, families)
+	if err != nil {
+		return err
+	}
+	return db.SetCurrentFile(descriptorNumber)
+}
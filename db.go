@@ -1,25 +1,62 @@
 package lsm
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"lsm/internal/key"
 	"lsm/internal/util"
 	"lsm/pkg/memtable"
+	"lsm/pkg/merge"
 	"lsm/pkg/version"
-	"os"
+	"lsm/pkg/vfs"
+	"lsm/pkg/wal"
+	"math"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"sync"
 	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrClosed          = errors.New("db is closed")
+	ErrNoMergeOperator = errors.New("merge operator is not set")
+	ErrInvalidRange    = errors.New("start must be less than end")
+	ErrInvalidTTL      = errors.New("ttl must be positive")
 )
 
 type Db struct {
-	name                  string
-	mu                    sync.Mutex
-	cond                  *sync.Cond
-	mem                   *memtable.Memtable
-	imm                   *memtable.Memtable
-	current               *version.Version
-	bgCompactionScheduled bool
+	name   string
+	option Option
+	mu     sync.Mutex
+	cond   *sync.Cond
+	// 按 id 升序, 第一个为 default column family
+	columnFamilies []*ColumnFamilyHandle
+	defaultCF      *ColumnFamilyHandle
+	// 正在被读取的旧 version 的引用计数, 其引用的文件不能删除
+	versionRefs map[*version.Version]int
+	// 存活的 snapshot, compaction 不会删除它们可见的记录
+	snapshots map[*Snapshot]struct{}
+	// 当前 manifest 文件编号
+	manifestNumber uint64
+	wal            *wal.WAL
+	// db 目录下 LOCK 文件的锁, Close 时释放
+	lock io.Closer
+	// wal 中最后一条记录的位置, 打开后没有记录时为 nil
+	lastLogPos *wal.ChunkPosition
+	// 正在进行的后台任务开始时的下一个文件编号, 编号不小于其中最小值的 sstable 可能正在写入
+	pendingOutputs map[uint64]int
+	// 后台 flush/compaction 出错后,后续写入均返回该错误
+	bgErr error
+	// 正在进行的 compaction 数量
+	runningCompactions int
+	// 通知后台 worker 退出
+	shuttingDown bool
+	bgWorkers    sync.WaitGroup
+	closed       bool
 }
 
 const (
@@ -27,111 +64,543 @@ const (
 	DefaultMemTableSize = 1024
 )
 
-func Open(dbName string) *Db {
+func Open(dbName string, option Option) (*Db, error) {
+	option.FS = vfs.OrDefault(option.FS)
+	if err := option.FS.MkdirAll(dbName, 0755); err != nil {
+		return nil, err
+	}
+	// 防止多个实例同时打开同一个 db
+	lock, err := option.FS.Lock(util.LockFileName(dbName))
+	if err != nil {
+		return nil, err
+	}
+	db, err := open(dbName, option)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	db.lock = lock
+	return db, nil
+}
+
+func open(dbName string, option Option) (*Db, error) {
 	var db Db
 	db.name = dbName
-	db.mem = memtable.NewMemtable(DefaultMemTableSize)
-	db.imm = nil
-	db.bgCompactionScheduled = false
+	db.option = option
 	db.cond = sync.NewCond(&db.mu)
+	db.versionRefs = make(map[*version.Version]int)
+	db.pendingOutputs = make(map[uint64]int)
+	db.snapshots = make(map[*Snapshot]struct{})
 	num := db.ReadCurrentFile()
 	if num > 0 {
-		v, err := version.Load(dbName, num)
+		families, err := version.LoadManifest(option.FS, dbName, num, option.KeyProvider, func(name string) version.Option {
+			return db.versionOption(option.columnFamilyOptions(name))
+		})
 		if err != nil {
-			return nil
+			return nil, err
+		}
+		for _, f := range families {
+			db.columnFamilies = append(db.columnFamilies, &ColumnFamilyHandle{
+				id:      f.ID,
+				name:    f.Name,
+				option:  option.columnFamilyOptions(f.Name),
+				current: f.Version,
+			})
 		}
-		db.current = v
+		db.manifestNumber = num
 	} else {
-		db.current = version.New(dbName)
+		opts := option.defaultColumnFamilyOptions()
+		db.columnFamilies = []*ColumnFamilyHandle{{
+			id:      0,
+			name:    DefaultColumnFamilyName,
+			option:  opts,
+			current: version.New(dbName, db.versionOption(opts)),
+		}}
+	}
+	db.defaultCF = db.columnFamilies[0]
+	for _, cf := range db.columnFamilies {
+		cf.mem = db.newMemtable(cf)
+	}
+
+	w, err := wal.Open(wal.Option{
+		Dir:          util.WALDirName(dbName),
+		FS:           option.FS,
+		SegmentSize:  option.WALSegmentSize,
+		SyncInterval: option.WALSyncInterval,
+		BytesPerSync: option.WALBytesPerSync,
+		Compression:  option.WALCompression,
+		KeyProvider:  option.KeyProvider,
+		RecoveryMode: option.WALRecoveryMode,
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.wal = w
+	if report := w.RecoveryReport(); report.FirstCorruption != nil {
+		logrus.Warnf("wal is corrupted at %+v, dropped %d bytes and %d records", *report.FirstCorruption, report.DroppedBytes, report.DroppedRecords)
+	}
+
+	if err := db.recover(); err != nil {
+		db.wal.Close()
+		return nil, err
 	}
+	db.removeObsoleteFiles()
+	db.startBackgroundWorkers()
 
-	return &db
+	return &db, nil
 }
 
-func (db *Db) Close() {
+// 重放 wal 中的记录,恢复上次关闭前未刷盘的 memtable
+// 已经刷入各个 column family 的记录会被跳过
+func (db *Db) recover() error {
+	reader, err := db.wal.NewReaderWithStart(nil)
+	if err != nil {
+		return err
+	}
+
+	flushed := false
+	for {
+		data, pos, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		db.lastLogPos = pos
+
+		ids, iks, err := decodeBatchRecords(data)
+		if err != nil {
+			return err
+		}
+		for i := range iks {
+			ik := &iks[i]
+			if ik.Seq > db.defaultCF.current.LastSeq() {
+				db.defaultCF.current.SetLastSeq(ik.Seq)
+			}
+			cf := db.columnFamilyByID(ids[i])
+			if cf == nil {
+				logrus.Warnf("column family %d not found in manifest, skip record %s", ids[i], ik.Debug())
+				continue
+			}
+			if ik.Seq <= cf.current.FlushedSeq() {
+				continue
+			}
+
+			cf.mem.Insert(ik)
+			if cf.memLogStart == nil {
+				cf.memLogStart = pos
+			}
+			if cf.mem.Full() {
+				cf.mem.MarkImmutable()
+				if err := cf.current.WriteLevel0Table(cf.mem); err != nil {
+					return err
+				}
+				cf.mem = db.newMemtable(cf)
+				cf.memLogStart = nil
+				flushed = true
+			}
+		}
+	}
+
+	if flushed {
+		if err := db.saveManifest(); err != nil {
+			return err
+		}
+		db.truncateWAL()
+	}
+	return nil
+}
+
+// 删除所有 column family 都已刷入 sstable 的 wal segment
+// 需要在刷盘结果写入 manifest 后调用, 调用前需持有 db.mu
+func (db *Db) truncateWAL() {
+	// 没有未刷盘的记录时, 最后一条记录之前的 segment 都可以删除
+	start := db.lastLogPos
+	for _, cf := range db.columnFamilies {
+		for _, pos := range []*wal.ChunkPosition{cf.memLogStart, cf.immLogStart} {
+			if pos != nil && (start == nil || pos.SegmentID < start.SegmentID) {
+				start = pos
+			}
+		}
+	}
+	if start == nil {
+		return
+	}
+	if err := db.wal.TruncateBefore(*start); err != nil {
+		logrus.Warnf("truncate wal before %+v failed, err:%v", *start, err)
+	}
+}
+
+// 等待后台任务结束后关闭 wal
+// 若 option.FlushOnClose 为 true,会先将 memtable 刷入 level 0
+func (db *Db) Close() error {
 	db.mu.Lock()
-	for db.bgCompactionScheduled {
+	if db.closed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.closed = true
+
+	var err error
+	if db.option.FlushOnClose {
+		err = db.flushAll()
+	}
+	for db.hasImm() && db.bgErr == nil {
 		db.cond.Wait()
 	}
+
+	// 正在进行的 compaction 完成后 worker 才会退出
+	db.shuttingDown = true
+	db.cond.Broadcast()
+	db.mu.Unlock()
+	db.bgWorkers.Wait()
+
+	db.mu.Lock()
+	if err == nil {
+		err = db.bgErr
+	}
 	db.mu.Unlock()
+
+	if err1 := db.wal.Close(); err == nil {
+		err = err1
+	}
+	if err1 := db.lock.Close(); err == nil {
+		err = err1
+	}
+	return err
 }
 
-func (db *Db) Put(userKey, userValue []byte) error {
-	// May temporarily unlock and wait.
-	seq, err := db.makeRoomForWrite()
-	if err != nil {
+// 将当前 memtable 切换为 imm,由后台 flush worker 写入 level 0
+// waitForCompletion 为 true 时,等待写入及其触发的 compaction 完成后返回
+func (db *Db) Flush(waitForCompletion bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	if err := db.flushAll(); err != nil {
 		return err
 	}
 
-	// todo : add wal
+	if waitForCompletion {
+		db.waitForBackgroundWork()
+	}
+	return db.bgErr
+}
 
-	db.mem.Add(seq, key.KTypeValue, userKey, userValue)
+// 将所有非空的 memtable 切换为 imm
+// 调用前需持有 db.mu
+func (db *Db) flushAll() error {
+	for _, cf := range db.columnFamilies {
+		if cf.mem.Empty() {
+			continue
+		}
+		if err := db.makeRoomForWrite(cf, true); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// 调用前需持有 db.mu
+func (db *Db) hasImm() bool {
+	return slices.ContainsFunc(db.columnFamilies, func(cf *ColumnFamilyHandle) bool {
+		return cf.imm != nil
+	})
+}
+
+// 等待 imm 写入完成, 且不再需要 compaction
+// 调用前需持有 db.mu
+func (db *Db) waitForBackgroundWork() {
+	for db.bgErr == nil {
+		if db.hasImm() || db.runningCompactions > 0 {
+			db.cond.Wait()
+			continue
+		}
+		// worker 可能还未被唤醒, 由当前 goroutine 执行剩余的 compaction
+		cf, c := db.pickCompaction()
+		if c == nil {
+			return
+		}
+		db.compact(cf, c)
+	}
+}
+
+func (db *Db) Put(userKey, userValue []byte) error {
+	return db.PutCF(db.defaultCF, userKey, userValue)
+}
+
+func (db *Db) PutCF(cf *ColumnFamilyHandle, userKey, userValue []byte) error {
+	return db.write(cf, key.KTypeValue, userKey, userValue)
+}
+
+// 写入在 ttl 之后过期的 value, 过期后 Get 与迭代器均视其为不存在, compaction 时物理删除
+// 过期时间以 Option.Clock 为准
+func (db *Db) PutWithTTL(userKey, userValue []byte, ttl time.Duration) error {
+	return db.PutWithTTLCF(db.defaultCF, userKey, userValue, ttl)
+}
+
+func (db *Db) PutWithTTLCF(cf *ColumnFamilyHandle, userKey, userValue []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	ik := key.New(userKey, userValue, 0, key.KTypeValue)
+	ik.ExpireAt = db.now().Add(ttl).UnixNano()
+	batch := NewWriteBatch()
+	batch.addKey(cf, ik)
+	return db.Write(batch)
+}
+
 func (db *Db) Get(userKey []byte, seq uint64) ([]byte, bool) {
+	return db.GetCF(db.defaultCF, userKey, seq)
+}
+
+func (db *Db) GetCF(cf *ColumnFamilyHandle, userKey []byte, seq uint64) ([]byte, bool) {
 	db.mu.Lock()
-	mem := db.mem
-	imm := db.imm
-	current := db.current
+	mem := cf.mem
+	imm := cf.imm
+	current := cf.current
+	db.refVersion(current)
 	db.mu.Unlock()
-	value, ok := mem.Get(userKey, seq)
-	if ok {
-		return value, ok
-	}
 
-	if imm != nil {
-		value, ok := imm.Get(userKey, seq)
-		if ok {
-			return value, ok
-		}
+	defer func() {
+		db.mu.Lock()
+		db.unrefVersion(current)
+		db.mu.Unlock()
+	}()
+
+	// 找到 value 或删除记录时,不再查找更旧的数据
+	// 只找到 merge operand 时,继续向更旧的数据查找
+	ctx := merge.NewGetContext(cf.option.MergeOperator, userKey)
+	ctx.SetNow(db.now())
+	if !mem.Lookup(ctx, seq) && (imm == nil || !imm.Lookup(ctx, seq)) {
+		current.Lookup(ctx, seq)
 	}
+	return ctx.Result()
+}
+
+// 以当前最新的 seq 创建 snapshot, 之后可通过 Get(userKey, snapshot.Seq()) 读取该时刻的数据
+// 使用完毕后需调用 ReleaseSnapshot
+func (db *Db) GetSnapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s := &Snapshot{seq: db.defaultCF.current.LastSeq()}
+	db.snapshots[s] = struct{}{}
+	return s
+}
+
+func (db *Db) ReleaseSnapshot(s *Snapshot) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	value, ok = current.Get(userKey, seq)
-	return value, ok
+	delete(db.snapshots, s)
 }
 
 func (db *Db) Delete(userKey []byte) error {
-	seq, err := db.makeRoomForWrite()
-	if err != nil {
+	return db.DeleteCF(db.defaultCF, userKey)
+}
+
+func (db *Db) DeleteCF(cf *ColumnFamilyHandle, userKey []byte) error {
+	return db.write(cf, key.KTypeDeletion, userKey, nil)
+}
+
+// 删除 [start, end) 范围内的所有 key
+// 只写入一条 range tombstone, 读取时屏蔽被覆盖的旧数据, compaction 时再物理删除
+func (db *Db) DeleteRange(start, end []byte) error {
+	return db.DeleteRangeCF(db.defaultCF, start, end)
+}
+
+func (db *Db) DeleteRangeCF(cf *ColumnFamilyHandle, start, end []byte) error {
+	return db.write(cf, key.KTypeRangeDeletion, start, end)
+}
+
+// 写入一个 merge operand, 读取时由 Option.MergeOperator 与旧值合并
+// 适用于计数器累加、列表追加等 read-modify-write 场景, 不需要先 Get
+func (db *Db) Merge(userKey, operand []byte) error {
+	return db.MergeCF(db.defaultCF, userKey, operand)
+}
+
+func (db *Db) MergeCF(cf *ColumnFamilyHandle, userKey, operand []byte) error {
+	return db.write(cf, key.KTypeMerge, userKey, operand)
+}
+
+func (db *Db) write(cf *ColumnFamilyHandle, tp key.KeyType, userKey, userValue []byte) error {
+	batch := NewWriteBatch()
+	batch.add(cf, tp, userKey, userValue)
+	return db.Write(batch)
+}
+
+// 原子地写入 batch 中的所有记录
+// batch 中的记录写入同一条 wal 记录, 并分配连续的 seq
+func (db *Db) Write(batch *WriteBatch) error {
+	return db.writeBatch(batch, db.option.Sync, nil)
+}
+
+// 单次写入的选项
+type WriteOptions struct {
+	// 返回前是否等待 wal sync, 覆盖 Option.Sync
+	Sync bool
+}
+
+func (db *Db) WriteWithOptions(batch *WriteBatch, opts WriteOptions) error {
+	return db.writeBatch(batch, opts.Sync, nil)
+}
+
+// sync 为 true 时, 返回前等待 batch 所在的 wal 记录持久化
+// validate 在持有 db.mu 且分配 seq 之前调用, 期间不会有其它写入, 返回错误时不写入 batch
+// batch 为空时只调用 validate
+func (db *Db) writeBatch(batch *WriteBatch, sync bool, validate func() error) error {
+	pos, err := db.applyBatch(batch, validate)
+	if err != nil || pos == nil || !sync {
 		return err
 	}
-	db.mem.Add(seq, key.KTypeDeletion, userKey, nil)
-	return nil
+	// 在 db.mu 之外等待 sync, 同时等待的写入合并为一次 sync
+	// 因此 batch 在持久化之前就可能被其它读取看到
+	return db.wal.SyncTo(pos)
 }
 
-func (db *Db) makeRoomForWrite() (uint64, error) {
+// 写入 wal 与 memtable, 返回 batch 所在的 wal 记录, batch 为空时返回 nil
+func (db *Db) applyBatch(batch *WriteBatch, validate func() error) (*wal.ChunkPosition, error) {
+	if batch.Count() == 0 && validate == nil {
+		return nil, nil
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	for true {
-		if db.current.NumLevelFiles(0) >= version.L0_SlowdownWritesTrigger {
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	records := slices.Clone(batch.records)
+	for i := range records {
+		r := &records[i]
+		if r.cf == nil {
+			r.cf = db.defaultCF
+		}
+		if db.columnFamilyByID(r.cf.id) != r.cf {
+			return nil, ErrColumnFamilyNotFound
+		}
+		switch r.ik.Type {
+		case key.KTypeMerge:
+			if r.cf.option.MergeOperator == nil {
+				return nil, ErrNoMergeOperator
+			}
+		case key.KTypeRangeDeletion:
+			if r.cf.current.Comparator().Compare(r.ik.UserKey, r.ik.UserValue) >= 0 {
+				return nil, ErrInvalidRange
+			}
+		}
+	}
+
+	// May temporarily unlock and wait.
+	for _, r := range records {
+		if err := db.makeRoomForWrite(r.cf, false); err != nil {
+			return nil, err
+		}
+	}
+
+	if validate != nil {
+		if err := validate(); err != nil {
+			return nil, err
+		}
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	for i := range records {
+		records[i].ik.Seq = db.defaultCF.current.NextSeq()
+	}
+	pos, err := db.wal.Write(encodeBatchRecords(records))
+	if err != nil {
+		return nil, err
+	}
+	db.lastLogPos = pos
+
+	for i := range records {
+		cf := records[i].cf
+		cf.mem.Insert(&records[i].ik)
+		if cf.memLogStart == nil {
+			cf.memLogStart = pos
+		}
+	}
+	return pos, nil
+}
+
+// 返回 cf 中 userKey 最新记录(包括删除记录与覆盖它的 range tombstone)的 seq, 不存在时返回 0
+// 调用前需持有 db.mu
+func (db *Db) latestSeq(cf *ColumnFamilyHandle, userKey []byte) uint64 {
+	ctx := merge.NewGetContext(cf.option.MergeOperator, userKey)
+	if !cf.mem.Lookup(ctx, math.MaxUint64) && (cf.imm == nil || !cf.imm.Lookup(ctx, math.MaxUint64)) {
+		cf.current.Lookup(ctx, math.MaxUint64)
+	}
+	return ctx.LatestSeq()
+}
+
+func (db *Db) now() time.Time {
+	if db.option.Clock != nil {
+		return db.option.Clock()
+	}
+	return time.Now()
+}
+
+// 调用前需持有 db.mu
+// force 为 true 时,即使 cf 的 memtable 未满也会切换
+func (db *Db) makeRoomForWrite(cf *ColumnFamilyHandle, force bool) error {
+	allowDelay := !force
+	for {
+		if db.bgErr != nil {
+			return db.bgErr
+		} else if db.shuttingDown {
+			return ErrClosed
+		} else if allowDelay && db.option.L0SlowdownWritesTrigger > 0 && cf.current.NumLevelFiles(0) >= db.option.L0SlowdownWritesTrigger {
+			// level 0 文件过多,延迟本次写入,让出 cpu 给后台 compaction
+			// 每次写入最多延迟一次
 			db.mu.Unlock()
 			time.Sleep(time.Duration(1000) * time.Microsecond)
+			allowDelay = false
 			db.mu.Lock()
-		} else if db.mem.Full() {
-			return db.current.NextSeq(), nil
-		} else if db.imm != nil {
+		} else if !force && !cf.mem.Full() {
+			return nil
+		} else if cf.imm != nil {
 			//  Current memtable full; waiting
 			db.cond.Wait()
 		} else {
 			// Attempt to switch to a new memtable and trigger compaction of old
-			// todo : switch log
-			db.imm = db.mem
-			db.mem = memtable.NewMemtable(DefaultMemTableSize)
-			db.maybeScheduleCompaction()
+			cf.imm = cf.mem
+			cf.imm.MarkImmutable()
+			cf.mem = db.newMemtable(cf)
+			cf.immLogStart, cf.memLogStart = cf.memLogStart, nil
+			force = false
+			// 唤醒 flush worker
+			db.cond.Broadcast()
 		}
 	}
+}
 
-	return db.current.NextSeq(), nil
+func (db *Db) newMemtable(cf *ColumnFamilyHandle) *memtable.Memtable {
+	return memtable.New(memtable.Option{
+		MaxSize:           cf.option.MemTableSize,
+		MergeOperator:     cf.option.MergeOperator,
+		Rep:               cf.option.MemTableRep,
+		BloomExpectedKeys: cf.option.MemTableBloomKeys,
+		BloomPrefix:       cf.option.MemTableBloomPrefix,
+		Clock:             db.option.Clock,
+		Comparator:        cf.option.Comparator,
+	})
 }
 
 // from dbname/CURRENT read current file number of version
 // if dbname/CURRENT not exist, return 0, represent a new db
 // else db should load version from dbname/MANIFEST-[number]
 func (db *Db) ReadCurrentFile() uint64 {
-	content, err := os.ReadFile(util.CurrentFileName(db.name))
-	if err == nil {
+	content, err := vfs.ReadFile(db.option.FS, util.CurrentFileName(db.name))
+	if err != nil {
 		return 0
 	}
 	num, err := strconv.Atoi(string(content))
@@ -141,44 +610,249 @@ func (db *Db) ReadCurrentFile() uint64 {
 	return uint64(num)
 }
 
-func (db *Db) SetCurrentFile(descriptorNumber uint64) {
+func (db *Db) SetCurrentFile(descriptorNumber uint64) error {
+	// 先持久化临时文件再 rename, 崩溃后 CURRENT 不会为空
 	tmp := util.TempFileName(db.name, descriptorNumber)
-	os.WriteFile(tmp, []byte(fmt.Sprintf("%d", descriptorNumber)), 0600)
-	os.Rename(tmp, util.CurrentFileName(db.name))
+	if err := vfs.WriteFile(db.option.FS, tmp, []byte(fmt.Sprintf("%d", descriptorNumber))); err != nil {
+		return err
+	}
+	if err := db.option.FS.Rename(tmp, util.CurrentFileName(db.name)); err != nil {
+		return err
+	}
+	db.manifestNumber = descriptorNumber
+	return nil
+}
+
+// 调用前需持有 db.mu
+func (db *Db) refVersion(v *version.Version) {
+	db.versionRefs[v]++
+}
+
+// 调用前需持有 db.mu
+func (db *Db) unrefVersion(v *version.Version) {
+	db.versionRefs[v]--
+	if db.versionRefs[v] == 0 {
+		delete(db.versionRefs, v)
+	}
+}
+
+// 记录后台任务开始, 此后该任务分配的文件编号均不小于返回值
+// 调用前需持有 db.mu
+func (db *Db) addPendingOutput() uint64 {
+	number := db.defaultCF.current.NextFileNumber()
+	db.pendingOutputs[number]++
+	return number
 }
 
-func (db *Db) maybeScheduleCompaction() {
-	if db.bgCompactionScheduled {
+// 调用前需持有 db.mu
+func (db *Db) removePendingOutput(number uint64) {
+	db.pendingOutputs[number]--
+	if db.pendingOutputs[number] == 0 {
+		delete(db.pendingOutputs, number)
+	}
+}
+
+// 删除不再被任何 version 引用的 sstable 文件, 以及旧的 manifest 文件
+// 后台任务正在写入的 sstable 不会被删除
+// 调用前需持有 db.mu
+func (db *Db) removeObsoleteFiles() {
+	live := make(map[uint64]struct{})
+	for _, cf := range db.columnFamilies {
+		cf.current.AddLiveFiles(live)
+	}
+	for v := range db.versionRefs {
+		v.AddLiveFiles(live)
+	}
+	minPending := uint64(math.MaxUint64)
+	for number := range db.pendingOutputs {
+		minPending = min(minPending, number)
+	}
+
+	names, err := db.option.FS.List(db.name)
+	if err != nil {
+		logrus.Errorf("read dir %s failed, err:%v", db.name, err)
 		return
 	}
-	db.bgCompactionScheduled = true
-	go db.backgroundCall()
+	for _, name := range names {
+		keep := true
+		switch tp, number := util.ParseFileName(name); tp {
+		case util.FileTypeSstable:
+			_, keep = live[number]
+			keep = keep || number >= minPending
+		case util.FileTypeManifest:
+			keep = number == db.manifestNumber
+		case util.FileTypeTemp:
+			keep = false
+		}
+
+		if !keep {
+			logrus.Debugf("remove obsolete file %s", name)
+			if err := db.option.FS.Remove(filepath.Join(db.name, name)); err != nil {
+				logrus.Errorf("remove %s failed, err:%v", name, err)
+			}
+		}
+	}
 }
 
-func (db *Db) backgroundCall() {
+// 启动一个 flush worker 和 option.MaxBackgroundCompactions 个 compaction worker
+//
+// flush 和 compaction 分开执行, 耗时较长的 compaction 不会阻塞 imm 的刷盘,
+// 多个 compaction worker 可以并发处理互不重叠的文件
+func (db *Db) startBackgroundWorkers() {
+	db.bgWorkers.Add(1)
+	go db.flushWorker()
+
+	for range max(db.option.MaxBackgroundCompactions, 1) {
+		db.bgWorkers.Add(1)
+		go db.compactionWorker()
+	}
+}
+
+func (db *Db) flushWorker() {
+	defer db.bgWorkers.Done()
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	db.backgroundCompaction()
-	db.bgCompactionScheduled = false
-	db.cond.Broadcast()
+
+	for {
+		var cf *ColumnFamilyHandle
+		for !db.shuttingDown {
+			if db.bgErr == nil {
+				if cf = db.pickFlush(); cf != nil {
+					break
+				}
+			}
+			db.cond.Wait()
+		}
+		if cf == nil {
+			return
+		}
+		db.flushMemTable(cf)
+	}
+}
+
+func (db *Db) compactionWorker() {
+	defer db.bgWorkers.Done()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for {
+		var (
+			cf *ColumnFamilyHandle
+			c  *version.Compaction
+		)
+		for !db.shuttingDown {
+			if db.bgErr == nil {
+				if cf, c = db.pickCompaction(); c != nil {
+					break
+				}
+			}
+			db.cond.Wait()
+		}
+		if c == nil {
+			return
+		}
+		db.compact(cf, c)
+	}
+}
+
+// 返回 imm 等待写入的 column family
+// 调用前需持有 db.mu
+func (db *Db) pickFlush() *ColumnFamilyHandle {
+	for _, cf := range db.columnFamilies {
+		if cf.imm != nil {
+			return cf
+		}
+	}
+	return nil
+}
+
+// 依次在各个 column family 中选择 compaction
+// 调用前需持有 db.mu
+func (db *Db) pickCompaction() (*ColumnFamilyHandle, *version.Compaction) {
+	for _, cf := range db.columnFamilies {
+		c := cf.current.PickCompaction()
+		if c == nil {
+			continue
+		}
+		snapshots := make([]uint64, 0, len(db.snapshots))
+		for s := range db.snapshots {
+			snapshots = append(snapshots, s.seq)
+		}
+		c.SetSnapshots(snapshots)
+		return cf, c
+	}
+	return nil, nil
 }
 
-func (db *Db) backgroundCompaction() {
-	imm := db.imm
-	version := db.current.Copy()
+// minor compaction, 调用前需持有 db.mu
+// 写入 sstable 期间释放锁
+func (db *Db) flushMemTable(cf *ColumnFamilyHandle) {
+	imm := cf.imm
+	current := cf.current
+	pending := db.addPendingOutput()
+	defer db.removePendingOutput(pending)
 	db.mu.Unlock()
 
-	// minor compaction
-	if imm != nil {
-		version.WriteLevel0Table(imm)
+	meta, err := current.BuildTable(imm)
+
+	db.mu.Lock()
+	if err == nil && meta != nil {
+		err = db.installVersion(cf, func(v *version.Version) {
+			v.ApplyFlush(meta)
+		})
 	}
-	// major compaction
-	for version.Compact() {
-		version.Debug()
+	if err != nil {
+		logrus.Errorf("flush memtable of column family %s failed, err:%v", cf.name, err)
+		db.bgErr = err
+	} else {
+		cf.imm = nil
+		cf.immLogStart = nil
+		db.removeObsoleteFiles()
+		db.truncateWAL()
 	}
-	descriptorNumber, _ := version.Save()
-	db.SetCurrentFile(descriptorNumber)
+	// 唤醒等待 imm 的写入和等待新文件的 compaction worker
+	db.cond.Broadcast()
+}
+
+// major compaction, 调用前需持有 db.mu
+// 合并期间释放锁, c 的输入文件已被标记, 不会被其它 compaction 选中
+func (db *Db) compact(cf *ColumnFamilyHandle, c *version.Compaction) {
+	db.runningCompactions++
+	defer func() { db.runningCompactions-- }()
+	current := cf.current
+	pending := db.addPendingOutput()
+	defer db.removePendingOutput(pending)
+	db.mu.Unlock()
+
+	outputs, err := current.RunCompaction(c)
+
 	db.mu.Lock()
-	db.imm = nil
-	db.current = version
+	if err == nil {
+		// 期间 current 可能已被 flush 或其它 compaction 替换
+		err = db.installVersion(cf, func(v *version.Version) {
+			v.ApplyCompaction(c, outputs)
+		})
+	}
+	// 安装完成后才释放输入文件, 否则可能被再次选中
+	c.Release()
+	if err != nil {
+		logrus.Errorf("compaction of column family %s failed, err:%v", cf.name, err)
+		db.bgErr = err
+	} else {
+		db.removeObsoleteFiles()
+	}
+	db.cond.Broadcast()
+}
+
+// 基于 cf.current 生成新的 version, 保存 manifest 后替换 cf.current
+// 调用前需持有 db.mu
+func (db *Db) installVersion(cf *ColumnFamilyHandle, edit func(v *version.Version)) error {
+	prev := cf.current
+	cf.current = prev.Copy()
+	edit(cf.current)
+	if err := db.saveManifest(); err != nil {
+		cf.current = prev
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,1368 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"lsm/internal/util"
+	"lsm/pkg/comparator"
+	"lsm/pkg/encryption"
+	"lsm/pkg/memtable"
+	"lsm/pkg/merge"
+	"lsm/pkg/version"
+	"lsm/pkg/vfs"
+	"lsm/pkg/wal"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	logrus.SetLevel(logrus.FatalLevel)
+}
+
+func openTestDb(t *testing.T, dbName string, option Option) *Db {
+	db, err := Open(dbName, option)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	return db
+}
+
+func TestDbFlush(t *testing.T) {
+	const dbName = "TestDbFlush"
+	defer os.RemoveAll(dbName)
+
+	option := DefaultOptions
+	option.MemTableSize = math.MaxUint64
+	db := openTestDb(t, dbName, option)
+	defer db.Close()
+
+	for i := range 100 {
+		assert.Nil(t, db.Put(fmt.Appendf(nil, "key-%03d", i), fmt.Appendf(nil, "value-%03d", i)))
+	}
+	assert.Equal(t, 0, db.defaultCF.current.NumLevelFiles(0))
+
+	assert.Nil(t, db.Flush(true))
+	assert.Equal(t, 1, db.defaultCF.current.NumLevelFiles(0))
+	assert.True(t, db.defaultCF.mem.Empty())
+	assert.Nil(t, db.defaultCF.imm)
+
+	// 空的 memtable 不会产生新的 sstable
+	assert.Nil(t, db.Flush(true))
+	assert.Equal(t, 1, db.defaultCF.current.NumLevelFiles(0))
+
+	// memtable 中的删除记录需要屏蔽 level 0 中的旧数据
+	assert.Nil(t, db.Delete([]byte("key-000")))
+	_, ok := db.Get([]byte("key-000"), math.MaxUint64)
+	assert.False(t, ok)
+
+	assert.Nil(t, db.Flush(true))
+	assert.Equal(t, 2, db.defaultCF.current.NumLevelFiles(0))
+	_, ok = db.Get([]byte("key-000"), math.MaxUint64)
+	assert.False(t, ok)
+
+	for i := 1; i < 100; i++ {
+		value, ok := db.Get(fmt.Appendf(nil, "key-%03d", i), math.MaxUint64)
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Appendf(nil, "value-%03d", i), value)
+	}
+}
+
+func TestDbCloseAndReopen(t *testing.T) {
+	const dbName = "TestDbCloseAndReopen"
+	defer os.RemoveAll(dbName)
+
+	for _, flushOnClose := range []bool{true, false} {
+		os.RemoveAll(dbName)
+
+		option := DefaultOptions
+		option.MemTableSize = math.MaxUint64
+		option.FlushOnClose = flushOnClose
+		db := openTestDb(t, dbName, option)
+		for i := range 100 {
+			assert.Nil(t, db.Put(fmt.Appendf(nil, "key-%03d", i), fmt.Appendf(nil, "value-%03d", i)))
+		}
+		assert.Nil(t, db.Close())
+		assert.Equal(t, ErrClosed, db.Put([]byte("key"), []byte("value")))
+		if flushOnClose {
+			assert.Equal(t, 1, db.defaultCF.current.NumLevelFiles(0))
+		} else {
+			assert.Equal(t, 0, db.defaultCF.current.NumLevelFiles(0))
+		}
+
+		db = openTestDb(t, dbName, option)
+		for i := range 100 {
+			value, ok := db.Get(fmt.Appendf(nil, "key-%03d", i), math.MaxUint64)
+			assert.True(t, ok)
+			assert.Equal(t, fmt.Appendf(nil, "value-%03d", i), value)
+		}
+
+		// 重放 wal 后 seq 继续递增
+		assert.Nil(t, db.Put([]byte("key-000"), []byte("new-value")))
+		value, ok := db.Get([]byte("key-000"), math.MaxUint64)
+		assert.True(t, ok)
+		assert.Equal(t, []byte("new-value"), value)
+		assert.Nil(t, db.Close())
+	}
+}
+
+func TestDbCompactionPicker(t *testing.T) {
+	const dbName = "TestDbCompactionPicker"
+	defer os.RemoveAll(dbName)
+
+	pickers := map[string]version.CompactionPicker{
+		"leveled":   nil,
+		"universal": version.NewUniversalCompactionPicker(version.DefaultUniversalOptions),
+	}
+	for name, picker := range pickers {
+		t.Run(name, func(t *testing.T) {
+			os.RemoveAll(dbName)
+			option := DefaultOptions
+			option.CompactionPicker = picker
+			db := openTestDb(t, dbName, option)
+
+			const keyN = 2000
+			for i := range keyN {
+				assert.Nil(t, db.Put(fmt.Appendf(nil, "key-%05d", i%500), fmt.Appendf(nil, "value-%05d", i)))
+			}
+			assert.Nil(t, db.Flush(true))
+
+			for i := keyN - 500; i < keyN; i++ {
+				value, ok := db.Get(fmt.Appendf(nil, "key-%05d", i%500), math.MaxUint64)
+				assert.True(t, ok)
+				assert.Equal(t, fmt.Appendf(nil, "value-%05d", i), value)
+			}
+			assert.Less(t, db.defaultCF.current.NumLevelFiles(0), version.L0_SlowdownWritesTrigger)
+			assert.Nil(t, db.Close())
+		})
+	}
+}
+
+func TestDbBackgroundWorkers(t *testing.T) {
+	const dbName = "TestDbBackgroundWorkers"
+	defer os.RemoveAll(dbName)
+
+	option := DefaultOptions
+	option.MaxBackgroundCompactions = 4
+	db := openTestDb(t, dbName, option)
+
+	const (
+		writerN = 4
+		keyN    = 2000
+	)
+	var wg sync.WaitGroup
+	for w := range writerN {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range keyN {
+				assert.Nil(t, db.Put(fmt.Appendf(nil, "key-%d-%05d", w, i), fmt.Appendf(nil, "value-%d-%05d", w, i)))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Nil(t, db.Flush(true))
+
+	for w := range writerN {
+		for i := range keyN {
+			value, ok := db.Get(fmt.Appendf(nil, "key-%d-%05d", w, i), math.MaxUint64)
+			assert.True(t, ok)
+			assert.Equal(t, fmt.Appendf(nil, "value-%d-%05d", w, i), value)
+		}
+	}
+	assert.Nil(t, db.Close())
+
+	// 磁盘上只保留 current 引用的 sstable
+	db = openTestDb(t, dbName, option)
+	defer db.Close()
+	live := make(map[uint64]struct{})
+	db.defaultCF.current.AddLiveFiles(live)
+	entries, err := os.ReadDir(dbName)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		if tp, number := util.ParseFileName(entry.Name()); tp == util.FileTypeSstable {
+			assert.Contains(t, live, number)
+		}
+	}
+	value, ok := db.Get([]byte("key-0-00000"), math.MaxUint64)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value-0-00000"), value)
+}
+
+func TestDbSnapshot(t *testing.T) {
+	const dbName = "TestDbSnapshot"
+	defer os.RemoveAll(dbName)
+
+	option := DefaultOptions
+	option.CompactionFilter = version.CompactionFilterFunc(func(ctx version.CompactionFilterContext, userKey, value []byte) (version.CompactionFilterDecision, []byte) {
+		return version.CompactionFilterRemove, nil
+	})
+	db := openTestDb(t, dbName, option)
+	defer db.Close()
+
+	assert.Nil(t, db.Put([]byte("key"), []byte("value-0")))
+	snapshot := db.GetSnapshot()
+	assert.Nil(t, db.Put([]byte("key"), []byte("value-1")))
+
+	// 触发多轮 flush 与 compaction
+	for i := range 2000 {
+		assert.Nil(t, db.Put(fmt.Appendf(nil, "key-%05d", i), fmt.Appendf(nil, "value-%05d", i)))
+	}
+	assert.Nil(t, db.Flush(true))
+
+	// snapshot 可见的记录不会被 compaction 删除
+	value, ok := db.Get([]byte("key"), snapshot.Seq())
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value-0"), value)
+	db.ReleaseSnapshot(snapshot)
+}
+
+func TestDbMerge(t *testing.T) {
+	const dbName = "TestDbMerge"
+	defer os.RemoveAll(dbName)
+
+	db := openTestDb(t, dbName, DefaultOptions)
+	assert.Equal(t, ErrNoMergeOperator, db.Merge([]byte("counter"), nil))
+	assert.Nil(t, db.Close())
+	os.RemoveAll(dbName)
+
+	option := DefaultOptions
+	option.MergeOperator = merge.UInt64AddOperator{}
+	db = openTestDb(t, dbName, option)
+	defer db.Close()
+
+	one := binary.LittleEndian.AppendUint64(nil, 1)
+	const counterN = 20
+	for round := range 100 {
+		for i := range counterN {
+			assert.Nil(t, db.Merge(fmt.Appendf(nil, "counter-%02d", i), one))
+		}
+		// operand 分布在 memtable 与各层 sstable 中
+		if round%10 == 0 {
+			assert.Nil(t, db.Flush(true))
+		}
+	}
+	assert.Nil(t, db.Put([]byte("counter-00"), binary.LittleEndian.AppendUint64(nil, 1000)))
+	assert.Nil(t, db.Merge([]byte("counter-00"), one))
+	assert.Nil(t, db.Delete([]byte("counter-01")))
+
+	expected := func(i int) (uint64, bool) {
+		switch i {
+		case 0:
+			return 1001, true
+		case 1:
+			return 0, false
+		default:
+			return 100, true
+		}
+	}
+	for i := range counterN {
+		value, ok := db.Get(fmt.Appendf(nil, "counter-%02d", i), math.MaxUint64)
+		n, exist := expected(i)
+		assert.Equal(t, exist, ok)
+		if exist {
+			assert.Equal(t, n, binary.LittleEndian.Uint64(value))
+		}
+	}
+
+	// 迭代器同样合并 operand, 并跳过删除的 key
+	iter, err := db.NewIterator(math.MaxUint64)
+	assert.Nil(t, err)
+	defer iter.Close()
+	i := 0
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		if i == 1 {
+			i++
+		}
+		n, _ := expected(i)
+		assert.Equal(t, fmt.Appendf(nil, "counter-%02d", i), iter.Key())
+		assert.Equal(t, n, binary.LittleEndian.Uint64(iter.Value()))
+		i++
+	}
+	assert.Equal(t, counterN, i)
+
+	iter.Seek([]byte("counter-10"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("counter-10"), iter.Key())
+}
+
+func TestDbDeleteRange(t *testing.T) {
+	const dbName = "TestDbDeleteRange"
+	defer os.RemoveAll(dbName)
+
+	db := openTestDb(t, dbName, DefaultOptions)
+	assert.Equal(t, ErrInvalidRange, db.DeleteRange([]byte("b"), []byte("a")))
+
+	const keyN = 1000
+	userKey := func(i int) []byte {
+		return fmt.Appendf(nil, "key-%05d", i)
+	}
+	for i := range keyN {
+		assert.Nil(t, db.Put(userKey(i), fmt.Appendf(nil, "value-%05d", i)))
+	}
+	assert.Nil(t, db.Flush(true))
+	snapshot := db.GetSnapshot()
+
+	// 删除 [100, 300), 之后重新写入 200
+	assert.Nil(t, db.DeleteRange(userKey(100), userKey(300)))
+	assert.Nil(t, db.Put(userKey(200), []byte("new")))
+
+	deleted := func(i int) bool {
+		return i >= 100 && i < 300 && i != 200
+	}
+	check := func(total int) {
+		for i := range keyN {
+			value, ok := db.Get(userKey(i), math.MaxUint64)
+			assert.Equal(t, !deleted(i), ok)
+			if i == 200 {
+				assert.Equal(t, []byte("new"), value)
+			}
+
+			// snapshot 仍能看到被删除的数据
+			_, ok = db.Get(userKey(i), snapshot.Seq())
+			assert.True(t, ok)
+		}
+
+		iter, err := db.NewIterator(math.MaxUint64)
+		assert.Nil(t, err)
+		defer iter.Close()
+		n := 0
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			assert.False(t, deleted(n))
+			n++
+			for deleted(n) {
+				n++
+			}
+		}
+		assert.Equal(t, total, n)
+	}
+
+	// tombstone 位于 memtable
+	check(keyN)
+
+	// tombstone 经过 flush 与 compaction 写入 sstable
+	for i := keyN; i < 3*keyN; i++ {
+		assert.Nil(t, db.Put(userKey(i), fmt.Appendf(nil, "value-%05d", i)))
+	}
+	assert.Nil(t, db.Flush(true))
+	check(3 * keyN)
+	db.ReleaseSnapshot(snapshot)
+	assert.Nil(t, db.Close())
+
+	// 重新打开后, 从 manifest 与 wal 恢复的 tombstone 依然有效
+	db = openTestDb(t, dbName, DefaultOptions)
+	defer db.Close()
+	for i := range keyN {
+		_, ok := db.Get(userKey(i), math.MaxUint64)
+		assert.Equal(t, !deleted(i), ok)
+	}
+}
+
+func TestDbTTL(t *testing.T) {
+	const dbName = "TestDbTTL"
+	defer os.RemoveAll(dbName)
+
+	// 后台 compaction 同样会读取时钟
+	var now atomic.Int64
+	now.Store(time.Unix(1000, 0).UnixNano())
+	advance := func(d time.Duration) {
+		now.Add(int64(d))
+	}
+	option := DefaultOptions
+	option.Clock = func() time.Time { return time.Unix(0, now.Load()) }
+	db := openTestDb(t, dbName, option)
+
+	assert.Equal(t, ErrInvalidTTL, db.PutWithTTL([]byte("a"), []byte("a"), 0))
+	assert.Nil(t, db.PutWithTTL([]byte("a"), []byte("a"), 10*time.Second))
+	assert.Nil(t, db.Put([]byte("b"), []byte("b")))
+	// 过期后旧的 value 同样不可见
+	assert.Nil(t, db.Put([]byte("c"), []byte("old")))
+	assert.Nil(t, db.PutWithTTL([]byte("c"), []byte("c"), 5*time.Second))
+
+	expect := func(keys ...string) {
+		for _, k := range []string{"a", "b", "c"} {
+			value, ok := db.Get([]byte(k), math.MaxUint64)
+			if assert.Equal(t, slices.Contains(keys, k), ok, k) && ok {
+				assert.Equal(t, []byte(k), value)
+			}
+		}
+
+		iter, err := db.NewIterator(math.MaxUint64)
+		assert.Nil(t, err)
+		defer iter.Close()
+		var actual []string
+		for iter.Seek([]byte("a")); iter.Valid() && string(iter.Key()) <= "c"; iter.Next() {
+			actual = append(actual, string(iter.Key()))
+		}
+		assert.Equal(t, keys, actual)
+	}
+
+	expect("a", "b", "c")
+	advance(5 * time.Second)
+	expect("a", "b")
+
+	// 过期时间随记录写入 sstable
+	for i := range 2000 {
+		assert.Nil(t, db.Put(fmt.Appendf(nil, "key-%05d", i), fmt.Appendf(nil, "value-%05d", i)))
+	}
+	assert.Nil(t, db.Flush(true))
+	expect("a", "b")
+	advance(5 * time.Second)
+	expect("b")
+
+	// 过期时间随记录写入 wal, 重新打开后依然有效
+	assert.Nil(t, db.PutWithTTL([]byte("a"), []byte("a"), 10*time.Second))
+	assert.Nil(t, db.Close())
+	option.FlushOnClose = false
+	db = openTestDb(t, dbName, option)
+	defer db.Close()
+	expect("a", "b")
+	advance(10 * time.Second)
+	expect("b")
+
+	// 其他 column family 中的记录同样可以指定 ttl, 且不影响 default 中的同名 key
+	cf, err := db.CreateColumnFamily("ttl", DefaultColumnFamilyOptions)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrInvalidTTL, db.PutWithTTLCF(cf, []byte("b"), []byte("b"), 0))
+	assert.Nil(t, db.PutWithTTLCF(cf, []byte("b"), []byte("ttl"), 10*time.Second))
+	value, ok := db.GetCF(cf, []byte("b"), math.MaxUint64)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("ttl"), value)
+	advance(10 * time.Second)
+	_, ok = db.GetCF(cf, []byte("b"), math.MaxUint64)
+	assert.False(t, ok)
+	expect("b")
+}
+
+func TestDbColumnFamily(t *testing.T) {
+	const dbName = "TestDbColumnFamily"
+	defer os.RemoveAll(dbName)
+
+	counterOptions := DefaultColumnFamilyOptions
+	counterOptions.MemTableSize = 256
+	counterOptions.MergeOperator = merge.UInt64AddOperator{}
+
+	option := DefaultOptions
+	option.FlushOnClose = false
+	db := openTestDb(t, dbName, option)
+	counters, err := db.CreateColumnFamily("counters", counterOptions)
+	assert.Nil(t, err)
+	_, err = db.CreateColumnFamily("counters", counterOptions)
+	assert.Equal(t, ErrColumnFamilyExists, err)
+
+	// 不同 column family 中的同名 key 互不影响
+	one := binary.LittleEndian.AppendUint64(nil, 1)
+	assert.Nil(t, db.Put([]byte("key"), []byte("default")))
+	assert.Nil(t, db.PutCF(counters, []byte("key"), binary.LittleEndian.AppendUint64(nil, 10)))
+	assert.Nil(t, db.MergeCF(counters, []byte("key"), one))
+	assert.Equal(t, ErrNoMergeOperator, db.Merge([]byte("key"), one))
+
+	// batch 中任意一条记录不合法时, 整个 batch 都不会写入
+	batch := NewWriteBatch()
+	batch.Put([]byte("batch"), []byte("default"))
+	batch.MergeCF(counters, []byte("batch"), one)
+	batch.Merge([]byte("batch"), one)
+	assert.Equal(t, ErrNoMergeOperator, db.Write(batch))
+	_, ok := db.Get([]byte("batch"), math.MaxUint64)
+	assert.False(t, ok)
+
+	batch.Clear()
+	batch.Put([]byte("batch"), []byte("default"))
+	batch.MergeCF(counters, []byte("batch"), one)
+	batch.DeleteCF(counters, []byte("deleted"))
+	assert.Nil(t, db.Write(batch))
+
+	check := func(db *Db, counters *ColumnFamilyHandle) {
+		value, ok := db.Get([]byte("key"), math.MaxUint64)
+		assert.True(t, ok)
+		assert.Equal(t, []byte("default"), value)
+		value, ok = db.GetCF(counters, []byte("key"), math.MaxUint64)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(11), binary.LittleEndian.Uint64(value))
+		value, ok = db.Get([]byte("batch"), math.MaxUint64)
+		assert.True(t, ok)
+		assert.Equal(t, []byte("default"), value)
+		value, ok = db.GetCF(counters, []byte("batch"), math.MaxUint64)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(1), binary.LittleEndian.Uint64(value))
+
+		iter, err := db.NewIteratorCF(counters, math.MaxUint64)
+		assert.Nil(t, err)
+		defer iter.Close()
+		var keys []string
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			if !bytes.HasPrefix(iter.Key(), []byte("counter-")) {
+				keys = append(keys, string(iter.Key()))
+			}
+		}
+		assert.Equal(t, []string{"batch", "key"}, keys)
+	}
+	check(db, counters)
+
+	// 重放 wal 时, 记录回到各自的 column family
+	assert.Nil(t, db.Close())
+	option.ColumnFamilies = map[string]ColumnFamilyOptions{"counters": counterOptions}
+	db = openTestDb(t, dbName, option)
+	counters, ok = db.ColumnFamily("counters")
+	assert.True(t, ok)
+	check(db, counters)
+
+	// 各个 column family 的 memtable 大小不同, 分别刷入自己的 level
+	for i := range 100 {
+		assert.Nil(t, db.MergeCF(counters, fmt.Appendf(nil, "counter-%02d", i%10), one))
+	}
+	assert.Greater(t, counters.current.NumLevelFiles(0)+counters.current.NumLevelFiles(1), 0)
+	assert.Equal(t, 0, db.defaultCF.current.NumLevelFiles(0))
+	assert.Nil(t, db.Flush(true))
+	assert.Nil(t, db.Close())
+
+	// 重新打开后从 manifest 恢复
+	db = openTestDb(t, dbName, option)
+	defer db.Close()
+	counters, ok = db.ColumnFamily("counters")
+	assert.True(t, ok)
+	check(db, counters)
+	for i := range 10 {
+		value, ok := db.GetCF(counters, fmt.Appendf(nil, "counter-%02d", i), math.MaxUint64)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(10), binary.LittleEndian.Uint64(value))
+	}
+}
+
+func TestDbTransaction(t *testing.T) {
+	const dbName = "TestDbTransaction"
+	defer os.RemoveAll(dbName)
+
+	db := openTestDb(t, dbName, DefaultOptions)
+	defer db.Close()
+	assert.Nil(t, db.Put([]byte("a"), []byte("0")))
+
+	// 读取自身的写入
+	txn := db.BeginTransaction()
+	value, ok := txn.Get([]byte("a"))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("0"), value)
+	assert.Nil(t, txn.Put([]byte("a"), []byte("1")))
+	value, _ = txn.Get([]byte("a"))
+	assert.Equal(t, []byte("1"), value)
+	assert.Nil(t, txn.Delete([]byte("b")))
+	_, ok = txn.Get([]byte("b"))
+	assert.False(t, ok)
+	// 提交前对外不可见
+	value, _ = db.Get([]byte("a"), math.MaxUint64)
+	assert.Equal(t, []byte("0"), value)
+	assert.Nil(t, txn.Commit())
+	assert.Equal(t, ErrTxnDone, txn.Commit())
+	value, _ = db.Get([]byte("a"), math.MaxUint64)
+	assert.Equal(t, []byte("1"), value)
+
+	// 读取过的 key 在 snapshot 之后被修改, 无论修改位于 memtable、sstable 还是 range tombstone
+	modifies := map[string]func(){
+		"memtable": func() { assert.Nil(t, db.Put([]byte("a"), []byte("2"))) },
+		"sstable": func() {
+			assert.Nil(t, db.Put([]byte("a"), []byte("2")))
+			assert.Nil(t, db.Flush(true))
+		},
+		"range tombstone": func() { assert.Nil(t, db.DeleteRange([]byte("a"), []byte("b"))) },
+	}
+	for name, modify := range modifies {
+		t.Run(name, func(t *testing.T) {
+			txn := db.BeginTransaction()
+			txn.Get([]byte("a"))
+			assert.Nil(t, txn.Put([]byte("c"), []byte("c")))
+			modify()
+			assert.Equal(t, ErrConflict, txn.Commit())
+			_, ok := db.Get([]byte("c"), math.MaxUint64)
+			assert.False(t, ok)
+		})
+	}
+
+	// 只写入而未读取的 key 同样检查冲突
+	txn = db.BeginTransaction()
+	assert.Nil(t, txn.Put([]byte("a"), []byte("3")))
+	assert.Nil(t, db.Put([]byte("a"), []byte("4")))
+	assert.Equal(t, ErrConflict, txn.Commit())
+
+	txn = db.BeginTransaction()
+	assert.Nil(t, txn.Put([]byte("a"), []byte("5")))
+	assert.Nil(t, txn.Rollback())
+	assert.Equal(t, ErrTxnDone, txn.Put([]byte("a"), []byte("5")))
+	value, _ = db.Get([]byte("a"), math.MaxUint64)
+	assert.Equal(t, []byte("4"), value)
+
+	// 并发的 read-modify-write 在冲突时重试, 不会丢失更新
+	const workers, rounds = 8, 50
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range rounds {
+				for {
+					txn := db.BeginTransaction()
+					var n uint64
+					if value, ok := txn.Get([]byte("counter")); ok {
+						n = binary.LittleEndian.Uint64(value)
+					}
+					assert.Nil(t, txn.Put([]byte("counter"), binary.LittleEndian.AppendUint64(nil, n+1)))
+					if err := txn.Commit(); err == nil {
+						break
+					} else {
+						assert.Equal(t, ErrConflict, err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	value, ok = db.Get([]byte("counter"), math.MaxUint64)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(workers*rounds), binary.LittleEndian.Uint64(value))
+}
+
+func TestDbTransactionColumnFamily(t *testing.T) {
+	const dbName = "TestDbTransactionColumnFamily"
+	defer os.RemoveAll(dbName)
+
+	db := openTestDb(t, dbName, DefaultOptions)
+	defer db.Close()
+	cf, err := db.CreateColumnFamily("txn", DefaultColumnFamilyOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("a"), []byte("default")))
+	assert.Nil(t, db.PutCF(cf, []byte("a"), []byte("0")))
+
+	// 不同 column family 中的同名 key 互不影响, 提交时原子地写入
+	txn := db.BeginTransaction()
+	value, ok := txn.GetCF(cf, []byte("a"))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("0"), value)
+	assert.Nil(t, txn.PutCF(cf, []byte("a"), []byte("1")))
+	assert.Nil(t, txn.DeleteCF(cf, []byte("b")))
+	value, _ = txn.GetCF(cf, []byte("a"))
+	assert.Equal(t, []byte("1"), value)
+	value, _ = txn.Get([]byte("a"))
+	assert.Equal(t, []byte("default"), value)
+	assert.Nil(t, txn.Put([]byte("b"), []byte("default")))
+	assert.Nil(t, txn.Commit())
+	value, _ = db.GetCF(cf, []byte("a"), math.MaxUint64)
+	assert.Equal(t, []byte("1"), value)
+	value, _ = db.Get([]byte("b"), math.MaxUint64)
+	assert.Equal(t, []byte("default"), value)
+
+	// 冲突按 column family 检查, 其他 column family 中同名 key 的修改不构成冲突
+	txn = db.BeginTransaction()
+	txn.GetCF(cf, []byte("a"))
+	assert.Nil(t, txn.Put([]byte("c"), []byte("c")))
+	assert.Nil(t, db.Put([]byte("a"), []byte("default")))
+	assert.Nil(t, txn.Commit())
+
+	txn = db.BeginTransaction()
+	txn.GetCF(cf, []byte("a"))
+	assert.Nil(t, txn.Put([]byte("d"), []byte("d")))
+	assert.Nil(t, db.PutCF(cf, []byte("a"), []byte("2")))
+	assert.Equal(t, ErrConflict, txn.Commit())
+	_, ok = db.Get([]byte("d"), math.MaxUint64)
+	assert.False(t, ok)
+}
+
+func TestTransactionDB(t *testing.T) {
+	const dbName = "TestTransactionDB"
+	defer os.RemoveAll(dbName)
+
+	db := openTestDb(t, dbName, DefaultOptions)
+	defer db.Close()
+	option := DefaultTransactionDBOptions
+	option.LockTimeout = 50 * time.Millisecond
+	tdb := NewTransactionDB(db, option)
+
+	// 锁被持有时等待超时, 释放后可以获取
+	txn1 := tdb.BeginTransaction()
+	_, ok, err := txn1.GetForUpdate([]byte("a"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Nil(t, txn1.Put([]byte("a"), []byte("1")))
+	txn2 := tdb.BeginTransaction()
+	assert.Equal(t, ErrLockTimeout, txn2.Put([]byte("a"), []byte("2")))
+	// 不加锁的读取看不到未提交的写入
+	_, ok = txn2.Get([]byte("a"))
+	assert.False(t, ok)
+	assert.Nil(t, txn1.Commit())
+	value, ok, err := txn2.GetForUpdate([]byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), value)
+	assert.Nil(t, txn2.Rollback())
+
+	// txn1 持有 a 等待 b, txn2 持有 b 再等待 a 时形成环
+	tdb = NewTransactionDB(db, DefaultTransactionDBOptions)
+	txn1, txn2 = tdb.BeginTransaction(), tdb.BeginTransaction()
+	assert.Nil(t, txn1.Put([]byte("a"), []byte("a1")))
+	assert.Nil(t, txn2.Put([]byte("b"), []byte("b2")))
+	done := make(chan error)
+	go func() {
+		done <- txn1.Put([]byte("b"), []byte("b1"))
+	}()
+	assert.Eventually(t, func() bool {
+		tdb.locks.waitMu.Lock()
+		defer tdb.locks.waitMu.Unlock()
+		return tdb.locks.waitFor[txn1.id] == txn2.id
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, ErrDeadlock, txn2.Put([]byte("a"), []byte("a2")))
+	assert.Nil(t, txn2.Rollback())
+	assert.Nil(t, <-done)
+	assert.Nil(t, txn1.Commit())
+	value, _ = db.Get([]byte("b"), math.MaxUint64)
+	assert.Equal(t, []byte("b1"), value)
+
+	// GetForUpdate 保证 read-modify-write 不需要重试
+	const workers, rounds = 8, 50
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range rounds {
+				txn := tdb.BeginTransaction()
+				value, ok, err := txn.GetForUpdate([]byte("counter"))
+				assert.Nil(t, err)
+				var n uint64
+				if ok {
+					n = binary.LittleEndian.Uint64(value)
+				}
+				assert.Nil(t, txn.Put([]byte("counter"), binary.LittleEndian.AppendUint64(nil, n+1)))
+				assert.Nil(t, txn.Commit())
+			}
+		}()
+	}
+	wg.Wait()
+	value, ok = db.Get([]byte("counter"), math.MaxUint64)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(workers*rounds), binary.LittleEndian.Uint64(value))
+}
+
+func TestWriteBatchWithIndex(t *testing.T) {
+	const dbName = "TestWriteBatchWithIndex"
+	defer os.RemoveAll(dbName)
+
+	db := openTestDb(t, dbName, DefaultOptions)
+	defer db.Close()
+	for _, k := range []string{"a", "c", "e", "g"} {
+		assert.Nil(t, db.Put([]byte(k), []byte("db-"+k)))
+	}
+
+	batch := NewWriteBatchWithIndex()
+	batch.Put([]byte("b"), []byte("batch-b"))
+	batch.Put([]byte("c"), []byte("batch-c0"))
+	batch.Put([]byte("c"), []byte("batch-c1"))
+	batch.Delete([]byte("e"))
+	batch.Put([]byte("f"), []byte("batch-f"))
+	batch.Delete([]byte("f"))
+	batch.Put([]byte("h"), []byte("batch-h"))
+	assert.Equal(t, 7, batch.Count())
+
+	expected := map[string]string{
+		"a": "db-a",
+		"b": "batch-b",
+		"c": "batch-c1",
+		"g": "db-g",
+		"h": "batch-h",
+	}
+	for _, k := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		value, ok := batch.GetFromBatchAndDB(db, []byte(k))
+		v, exist := expected[k]
+		assert.Equal(t, exist, ok, k)
+		if exist {
+			assert.Equal(t, []byte(v), value)
+		}
+	}
+
+	collect := func(seek []byte) []string {
+		base, err := db.NewIterator(math.MaxUint64)
+		assert.Nil(t, err)
+		iter := batch.NewIteratorWithBase(base)
+		defer iter.Close()
+		var kvs []string
+		if seek == nil {
+			iter.SeekToFirst()
+		} else {
+			iter.Seek(seek)
+		}
+		for ; iter.Valid(); iter.Next() {
+			kvs = append(kvs, string(iter.Key())+"="+string(iter.Value()))
+		}
+		return kvs
+	}
+	assert.Equal(t, []string{"a=db-a", "b=batch-b", "c=batch-c1", "g=db-g", "h=batch-h"}, collect(nil))
+	assert.Equal(t, []string{"c=batch-c1", "g=db-g", "h=batch-h"}, collect([]byte("c")))
+	assert.Equal(t, []string{"g=db-g", "h=batch-h"}, collect([]byte("d")))
+
+	// 提交后 db 中的结果与叠加视图一致
+	assert.Nil(t, db.Write(batch.WriteBatch()))
+	for _, k := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		value, ok := db.Get([]byte(k), math.MaxUint64)
+		v, exist := expected[k]
+		assert.Equal(t, exist, ok, k)
+		if exist {
+			assert.Equal(t, []byte(v), value)
+		}
+	}
+}
+
+func TestDbFIFOCompaction(t *testing.T) {
+	const dbName = "TestDbFIFOCompaction"
+	defer os.RemoveAll(dbName)
+
+	option := DefaultOptions
+	option.CompactionPicker = version.NewFIFOCompactionPicker(version.FIFOOption{MaxTableFilesSize: 8 * 1024})
+	option.L0SlowdownWritesTrigger = 0
+	db := openTestDb(t, dbName, option)
+	defer db.Close()
+
+	for i := range 5000 {
+		assert.Nil(t, db.Put(fmt.Appendf(nil, "key-%05d", i), fmt.Appendf(nil, "value-%05d", i)))
+	}
+	assert.Nil(t, db.Flush(true))
+
+	// 所有文件都在 level 0, 且总大小不超过上限
+	total := uint64(0)
+	for _, f := range db.defaultCF.current.LevelFiles(0) {
+		total += f.FileSize()
+	}
+	assert.LessOrEqual(t, total, uint64(8*1024))
+	for level := 1; level < version.DefaultLevels; level++ {
+		assert.Equal(t, 0, db.defaultCF.current.NumLevelFiles(level))
+	}
+
+	// 被淘汰的文件已从磁盘删除
+	entries, err := os.ReadDir(dbName)
+	assert.Nil(t, err)
+	sstables := 0
+	for _, entry := range entries {
+		if tp, _ := util.ParseFileName(entry.Name()); tp == util.FileTypeSstable {
+			sstables++
+		}
+	}
+	assert.Equal(t, db.defaultCF.current.NumLevelFiles(0), sstables)
+
+	// 最旧的数据被淘汰, 最新的数据仍然可读
+	_, ok := db.Get([]byte("key-00000"), math.MaxUint64)
+	assert.False(t, ok)
+	value, ok := db.Get([]byte("key-04999"), math.MaxUint64)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value-04999"), value)
+}
+
+func TestDbMemTableRep(t *testing.T) {
+	const dbName = "TestDbMemTableRep"
+	defer os.RemoveAll(dbName)
+
+	reps := map[string]memtable.RepFactory{
+		"skiplist":     memtable.NewSkiplistRep,
+		"hashLinkList": memtable.NewHashLinkListRepFactory(memtable.FixedPrefix(4), 64),
+		"vector":       memtable.NewVectorRep,
+	}
+	for name, rep := range reps {
+		t.Run(name, func(t *testing.T) {
+			os.RemoveAll(dbName)
+
+			option := DefaultOptions
+			option.MemTableSize = 16 << 10
+			option.MemTableRep = rep
+			option.FlushOnClose = false
+			db := openTestDb(t, dbName, option)
+
+			// 写满多个 memtable, 一部分数据在 sstable 中, 一部分只在 memtable 与 wal 中
+			const N = 1000
+			for _, i := range rand.Perm(N) {
+				assert.Nil(t, db.Put(fmt.Appendf(nil, "key-%04d", i), fmt.Appendf(nil, "value-%04d", i)))
+			}
+			for i := 0; i < N; i += 3 {
+				assert.Nil(t, db.Delete(fmt.Appendf(nil, "key-%04d", i)))
+			}
+
+			check := func(db *Db) {
+				for i := range N {
+					value, ok := db.Get(fmt.Appendf(nil, "key-%04d", i), math.MaxUint64)
+					assert.Equal(t, i%3 != 0, ok)
+					if ok {
+						assert.Equal(t, fmt.Appendf(nil, "value-%04d", i), value)
+					}
+				}
+
+				iter, err := db.NewIterator(math.MaxUint64)
+				assert.Nil(t, err)
+				defer iter.Close()
+				n := 0
+				var prev []byte
+				for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+					assert.Less(t, string(prev), string(iter.Key()))
+					prev = iter.Key()
+					n++
+				}
+				assert.Equal(t, N-(N+2)/3, n)
+			}
+			check(db)
+
+			assert.Nil(t, db.Close())
+			db = openTestDb(t, dbName, option)
+			defer db.Close()
+			check(db)
+		})
+	}
+}
+
+func TestDbHashLinkListDefaultBuckets(t *testing.T) {
+	const dbName = "TestDbHashLinkListDefaultBuckets"
+	defer os.RemoveAll(dbName)
+
+	// 默认的 memtable 大小与桶数, 桶数组不应使 memtable 一写入就被 flush
+	option := DefaultOptions
+	option.MemTableRep = memtable.NewHashLinkListRepFactory(nil, 0)
+	db := openTestDb(t, dbName, option)
+	defer db.Close()
+
+	for i := range 5 {
+		assert.Nil(t, db.Put(fmt.Appendf(nil, "key-%d", i), fmt.Appendf(nil, "value-%d", i)))
+	}
+	assert.False(t, db.defaultCF.mem.Full())
+	assert.Nil(t, db.defaultCF.imm)
+	assert.Equal(t, 0, db.defaultCF.current.NumLevelFiles(0))
+	for i := range 5 {
+		value, ok := db.Get(fmt.Appendf(nil, "key-%d", i), math.MaxUint64)
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Appendf(nil, "value-%d", i), value)
+	}
+}
+
+func TestDbMemTableBloom(t *testing.T) {
+	const dbName = "TestDbMemTableBloom"
+	defer os.RemoveAll(dbName)
+
+	option := DefaultOptions
+	option.MemTableSize = 4 << 10
+	option.MemTableBloomKeys = 256
+	option.MemTableBloomPrefix = memtable.FixedPrefix(len("user-00"))
+	db := openTestDb(t, dbName, option)
+	defer db.Close()
+
+	const N = 500
+	for i := range N {
+		assert.Nil(t, db.Put(fmt.Appendf(nil, "user-%02d/%03d", i%50, i), fmt.Appendf(nil, "value-%03d", i)))
+	}
+	assert.Nil(t, db.Delete([]byte("user-00/000")))
+
+	for i := range N {
+		value, ok := db.Get(fmt.Appendf(nil, "user-%02d/%03d", i%50, i), math.MaxUint64)
+		assert.Equal(t, i != 0, ok)
+		if ok {
+			assert.Equal(t, fmt.Appendf(nil, "value-%03d", i), value)
+		}
+		_, ok = db.Get(fmt.Appendf(nil, "user-%02d/%03d", i%50+50, i), math.MaxUint64)
+		assert.False(t, ok)
+	}
+}
+
+func TestDbWALTruncate(t *testing.T) {
+	const dbName = "TestDbWALTruncate"
+	defer os.RemoveAll(dbName)
+
+	option := DefaultOptions
+	option.MemTableSize = 64 << 10
+	option.WALSegmentSize = 32 << 10
+	option.FlushOnClose = false
+	db := openTestDb(t, dbName, option)
+
+	countSegments := func() int {
+		entries, err := os.ReadDir(util.WALDirName(dbName))
+		assert.Nil(t, err)
+		return len(entries)
+	}
+	value := bytes.Repeat([]byte("v"), 100)
+	put := func(cf *ColumnFamilyHandle, start, end int) {
+		for i := start; i < end; i++ {
+			assert.Nil(t, db.PutCF(cf, fmt.Appendf(nil, "key-%05d", i), value))
+		}
+	}
+
+	// 刷盘后已持久化的 segment 被删除, wal 占用的空间有上限
+	put(db.DefaultColumnFamily(), 0, 5000)
+	assert.Nil(t, db.Flush(true))
+	assert.LessOrEqual(t, countSegments(), 2)
+
+	// 其它 column family 未刷盘的记录所在的 segment 需要保留
+	other, err := db.CreateColumnFamily("other", DefaultColumnFamilyOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, db.PutCF(other, []byte("pinned"), []byte("value")))
+	put(db.DefaultColumnFamily(), 5000, 10000)
+	db.mu.Lock()
+	db.waitForBackgroundWork()
+	db.mu.Unlock()
+	assert.Greater(t, countSegments(), 10)
+
+	// 重新打开后从 wal 中恢复未刷盘的记录
+	put(db.DefaultColumnFamily(), 10000, 10100)
+	assert.Nil(t, db.Close())
+	option.ColumnFamilies = map[string]ColumnFamilyOptions{"other": DefaultColumnFamilyOptions}
+	db = openTestDb(t, dbName, option)
+	defer db.Close()
+	other, ok := db.ColumnFamily("other")
+	assert.True(t, ok)
+	v, ok := db.GetCF(other, []byte("pinned"), math.MaxUint64)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value"), v)
+	for _, i := range []int{0, 4999, 5000, 9999, 10000, 10099} {
+		v, ok := db.Get(fmt.Appendf(nil, "key-%05d", i), math.MaxUint64)
+		assert.True(t, ok)
+		assert.Equal(t, value, v)
+	}
+
+	// other 刷盘后, 之前的 segment 都可以删除
+	assert.Nil(t, db.Flush(true))
+	assert.LessOrEqual(t, countSegments(), 2)
+}
+
+func TestDbWALRecoveryMode(t *testing.T) {
+	const dbName = "TestDbWALRecoveryMode"
+	defer os.RemoveAll(dbName)
+
+	option := DefaultOptions
+	option.MemTableSize = math.MaxUint64
+	option.FlushOnClose = false
+	db := openTestDb(t, dbName, option)
+	for i := range 100 {
+		assert.Nil(t, db.Put(fmt.Appendf(nil, "key-%03d", i), fmt.Appendf(nil, "value-%03d", i)))
+	}
+	assert.Nil(t, db.Close())
+
+	// 模拟写入 wal 时崩溃, 末尾只写入了一半的记录
+	entries, err := os.ReadDir(util.WALDirName(dbName))
+	assert.Nil(t, err)
+	fd, err := os.OpenFile(filepath.Join(util.WALDirName(dbName), entries[len(entries)-1].Name()), os.O_WRONLY|os.O_APPEND, 0)
+	assert.Nil(t, err)
+	_, err = fd.Write([]byte{1, 2, 3, 4, 0, 100, 0, 'a'})
+	assert.Nil(t, err)
+	assert.Nil(t, fd.Close())
+
+	option.WALRecoveryMode = wal.AbsoluteConsistency
+	_, err = Open(dbName, option)
+	assert.ErrorIs(t, err, wal.ErrCorrupted)
+
+	option.WALRecoveryMode = wal.TolerateCorruptedTailRecords
+	db = openTestDb(t, dbName, option)
+	defer db.Close()
+	for i := range 100 {
+		value, ok := db.Get(fmt.Appendf(nil, "key-%03d", i), math.MaxUint64)
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Appendf(nil, "value-%03d", i), value)
+	}
+}
+
+func TestDbWriteOptions(t *testing.T) {
+	const dbName = "TestDbWriteOptions"
+	defer os.RemoveAll(dbName)
+
+	option := DefaultOptions
+	option.FlushOnClose = false
+	option.WALSyncInterval = 10 * time.Millisecond
+	db := openTestDb(t, dbName, option)
+
+	// 并发的 sync 写入与普通写入
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batch := NewWriteBatch()
+			batch.Put(fmt.Appendf(nil, "key-%02d", i), []byte("value"))
+			assert.Nil(t, db.WriteWithOptions(batch, WriteOptions{Sync: i%2 == 0}))
+		}()
+	}
+	wg.Wait()
+
+	assert.Nil(t, db.WriteWithOptions(NewWriteBatch(), WriteOptions{Sync: true}))
+	assert.Nil(t, db.Close())
+
+	db = openTestDb(t, dbName, option)
+	defer db.Close()
+	for i := range 20 {
+		value, ok := db.Get(fmt.Appendf(nil, "key-%02d", i), math.MaxUint64)
+		assert.True(t, ok)
+		assert.Equal(t, []byte("value"), value)
+	}
+}
+
+func TestDbWALCompression(t *testing.T) {
+	const dbName = "TestDbWALCompression"
+	defer os.RemoveAll(dbName)
+
+	option := DefaultOptions
+	option.FlushOnClose = false
+	option.WALCompression = wal.FlateCompression
+	db := openTestDb(t, dbName, option)
+	value := bytes.Repeat([]byte(`{"field":"value"}`), 100)
+	for i := range 100 {
+		assert.Nil(t, db.Put(fmt.Appendf(nil, "key-%03d", i), value))
+	}
+	assert.Nil(t, db.Close())
+
+	// 关闭压缩后从压缩的 wal 中恢复
+	option.WALCompression = wal.NoCompression
+	db = openTestDb(t, dbName, option)
+	defer db.Close()
+	for i := range 100 {
+		v, ok := db.Get(fmt.Appendf(nil, "key-%03d", i), math.MaxUint64)
+		assert.True(t, ok)
+		assert.Equal(t, value, v)
+	}
+}
+
+func TestDbEncryption(t *testing.T) {
+	const dbName = "TestDbEncryption"
+	defer os.RemoveAll(dbName)
+
+	keys := &encryption.StaticKeyProvider{
+		CurrentID: "k1",
+		Keys:      map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+	}
+	option := DefaultOptions
+	option.FlushOnClose = false
+	option.KeyProvider = keys
+	db := openTestDb(t, dbName, option)
+	value := func(i int) []byte { return fmt.Appendf(nil, "secret-value-%03d", i) }
+	// 一半刷入 sstable, 一半只在 wal 中
+	for i := range 100 {
+		assert.Nil(t, db.Put(fmt.Appendf(nil, "key-%03d", i), value(i)))
+		if i == 49 {
+			assert.Nil(t, db.Flush(true))
+		}
+	}
+	assert.Nil(t, db.Close())
+
+	// 除 CURRENT 外的文件都是密文
+	err := filepath.WalkDir(dbName, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() == "CURRENT" {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(data, []byte("secret-value")), path)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	option.KeyProvider = &encryption.StaticKeyProvider{
+		CurrentID: "k1",
+		Keys:      map[string][]byte{"k1": bytes.Repeat([]byte{2}, 32)},
+	}
+	_, err = Open(dbName, option)
+	assert.ErrorIs(t, err, encryption.ErrKeyMismatch)
+
+	option.KeyProvider = nil
+	_, err = Open(dbName, option)
+	assert.ErrorIs(t, err, encryption.ErrNoKeyProvider)
+
+	// 更换密钥后, 旧文件仍然可以读取
+	keys.CurrentID = "k2"
+	keys.Keys["k2"] = bytes.Repeat([]byte{3}, 16)
+	option.KeyProvider = keys
+	db = openTestDb(t, dbName, option)
+	defer db.Close()
+	for i := range 100 {
+		v, ok := db.Get(fmt.Appendf(nil, "key-%03d", i), math.MaxUint64)
+		assert.True(t, ok)
+		assert.Equal(t, value(i), v)
+	}
+}
+
+func TestDbMemFS(t *testing.T) {
+	const dbName = "TestDbMemFS"
+	fs := vfs.NewMemFS()
+
+	option := DefaultOptions
+	option.FS = fs
+	option.MemTableSize = 4 << 10
+	db := openTestDb(t, dbName, option)
+	for i := range 2000 {
+		assert.Nil(t, db.Put(fmt.Appendf(nil, "key-%04d", i), fmt.Appendf(nil, "value-%04d", i)))
+	}
+	assert.Nil(t, db.Flush(true))
+
+	// 不能同时打开同一个 db
+	_, err := Open(dbName, option)
+	assert.ErrorIs(t, err, vfs.ErrLocked)
+	assert.Nil(t, db.Close())
+
+	// 所有文件都在内存中
+	_, err = os.Stat(dbName)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	names, err := fs.List(dbName)
+	assert.Nil(t, err)
+	assert.Contains(t, names, "CURRENT")
+
+	db = openTestDb(t, dbName, option)
+	defer db.Close()
+	for i := range 2000 {
+		value, ok := db.Get(fmt.Appendf(nil, "key-%04d", i), math.MaxUint64)
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Appendf(nil, "value-%04d", i), value)
+	}
+}
+
+func TestDbComparator(t *testing.T) {
+	const dbName = "TestDbComparator"
+	fs := vfs.NewMemFS()
+
+	option := DefaultOptions
+	option.FS = fs
+	option.MemTableSize = 4 << 10
+	option.Comparator = comparator.ReverseBytewise
+	db := openTestDb(t, dbName, option)
+
+	const keyN = 3000
+	userKey := func(i int) []byte {
+		return fmt.Appendf(nil, "key-%05d", i)
+	}
+	for i := range keyN {
+		assert.Nil(t, db.Put(userKey(i), fmt.Appendf(nil, "value-%05d", i)))
+	}
+	// 按 Comparator 的顺序, 范围的起点是字节序较大的 key
+	assert.Equal(t, ErrInvalidRange, db.DeleteRange(userKey(100), userKey(300)))
+	assert.Nil(t, db.DeleteRange(userKey(300), userKey(100)))
+	assert.Nil(t, db.Flush(true))
+
+	deleted := func(i int) bool {
+		return i > 100 && i <= 300
+	}
+	check := func(db *Db) {
+		for _, i := range []int{0, 100, 101, 200, 300, 301, keyN - 1} {
+			value, ok := db.Get(userKey(i), math.MaxUint64)
+			assert.Equal(t, !deleted(i), ok, i)
+			if ok {
+				assert.Equal(t, fmt.Appendf(nil, "value-%05d", i), value)
+			}
+		}
+
+		iter, err := db.NewIterator(math.MaxUint64)
+		assert.Nil(t, err)
+		defer iter.Close()
+		n := keyN - 1
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			for deleted(n) {
+				n--
+			}
+			assert.Equal(t, userKey(n), iter.Key())
+			n--
+		}
+		assert.Equal(t, -1, n)
+
+		// 第一个在 Comparator 顺序上 >= key-00250 的 key
+		iter.Seek(userKey(250))
+		assert.True(t, iter.Valid())
+		assert.Equal(t, userKey(100), iter.Key())
+	}
+	check(db)
+
+	batch := NewWriteBatchWithIndexComparator(comparator.ReverseBytewise)
+	batch.Put(userKey(200), []byte("batch"))
+	batch.Delete(userKey(0))
+	base, err := db.NewIterator(math.MaxUint64)
+	assert.Nil(t, err)
+	iter := batch.NewIteratorWithBase(base)
+	var keys [][]byte
+	for iter.Seek(userKey(201)); iter.Valid(); iter.Next() {
+		keys = append(keys, bytes.Clone(iter.Key()))
+	}
+	iter.Close()
+	assert.Equal(t, [][]byte{userKey(200), userKey(100)}, keys[:2])
+	assert.Equal(t, userKey(1), keys[len(keys)-1])
+	assert.Nil(t, db.Close())
+
+	db = openTestDb(t, dbName, option)
+	check(db)
+	assert.Nil(t, db.Close())
+
+	// 使用不同的 Comparator 重新打开, 已有文件的顺序不再有效
+	option.Comparator = nil
+	_, err = Open(dbName, option)
+	assert.ErrorIs(t, err, version.ErrComparatorMismatch)
+}
+
+func TestDbCrashConsistency(t *testing.T) {
+	const dbName = "TestDbCrashConsistency"
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+
+	option := DefaultOptions
+	option.FS = fs
+	option.MemTableSize = 4 << 10
+	option.FlushOnClose = false
+
+	// 每轮写入一批 sync 的记录与一批未 sync 的记录后崩溃
+	// 重启后 sync 的记录必须存在, 未 sync 的记录可能丢失
+	synced := make(map[string]string)
+	for round := range 5 {
+		db := openTestDb(t, dbName, option)
+		for k, v := range synced {
+			value, ok := db.Get([]byte(k), math.MaxUint64)
+			assert.True(t, ok, "round %d, key %s", round, k)
+			assert.Equal(t, []byte(v), value)
+		}
+
+		for i := range 200 {
+			k, v := fmt.Sprintf("key-%d-%03d", round, i), fmt.Sprintf("value-%d-%03d", round, i)
+			batch := NewWriteBatch()
+			batch.Put([]byte(k), []byte(v))
+			assert.Nil(t, db.WriteWithOptions(batch, WriteOptions{Sync: true}))
+			synced[k] = v
+		}
+		for i := range 200 {
+			assert.Nil(t, db.Put(fmt.Appendf(nil, "unsynced-%d-%03d", round, i), []byte("value")))
+		}
+
+		fs.Crash()
+		db.Close()
+		assert.Nil(t, fs.Restart())
+	}
+
+	// sync 失败时写入返回错误
+	db := openTestDb(t, dbName, option)
+	injected := errors.New("injected")
+	fs.InjectSyncError(injected)
+	batch := NewWriteBatch()
+	batch.Put([]byte("key"), []byte("value"))
+	assert.ErrorIs(t, db.WriteWithOptions(batch, WriteOptions{Sync: true}), injected)
+	fs.InjectSyncError(nil)
+
+	// manifest 写入失败时, CURRENT 仍指向之前的 manifest
+	current, err := vfs.ReadFile(fs, util.CurrentFileName(dbName))
+	assert.Nil(t, err)
+	fs.InjectWriteError(injected)
+	_, err = db.CreateColumnFamily("cf", DefaultColumnFamilyOptions)
+	assert.ErrorIs(t, err, injected)
+	fs.InjectWriteError(nil)
+	after, err := vfs.ReadFile(fs, util.CurrentFileName(dbName))
+	assert.Nil(t, err)
+	assert.Equal(t, current, after)
+	fs.Crash()
+	db.Close()
+	assert.Nil(t, fs.Restart())
+
+	db = openTestDb(t, dbName, option)
+	_, ok := db.ColumnFamily("cf")
+	assert.False(t, ok)
+	for k, v := range synced {
+		value, ok := db.Get([]byte(k), math.MaxUint64)
+		assert.True(t, ok, k)
+		assert.Equal(t, []byte(v), value)
+	}
+	assert.Nil(t, db.Close())
+}
@@ -2,8 +2,7 @@ package block
 
 import (
 	"encoding/binary"
-	"lsm/internal/key"
-	"os"
+	"io"
 	"sort"
 )
 
@@ -29,7 +28,7 @@ type Block struct {
 	values [][]byte
 }
 
-func NewBlock(fd *os.File, bh BlockHandler) (*Block, error) {
+func NewBlock(fd io.ReaderAt, bh BlockHandler) (*Block, error) {
 	data := make([]byte, bh.Size)
 	if _, err := fd.ReadAt(data, int64(bh.Offset)); err != nil {
 		return nil, err
@@ -70,12 +69,15 @@ func (b *Block) Size() int {
 type BlockIterator struct {
 	block *Block
 	index int
+	// 编码后的 InternalKey 的比较函数, 需与写入时的顺序一致
+	cmp func(a, b []byte) int
 }
 
-func (b *Block) NewIterator() *BlockIterator {
+func (b *Block) NewIterator(cmp func(a, b []byte) int) *BlockIterator {
 	return &BlockIterator{
 		block: b,
 		index: 0,
+		cmp:   cmp,
 	}
 }
 
@@ -87,7 +89,7 @@ func (bi *BlockIterator) Rewind() {
 // Valid() is false after this call iff such position does not exist
 func (bi *BlockIterator) Seek(target []byte) {
 	idx := sort.Search(len(bi.block.keys), func(i int) bool {
-		return key.InternalKeyCompareFunc(bi.block.keys[i], target) >= 0
+		return bi.cmp(bi.block.keys[i], target) >= 0
 	})
 	bi.index = idx
 }
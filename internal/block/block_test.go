@@ -1,6 +1,7 @@
 package block
 
 import (
+	"lsm/internal/key"
 	"strconv"
 	"testing"
 
@@ -8,23 +9,29 @@ import (
 )
 
 func TestBlock(t *testing.T) {
+	// block 中的 key 为编码后的 InternalKey
+	internalKey := func(i int) []byte {
+		ik := key.New([]byte("key"+strconv.Itoa(i)), nil, 0, key.KTypeValue)
+		return ik.EncodeTo()
+	}
+
 	bb := NewBlockBuilder()
-	bb.Add([]byte("key1"), []byte("value1"))
-	bb.Add([]byte("key2"), []byte("value2"))
-	bb.Add([]byte("key3"), []byte("value3"))
+	bb.Add(internalKey(1), []byte("value1"))
+	bb.Add(internalKey(2), []byte("value2"))
+	bb.Add(internalKey(3), []byte("value3"))
 
 	data := bb.Finish()
 
 	block := newBlockFromRawData(data)
 	assert.Equal(t, 3, block.Size())
 
-	iter := block.NewIterator()
+	iter := block.NewIterator(key.InternalKeyCompareFunc)
 	iter.Rewind()
 
 	i := 1
 	for iter.Valid() {
 		key, value := iter.Key(), iter.Value()
-		assert.Equal(t, key, []byte("key"+strconv.Itoa(i)))
+		assert.Equal(t, key, internalKey(i))
 		assert.Equal(t, value, []byte("value"+strconv.Itoa(i)))
 		iter.Next()
 		i++
@@ -32,7 +39,7 @@ func TestBlock(t *testing.T) {
 
 	iter.Rewind()
 
-	iter.Seek([]byte("key2"))
-	assert.Equal(t, iter.Key(), []byte("key2"))
+	iter.Seek(internalKey(2))
+	assert.Equal(t, iter.Key(), internalKey(2))
 	assert.Equal(t, iter.Value(), []byte("value2"))
 }
@@ -12,6 +12,10 @@ type KeyType byte
 const (
 	KTypeDeletion KeyType = iota
 	KTypeValue
+	// merge operand, 读取或 compaction 时由 MergeOperator 与更旧的记录合并
+	KTypeMerge
+	// 范围删除, UserKey 为起点, UserValue 为终点(不包含), 见 RangeTombstone
+	KTypeRangeDeletion
 )
 
 // 对用户 KV 的包装
@@ -22,6 +26,10 @@ type InternalKey struct {
 
 	// 区分 delete 操作
 	Type KeyType
+
+	// 过期时间(unix 纳秒), 0 表示永不过期, 只对 KTypeValue 有效
+	// 非 0 时才会编码, 不影响没有 TTL 的记录
+	ExpireAt int64
 }
 
 func New(userKey, userValue []byte, seq uint64, tp KeyType) InternalKey {
@@ -44,11 +52,30 @@ func (ik InternalKey) Size() uint64 {
 	return 4 + uint64(len(ik.UserKey)) + // userKey
 		4 + uint64(len(ik.UserValue)) + // userValue
 		8 + // seq
-		1 // type
+		1 + // type
+		ik.expireAtSize()
+}
+
+func (ik InternalKey) expireAtSize() uint64 {
+	if ik.ExpireAt == 0 {
+		return 0
+	}
+	return 8
+}
+
+// 在 now(unix 纳秒) 时是否已过期, 过期的 value 等同于删除记录
+func (ik *InternalKey) Expired(now int64) bool {
+	return ik.ExpireAt != 0 && ik.ExpireAt <= now
 }
 
 func (ik *InternalKey) EncodeTo() []byte {
 	data := make([]byte, ik.Size())
+	ik.EncodeInto(data)
+	return data
+}
+
+// 编码到 data 中, len(data) 必须等于 Size(), 用于避免额外的内存分配
+func (ik *InternalKey) EncodeInto(data []byte) {
 	keyLen, valueLen := uint32(len(ik.UserKey)), uint32(len(ik.UserValue))
 	offset := 0
 
@@ -69,11 +96,14 @@ func (ik *InternalKey) EncodeTo() []byte {
 	data[offset] = byte(ik.Type)
 	offset += 1
 
+	if ik.ExpireAt != 0 {
+		binary.LittleEndian.PutUint64(data[offset:], uint64(ik.ExpireAt))
+		offset += 8
+	}
+
 	if offset != len(data) {
 		panic("offset != len(data)")
 	}
-
-	return data
 }
 
 func (ik *InternalKey) DecodeFrom(data []byte) {
@@ -94,22 +124,49 @@ func (ik *InternalKey) DecodeFrom(data []byte) {
 	offset += 8
 	ik.Type = KeyType(data[offset])
 	offset += 1
+
+	ik.ExpireAt = 0
+	if len(data)-offset == 8 {
+		ik.ExpireAt = int64(binary.LittleEndian.Uint64(data[offset:]))
+		offset += 8
+	}
 	if offset != len(data) {
 		panic("offset!= len(data)")
 	}
 }
 
 func (ik *InternalKey) Debug() string {
-	return fmt.Sprintf("InternalKey{UserKey: %s, UserValue: %s, Seq: %d, Type: %d}", ik.UserKey, ik.UserValue, ik.Seq, ik.Type)
+	return fmt.Sprintf("InternalKey{UserKey: %s, UserValue: %s, Seq: %d, Type: %d, ExpireAt: %d}", ik.UserKey, ik.UserValue, ik.Seq, ik.Type, ik.ExpireAt)
 }
 
 // 按 UserKey 升序,Seq 降序
 func InternalKeyCompareFunc(a, b []byte) int {
-	var ak, bk InternalKey
-	ak.DecodeFrom(a)
-	bk.DecodeFrom(b)
+	return CompareInternalKey(bytes.Compare, a, b)
+}
+
+// 按 ucmp 比较 UserKey, UserKey 相同时按 Seq 降序
+func CompareInternalKey(ucmp func(a, b []byte) int, a, b []byte) int {
+	aKey, aSeq := parseUserKeyAndSeq(a)
+	bKey, bSeq := parseUserKeyAndSeq(b)
 	return cmp.Or(
-		bytes.Compare(ak.UserKey, bk.UserKey),
-		-cmp.Compare(ak.Seq, bk.Seq),
+		ucmp(aKey, bKey),
+		-cmp.Compare(aSeq, bSeq),
 	)
 }
+
+// 返回按 ucmp 比较 UserKey 的 InternalKey 比较函数
+func InternalKeyComparer(ucmp func(a, b []byte) int) func(a, b []byte) int {
+	return func(a, b []byte) int {
+		return CompareInternalKey(ucmp, a, b)
+	}
+}
+
+// 直接从编码中取出 userKey 与 seq, 不复制, 比较时不产生内存分配
+func parseUserKeyAndSeq(data []byte) ([]byte, uint64) {
+	kLen := binary.LittleEndian.Uint32(data)
+	userKey := data[4 : 4+kLen]
+	offset := 4 + kLen
+	vLen := binary.LittleEndian.Uint32(data[offset:])
+	offset += 4 + vLen
+	return userKey, binary.LittleEndian.Uint64(data[offset:])
+}
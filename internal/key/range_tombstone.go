@@ -0,0 +1,64 @@
+package key
+
+import "math"
+
+// RangeTombstone 删除 [Start, End) 内 seq 小于 Seq 的所有记录
+type RangeTombstone struct {
+	Start []byte
+	End   []byte
+	Seq   uint64
+}
+
+// 编码为 KTypeRangeDeletion 类型的 InternalKey, 用于写入 wal 与 sstable
+func (t RangeTombstone) InternalKey() InternalKey {
+	return New(t.Start, t.End, t.Seq, KTypeRangeDeletion)
+}
+
+func RangeTombstoneFrom(ik *InternalKey) RangeTombstone {
+	return RangeTombstone{
+		Start: ik.UserKey,
+		End:   ik.UserValue,
+		Seq:   ik.Seq,
+	}
+}
+
+// ucmp 为 user key 的比较函数, 下同
+func (t RangeTombstone) Contains(ucmp func(a, b []byte) int, userKey []byte) bool {
+	return ucmp(t.Start, userKey) <= 0 && ucmp(userKey, t.End) < 0
+}
+
+// 返回 t 与 [lower, upper) 的交集, nil 表示无界
+func (t RangeTombstone) Clip(ucmp func(a, b []byte) int, lower, upper []byte) (RangeTombstone, bool) {
+	if lower != nil && ucmp(t.Start, lower) < 0 {
+		t.Start = lower
+	}
+	if upper != nil && ucmp(t.End, upper) > 0 {
+		t.End = upper
+	}
+	return t, ucmp(t.Start, t.End) < 0
+}
+
+// 作为文件的 smallest, 排在 Start 所有 seq 不大于 t.Seq 的记录之前
+func (t RangeTombstone) SmallestKey() InternalKey {
+	return New(t.Start, nil, t.Seq, KTypeRangeDeletion)
+}
+
+// 作为文件的 largest, End 本身不在范围内,
+// seq 取最大值使其排在 End 的所有记录之前, 不会与下一个文件重叠
+func (t RangeTombstone) LargestKey() InternalKey {
+	return New(t.End, nil, math.MaxUint64, KTypeRangeDeletion)
+}
+
+type RangeTombstones []RangeTombstone
+
+// 返回在 readSeq 时可见且包含 userKey 的 tombstone 中最大的 seq, 没有时返回 0
+// seq 小于返回值的 userKey 记录均已被删除
+func (ts RangeTombstones) MaxCoveringSeq(ucmp func(a, b []byte) int, userKey []byte, readSeq uint64) uint64 {
+	var maxSeq uint64
+	for _, t := range ts {
+		if t.Seq <= readSeq && t.Seq > maxSeq && t.Contains(ucmp, userKey) {
+			maxSeq = t.Seq
+		}
+	}
+	return maxSeq
+}
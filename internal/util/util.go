@@ -3,6 +3,17 @@ package util
 import (
 	"encoding/binary"
 	"fmt"
+	"strings"
+)
+
+type FileType int
+
+const (
+	FileTypeUnknown FileType = iota
+	FileTypeCurrent
+	FileTypeManifest
+	FileTypeSstable
+	FileTypeTemp
 )
 
 func CurrentFileName(dbname string) string {
@@ -13,6 +24,14 @@ func ManifestFileName(dbname string, number uint64) string {
 	return fmt.Sprintf("%s/MANIFEST-%06d", dbname, number)
 }
 
+func LockFileName(dbname string) string {
+	return dbname + "/LOCK"
+}
+
+func WALDirName(dbname string) string {
+	return dbname + "/wal"
+}
+
 func fileName(dbname string, number uint64, suffix string) string {
 	return fmt.Sprintf("%s/%06d.%s", dbname, number, suffix)
 }
@@ -25,6 +44,28 @@ func TempFileName(dbname string, number uint64) string {
 	return fileName(dbname, number, "dbtmp")
 }
 
+// 从文件名(不包含目录)中解析文件类型和编号
+func ParseFileName(name string) (FileType, uint64) {
+	var number uint64
+	switch {
+	case name == "CURRENT":
+		return FileTypeCurrent, 0
+	case strings.HasPrefix(name, "MANIFEST-"):
+		if _, err := fmt.Sscanf(name, "MANIFEST-%d", &number); err == nil {
+			return FileTypeManifest, number
+		}
+	case strings.HasSuffix(name, ".ldb"):
+		if _, err := fmt.Sscanf(name, "%d.ldb", &number); err == nil {
+			return FileTypeSstable, number
+		}
+	case strings.HasSuffix(name, ".dbtmp"):
+		if _, err := fmt.Sscanf(name, "%d.dbtmp", &number); err == nil {
+			return FileTypeTemp, number
+		}
+	}
+	return FileTypeUnknown, 0
+}
+
 func LenPrefixSlice(data []byte) []byte {
 	ret := make([]byte, len(data)+4)
 	binary.LittleEndian.PutUint32(ret, uint32(len(data)))
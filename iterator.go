@@ -0,0 +1,152 @@
+package lsm
+
+import (
+	"lsm/internal/key"
+	"lsm/pkg/comparator"
+	"lsm/pkg/merge"
+	"lsm/pkg/version"
+	"math"
+	"time"
+)
+
+// Iterator 按 column family 的 Comparator 顺序遍历 seq 时刻可见的数据
+// 删除、过期或被 range tombstone 覆盖的 key 会被跳过, merge operand 会与更旧的记录合并后返回
+//
+// 创建时固定 mem、imm 与 current, 使用完毕后需调用 Close
+type Iterator struct {
+	db      *Db
+	current *version.Version
+	iter    version.InternalIterator
+	// mem、imm 与所有 sstable 中的 range tombstone
+	tombstones key.RangeTombstones
+	ucmp       comparator.Comparator
+	release    func()
+	op         merge.MergeOperator
+	seq        uint64
+	// 创建时刻, 在此之前过期的 value 会被跳过
+	now time.Time
+
+	key   []byte
+	value []byte
+	valid bool
+}
+
+// 创建迭代器, seq 可以是 Snapshot.Seq(), 或 math.MaxUint64 表示读取最新数据
+// 返回的迭代器未定位, 需要先调用 SeekToFirst 或 Seek
+func (db *Db) NewIterator(seq uint64) (*Iterator, error) {
+	return db.NewIteratorCF(db.defaultCF, seq)
+}
+
+// 创建遍历 cf 的迭代器
+func (db *Db) NewIteratorCF(cf *ColumnFamilyHandle, seq uint64) (*Iterator, error) {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil, ErrClosed
+	}
+	mem := cf.mem
+	imm := cf.imm
+	current := cf.current
+	db.refVersion(current)
+	db.mu.Unlock()
+
+	iters, tombstones, release, err := current.NewIterators()
+	if err != nil {
+		db.mu.Lock()
+		db.unrefVersion(current)
+		db.mu.Unlock()
+		return nil, err
+	}
+	iters = append(iters, mem.Iterator())
+	tombstones = append(tombstones, mem.RangeTombstones()...)
+	if imm != nil {
+		iters = append(iters, imm.Iterator())
+		tombstones = append(tombstones, imm.RangeTombstones()...)
+	}
+
+	return &Iterator{
+		db:         db,
+		current:    current,
+		iter:       version.NewMergeIterator(iters, key.InternalKeyComparer(current.Comparator().Compare)),
+		tombstones: tombstones,
+		ucmp:       current.Comparator(),
+		release:    release,
+		op:         cf.option.MergeOperator,
+		seq:        seq,
+		now:        db.now(),
+	}, nil
+}
+
+func (it *Iterator) SeekToFirst() {
+	it.iter.SeekToFirst()
+	it.findNext()
+}
+
+// 定位到第一个 >= userKey 的 key
+func (it *Iterator) Seek(userKey []byte) {
+	// seq 最大的 lookupKey 排在该 userKey 所有记录之前
+	lookupKey := key.NewLookupKey(userKey, math.MaxUint64)
+	it.iter.Seek(lookupKey.EncodeTo())
+	it.findNext()
+}
+
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// requires it.Valid()
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// requires it.Valid()
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+func (it *Iterator) Next() {
+	it.findNext()
+}
+
+func (it *Iterator) Close() {
+	if it.release == nil {
+		return
+	}
+	it.release()
+	it.release = nil
+	it.valid = false
+
+	it.db.mu.Lock()
+	it.db.unrefVersion(it.current)
+	it.db.mu.Unlock()
+}
+
+// 从当前位置开始, 找到下一个在 seq 时刻存在的 userKey
+// 记录按 userKey 升序(由 Comparator 决定), seq 降序排列, 同一个 userKey 的记录按从新到旧的顺序交给 GetContext
+func (it *Iterator) findNext() {
+	it.valid = false
+	for it.iter.Valid() {
+		var ik key.InternalKey
+		ik.DecodeFrom(it.iter.Key())
+		userKey := ik.UserKey
+
+		ctx := merge.NewGetContext(it.op, userKey)
+		ctx.SetNow(it.now)
+		ctx.AddRangeDeletion(it.tombstones.MaxCoveringSeq(it.ucmp.Compare, userKey, it.seq))
+		done := false
+		for ; it.iter.Valid(); it.iter.Next() {
+			ik.DecodeFrom(it.iter.Key())
+			if it.ucmp.Compare(ik.UserKey, userKey) != 0 {
+				break
+			}
+			if !done && ik.Seq <= it.seq {
+				done = ctx.Add(&ik)
+			}
+		}
+
+		if value, ok := ctx.Result(); ok {
+			it.key, it.value, it.valid = userKey, value, true
+			return
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package lsm
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLockTimeout = errors.New("lock wait timeout")
+	ErrDeadlock    = errors.New("deadlock detected")
+)
+
+type lockInfo struct {
+	owner uint64
+	// 释放时关闭, 唤醒所有等待者
+	released chan struct{}
+}
+
+// 对 key 的一个分片加锁, 分片之间互不影响
+type lockStripe struct {
+	mu    sync.Mutex
+	locks map[string]*lockInfo
+}
+
+// lockManager 管理事务持有的 key 级别的排他锁
+//
+// key 按哈希分散到多个分片, 不同分片的加锁互不阻塞.
+// 等待锁之前沿 wait-for 图检查是否会形成环, 形成环时返回 ErrDeadlock
+type lockManager struct {
+	stripes []lockStripe
+	timeout time.Duration
+	// <= 0 时不检测死锁
+	deadlockDetectDepth int
+
+	// 事务 id -> 它正在等待的锁的持有者
+	waitMu  sync.Mutex
+	waitFor map[uint64]uint64
+}
+
+func newLockManager(numStripes int, timeout time.Duration, deadlockDetectDepth int) *lockManager {
+	lm := &lockManager{
+		stripes:             make([]lockStripe, max(numStripes, 1)),
+		timeout:             timeout,
+		deadlockDetectDepth: deadlockDetectDepth,
+		waitFor:             make(map[uint64]uint64),
+	}
+	for i := range lm.stripes {
+		lm.stripes[i].locks = make(map[string]*lockInfo)
+	}
+	return lm
+}
+
+func (lm *lockManager) stripe(key string) *lockStripe {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &lm.stripes[h.Sum32()%uint32(len(lm.stripes))]
+}
+
+// 为事务 txnID 获取 key 的锁, 已持有时直接返回
+// 等待超过 timeout 时返回 ErrLockTimeout, timeout <= 0 表示一直等待
+func (lm *lockManager) lock(txnID uint64, key string) error {
+	var deadline <-chan time.Time
+	if lm.timeout > 0 {
+		timer := time.NewTimer(lm.timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	s := lm.stripe(key)
+	for {
+		s.mu.Lock()
+		info, ok := s.locks[key]
+		if !ok {
+			s.locks[key] = &lockInfo{owner: txnID, released: make(chan struct{})}
+			s.mu.Unlock()
+			return nil
+		}
+		if info.owner == txnID {
+			s.mu.Unlock()
+			return nil
+		}
+		released := info.released
+		holder := info.owner
+		s.mu.Unlock()
+
+		if err := lm.startWaiting(txnID, holder); err != nil {
+			return err
+		}
+		select {
+		case <-released:
+			lm.stopWaiting(txnID)
+		case <-deadline:
+			lm.stopWaiting(txnID)
+			return ErrLockTimeout
+		}
+	}
+}
+
+// 释放 txnID 持有的 key 的锁
+func (lm *lockManager) unlock(txnID uint64, key string) {
+	s := lm.stripe(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if info, ok := s.locks[key]; ok && info.owner == txnID {
+		delete(s.locks, key)
+		close(info.released)
+	}
+}
+
+// 记录 txnID 等待 holder, 如果 holder 直接或间接地在等待 txnID, 返回 ErrDeadlock
+func (lm *lockManager) startWaiting(txnID, holder uint64) error {
+	lm.waitMu.Lock()
+	defer lm.waitMu.Unlock()
+
+	if lm.deadlockDetectDepth > 0 {
+		next := holder
+		for range lm.deadlockDetectDepth {
+			if next == txnID {
+				return ErrDeadlock
+			}
+			var ok bool
+			if next, ok = lm.waitFor[next]; !ok {
+				break
+			}
+		}
+	}
+	lm.waitFor[txnID] = holder
+	return nil
+}
+
+func (lm *lockManager) stopWaiting(txnID uint64) {
+	lm.waitMu.Lock()
+	defer lm.waitMu.Unlock()
+
+	delete(lm.waitFor, txnID)
+}
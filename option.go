@@ -0,0 +1,150 @@
+package lsm
+
+import (
+	"lsm/pkg/comparator"
+	"lsm/pkg/encryption"
+	"lsm/pkg/memtable"
+	"lsm/pkg/merge"
+	"lsm/pkg/version"
+	"lsm/pkg/vfs"
+	"lsm/pkg/wal"
+	"time"
+)
+
+type Option struct {
+	// memtable 大小上限,写满后切换为 imm 并刷入 level 0
+	MemTableSize uint64
+
+	// memtable 中记录的存储结构, 为 nil 时使用 memtable.NewSkiplistRep
+	// 批量导入可选 memtable.NewVectorRep, 按前缀点查可选 memtable.NewHashLinkListRepFactory
+	MemTableRep memtable.RepFactory
+
+	// memtable bloom filter 预期的 key 数量, 0 表示不使用
+	// 不存在的 key 在 mem 与 imm 中查找时, 可以跳过 Rep 的查找
+	MemTableBloomKeys uint64
+
+	// memtable bloom filter 只保存 user key 的前缀, 为 nil 时保存整个 user key
+	// 如 memtable.FixedPrefix(n), 相同前缀的 key 共用 bloom filter 中的位置
+	MemTableBloomPrefix memtable.PrefixExtractor
+
+	// Close 时是否先将 memtable 刷入 level 0
+	// 设置为 false 时,未刷盘的数据只保存在 wal 中,下次 Open 时重放
+	FlushOnClose bool
+
+	// wal 单个 segment 文件的大小
+	WALSegmentSize uint64
+
+	// 是否在每次写入 wal 后都 sync, 可以通过 WriteOptions 为单次写入覆盖
+	Sync bool
+
+	// 后台 sync wal 的时间间隔, 0 表示不按时间 sync
+	WALSyncInterval time.Duration
+
+	// wal 累计写入该字节数后在后台 sync, 0 表示不按字节数 sync
+	WALBytesPerSync uint64
+
+	// wal 记录的压缩方式, 修改后之前写入的 wal 仍然可以读取
+	WALCompression wal.Compression
+
+	// 不为 nil 时, 新生成的 sstable、wal segment 与 manifest 使用 AES-CTR 加密
+	// 每个文件的文件头记录密钥 id, 已有的文件按原来的密钥(或明文)读取, CURRENT 文件不加密
+	// Open 时密钥错误会返回 encryption.ErrKeyMismatch
+	KeyProvider encryption.KeyProvider
+
+	// 所有文件所在的文件系统, 为 nil 时使用 vfs.Default
+	// 测试中可以使用 vfs.NewMemFS 或用 vfs.NewFaultFS 注入错误
+	FS vfs.FS
+
+	// Open 时如何处理 wal 中损坏的记录, 默认忽略末尾写入一半的记录
+	WALRecoveryMode wal.RecoveryMode
+
+	// compaction 策略, 为 nil 时使用 leveled compaction
+	// 可选 version.NewUniversalCompactionPicker 以降低写放大,
+	// 或 version.NewFIFOCompactionPicker 按大小和时间淘汰旧文件
+	CompactionPicker version.CompactionPicker
+
+	// 一次 compaction 最多拆分为多少个并行的 subcompaction, <= 1 表示不拆分
+	// level 0 文件积压时, 可以利用多核加快 level 0 -> level 1 的合并
+	MaxSubcompactions int
+
+	// 后台 compaction worker 的数量, <= 1 表示只有一个
+	// flush 由单独的 worker 执行, 不受 compaction 影响
+	MaxBackgroundCompactions int
+
+	// compaction 时按业务逻辑删除或改写记录, 如清理过期数据, 为 nil 时不过滤
+	CompactionFilter version.CompactionFilter
+
+	// Merge 写入的 operand 的合并逻辑, 为 nil 时不能调用 Db.Merge
+	MergeOperator merge.MergeOperator
+
+	// default column family 中 user key 的排序方式, 为 nil 时使用 comparator.Bytewise
+	// 名字记录在 manifest 中, 重新打开时使用不同名字的 Comparator 会返回 version.ErrComparatorMismatch
+	Comparator comparator.Comparator
+
+	// level 0 文件数量达到该值时延迟写入, <= 0 表示不延迟
+	// FIFO compaction 会在 level 0 保留大量文件, 此时应设置为 0
+	L0SlowdownWritesTrigger int
+
+	// 判断 PutWithTTL 写入的记录是否过期时使用的时钟, 为 nil 时使用 time.Now
+	// 测试时可以注入可控的时钟
+	Clock func() time.Time
+
+	// Open 时已存在的 column family 的选项, 按名称指定, 未指定时使用 DefaultColumnFamilyOptions
+	// default column family 使用上面的 MemTableSize 等选项
+	ColumnFamilies map[string]ColumnFamilyOptions
+}
+
+// ColumnFamilyOptions 是每个 column family 独立的选项
+// 含义与 Option 中的同名字段相同
+type ColumnFamilyOptions struct {
+	MemTableSize        uint64
+	MemTableRep         memtable.RepFactory
+	MemTableBloomKeys   uint64
+	MemTableBloomPrefix memtable.PrefixExtractor
+	CompactionPicker    version.CompactionPicker
+	MaxSubcompactions   int
+	CompactionFilter    version.CompactionFilter
+	MergeOperator       merge.MergeOperator
+	Comparator          comparator.Comparator
+}
+
+var DefaultColumnFamilyOptions = ColumnFamilyOptions{
+	MemTableSize:      DefaultMemTableSize,
+	MaxSubcompactions: 1,
+}
+
+func (option *Option) defaultColumnFamilyOptions() ColumnFamilyOptions {
+	return ColumnFamilyOptions{
+		MemTableSize:        option.MemTableSize,
+		MemTableRep:         option.MemTableRep,
+		MemTableBloomKeys:   option.MemTableBloomKeys,
+		MemTableBloomPrefix: option.MemTableBloomPrefix,
+		CompactionPicker:    option.CompactionPicker,
+		MaxSubcompactions:   option.MaxSubcompactions,
+		CompactionFilter:    option.CompactionFilter,
+		MergeOperator:       option.MergeOperator,
+		Comparator:          option.Comparator,
+	}
+}
+
+// 返回 Open 时名为 name 的 column family 的选项
+func (option *Option) columnFamilyOptions(name string) ColumnFamilyOptions {
+	if name == DefaultColumnFamilyName {
+		return option.defaultColumnFamilyOptions()
+	}
+	if opts, ok := option.ColumnFamilies[name]; ok {
+		return opts
+	}
+	return DefaultColumnFamilyOptions
+}
+
+var DefaultOptions = Option{
+	MemTableSize:   DefaultMemTableSize,
+	FlushOnClose:   true,
+	WALSegmentSize: 64 * wal.MB,
+	Sync:           false,
+
+	MaxSubcompactions:        1,
+	MaxBackgroundCompactions: 1,
+	L0SlowdownWritesTrigger:  version.L0_SlowdownWritesTrigger,
+}
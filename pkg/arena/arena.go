@@ -0,0 +1,104 @@
+package arena
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	DefaultChunkSize = 4 << 20
+
+	// 所有分配都按 8 字节对齐, 使 uint64 可以被原子地读写
+	align = 8
+)
+
+// Arena 从大块连续内存(chunk)中分配小对象, 用 offset 代替指针,
+// 大量小对象只对应少数几个 chunk, 减少 GC 的扫描与分配开销
+//
+// offset 的高 32 位为 chunk 的序号, 低 32 位为 chunk 内的偏移, 0 不是合法的 offset.
+// 分配的内存在 Arena 被丢弃之前一直有效, 不支持释放单个对象
+//
+// 只能有一个 goroutine 调用 Allocate, 读取已分配的内存(Bytes/Uint64 等)可以与之并发
+type Arena struct {
+	chunkSize int
+	// 写时复制, 读取方拿到的切片头不会再被修改
+	chunks atomic.Pointer[[][]byte]
+	// 当前 chunk 已使用的字节数, 只由写入方访问
+	used int
+
+	// 已分配的字节数(包括对齐的填充)
+	allocated atomic.Uint64
+	// 所有 chunk 的总大小
+	reserved atomic.Uint64
+}
+
+func New(chunkSize int) *Arena {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	a := &Arena{chunkSize: chunkSize}
+	a.chunks.Store(&[][]byte{})
+	return a
+}
+
+// 分配 n 字节, 返回其 offset, 内存已清零
+func (a *Arena) Allocate(n int) uint64 {
+	size := (n + align - 1) &^ (align - 1)
+	chunks := *a.chunks.Load()
+	// 第一个 chunk 跳过开头的 align 字节, 保证 0 不是合法的 offset
+	if len(chunks) == 0 || a.used+size > len(chunks[len(chunks)-1]) {
+		start := 0
+		if len(chunks) == 0 {
+			start = align
+		}
+		// 超过 chunk 大小的对象单独分配一个 chunk
+		chunk := make([]byte, max(a.chunkSize, start+size))
+		next := append(chunks[:len(chunks):len(chunks)], chunk)
+		a.chunks.Store(&next)
+		chunks = next
+		a.used = start
+		a.reserved.Add(uint64(len(chunk)))
+	}
+
+	offset := uint64(len(chunks)-1)<<32 | uint64(a.used)
+	a.used += size
+	a.allocated.Add(uint64(size))
+	return offset
+}
+
+// 分配空间并复制 data, 返回其 offset
+func (a *Arena) Put(data []byte) uint64 {
+	offset := a.Allocate(len(data))
+	copy(a.Bytes(offset, len(data)), data)
+	return offset
+}
+
+// 返回 [offset, offset+n) 对应的内存, 不会复制
+func (a *Arena) Bytes(offset uint64, n int) []byte {
+	chunk := (*a.chunks.Load())[offset>>32]
+	start := int(uint32(offset))
+	return chunk[start : start+n : start+n]
+}
+
+// 原子地读取 offset 处的 uint64, offset 需由 Allocate 返回或在其基础上偏移 8 的倍数
+func (a *Arena) LoadUint64(offset uint64) uint64 {
+	return atomic.LoadUint64(a.uint64Ptr(offset))
+}
+
+func (a *Arena) StoreUint64(offset uint64, v uint64) {
+	atomic.StoreUint64(a.uint64Ptr(offset), v)
+}
+
+func (a *Arena) uint64Ptr(offset uint64) *uint64 {
+	return (*uint64)(unsafe.Pointer(&a.Bytes(offset, 8)[0]))
+}
+
+// 已分配的字节数
+func (a *Arena) Size() uint64 {
+	return a.allocated.Load()
+}
+
+// 所有 chunk 占用的内存
+func (a *Arena) Reserved() uint64 {
+	return a.reserved.Load()
+}
@@ -0,0 +1,39 @@
+package arena
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArena(t *testing.T) {
+	a := New(64)
+	assert.Equal(t, uint64(0), a.Size())
+
+	// 分配按 8 字节对齐, 0 不是合法的 offset
+	o1 := a.Put([]byte("hello"))
+	assert.NotEqual(t, uint64(0), o1)
+	assert.Equal(t, []byte("hello"), a.Bytes(o1, 5))
+	assert.Equal(t, uint64(8), a.Size())
+
+	o2 := a.Allocate(8)
+	assert.Equal(t, uint64(0), o2%8)
+	a.StoreUint64(o2, 42)
+	assert.Equal(t, uint64(42), a.LoadUint64(o2))
+
+	// 当前 chunk 放不下时分配新的 chunk, 之前的数据不受影响
+	o3 := a.Put(make([]byte, 48))
+	assert.Equal(t, uint64(1), o3>>32)
+	assert.Equal(t, uint64(128), a.Reserved())
+
+	// 超过 chunk 大小的对象单独占用一个 chunk
+	big := make([]byte, 100)
+	big[99] = 1
+	o4 := a.Put(big)
+	assert.Equal(t, uint64(2), o4>>32)
+	assert.Equal(t, big, a.Bytes(o4, 100))
+	assert.Equal(t, uint64(8+8+48+104), a.Size())
+
+	assert.Equal(t, []byte("hello"), a.Bytes(o1, 5))
+	assert.Equal(t, uint64(42), a.LoadUint64(o2))
+}
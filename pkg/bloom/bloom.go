@@ -3,20 +3,22 @@ package bloom
 import (
 	"hash/fnv"
 	"math"
+	"sync/atomic"
 )
 
-type BitArray []byte
+// 位数组按 64 位的字原子地读写, Add 与 Contains 可以并发调用
+type BitArray []atomic.Uint64
 
 func newBitArray(size uint64) BitArray {
-	return make(BitArray, (size+7)/8)
+	return make(BitArray, (size+63)/64)
 }
 
 func (b BitArray) set(idx uint64) {
-	b[idx/8] |= 1 << (idx % 8)
+	b[idx/64].Or(1 << (idx % 64))
 }
 
 func (b BitArray) get(idx uint64) bool {
-	return b[idx/8]&(1<<(idx%8)) != 0
+	return b[idx/64].Load()&(1<<(idx%64)) != 0
 }
 
 type Bloom struct {
@@ -32,8 +34,8 @@ type Bloom struct {
 // n 代表预期的元素个数
 // p 代表错误率, 当布隆过滤器判断某个元素存在时，实际上该元素并不在集合中的概率
 func NewBloom(n uint64, p float64) *Bloom {
-	m := uint64(-(float64(n) * math.Log(p)) / (math.Log(2) * math.Log(2)))
-	k := uint64((float64(m) / float64(n)) * math.Log(2))
+	m := max(uint64(-(float64(n)*math.Log(p))/(math.Log(2)*math.Log(2))), 64)
+	k := max(uint64((float64(m)/float64(n))*math.Log(2)), 1)
 	return &Bloom{
 		bitArray: newBitArray(m),
 		k:        k,
@@ -41,30 +43,32 @@ func NewBloom(n uint64, p float64) *Bloom {
 	}
 }
 
-func (b *Bloom) hash(key []byte) []uint64 {
-	hsh := make([]uint64, b.k)
-	for i := range hsh {
-		h := fnv.New64a()
-		h.Write(key)
-		h.Write([]byte{byte(i)})
-		hsh[i] = h.Sum64() % b.m
-	}
-	return hsh
+// 用一次 fnv 得到两个哈希值, 第 i 个位置为 h1 + i*h2, 不需要计算 k 次哈希
+func (b *Bloom) hash(key []byte) (h1, h2 uint64) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	return sum, sum>>33 | sum<<31 | 1
 }
 
 func (b *Bloom) Add(key []byte) {
-	hsh := b.hash(key)
-	for _, idx := range hsh {
-		b.bitArray.set(idx)
+	h1, h2 := b.hash(key)
+	for i := range b.k {
+		b.bitArray.set((h1 + i*h2) % b.m)
 	}
 }
 
 func (b *Bloom) Contains(key []byte) bool {
-	hsh := b.hash(key)
-	for _, idx := range hsh {
-		if !b.bitArray.get(idx) {
+	h1, h2 := b.hash(key)
+	for i := range b.k {
+		if !b.bitArray.get((h1 + i*h2) % b.m) {
 			return false
 		}
 	}
 	return true
 }
+
+// 位数组占用的字节数
+func (b *Bloom) Size() uint64 {
+	return uint64(len(b.bitArray)) * 8
+}
@@ -16,6 +16,18 @@ func TestBloom(t *testing.T) {
 	}
 
 	assert.True(t, bloom.Contains([]byte("1000")))
+	for i := 0; i < N; i++ {
+		assert.True(t, bloom.Contains([]byte(strconv.Itoa(i))))
+	}
+
+	// 误判率应接近 p
+	falsePositive := 0
+	for i := N; i < 11*N; i++ {
+		if bloom.Contains([]byte(strconv.Itoa(i))) {
+			falsePositive++
+		}
+	}
+	assert.Less(t, falsePositive, 10*N/100)
 }
 
 func BenchmarkBloomAdd(b *testing.B) {
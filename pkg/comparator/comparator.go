@@ -0,0 +1,50 @@
+package comparator
+
+import "bytes"
+
+// Comparator 定义 user key 的顺序
+//
+// 同一个 column family 的 memtable、sstable、compaction 与迭代器都按它排序.
+// Name 会写入 manifest, 重新打开时需要使用同名的 Comparator, 否则已有文件中记录的顺序与之不符
+//
+// Compare 返回 0 当且仅当两个 key 的字节完全相同; 实现需要保证并发安全
+type Comparator interface {
+	// a < b 时返回负数, a == b 时返回 0, a > b 时返回正数
+	Compare(a, b []byte) int
+	Name() string
+}
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+func (bytewiseComparator) Name() string {
+	return "lsm.BytewiseComparator"
+}
+
+type reverseBytewiseComparator struct{}
+
+func (reverseBytewiseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+func (reverseBytewiseComparator) Name() string {
+	return "lsm.ReverseBytewiseComparator"
+}
+
+var (
+	// 按字节序升序, 是默认的 Comparator
+	Bytewise Comparator = bytewiseComparator{}
+	// 按字节序降序
+	ReverseBytewise Comparator = reverseBytewiseComparator{}
+)
+
+// c 为 nil 时返回 Bytewise
+func OrDefault(c Comparator) Comparator {
+	if c == nil {
+		return Bytewise
+	}
+	return c
+}
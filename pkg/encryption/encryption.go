@@ -0,0 +1,344 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"lsm/pkg/vfs"
+	"math"
+	"path/filepath"
+)
+
+var (
+	ErrKeyNotFound   = errors.New("encryption key not found")
+	ErrKeyMismatch   = errors.New("wrong encryption key")
+	ErrNoKeyProvider = errors.New("file is encrypted but no key provider is configured")
+	ErrInvalidHeader = errors.New("invalid encryption header")
+)
+
+// KeyProvider 提供加密使用的密钥, 每个密钥有唯一的 id, 记录在文件头中
+// 更换密钥时, 新文件使用新的密钥, 旧文件仍然通过 id 找到原来的密钥
+type KeyProvider interface {
+	// 返回新文件使用的密钥及其 id
+	CurrentKey() (id string, key []byte, err error)
+	// 返回 id 对应的密钥, 不存在时返回 ErrKeyNotFound
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeyProvider 从内存中的 Keys 查找密钥, 新文件使用 CurrentID 对应的密钥
+// 密钥长度需为 16/24/32 字节, 分别对应 AES-128/192/256
+type StaticKeyProvider struct {
+	CurrentID string
+	Keys      map[string][]byte
+}
+
+func (p *StaticKeyProvider) CurrentKey() (string, []byte, error) {
+	key, err := p.Key(p.CurrentID)
+	return p.CurrentID, key, err
+}
+
+func (p *StaticKeyProvider) Key(id string) ([]byte, error) {
+	key, ok := p.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, id)
+	}
+	return key, nil
+}
+
+// 加密文件的文件头:
+//
+//	magic | keyIDLen(1) | keyID | iv(16) | check(16)
+//
+// check 为 HMAC-SHA256(key, magic | keyIDLen | keyID | iv) 的前 16 字节, 用于在打开时发现错误的密钥
+// 文件头之后的内容使用 AES-CTR 加密, 计数器从 iv 开始, 因此可以从任意位置读取
+// 同一个 iv 下每个位置只会加密一次, 截断时换用新的 iv, 见 Truncate
+const (
+	magic     = "\x00LSMENC\x01"
+	ivSize    = aes.BlockSize
+	checkSize = 16
+
+	// 截断时每次重新加密的内容大小
+	rekeyBufferSize = 64 * 1024
+)
+
+// File 是可能加密的文件, 只支持追加写入与随机读取
+// 读写的偏移量不包括文件头, 对调用方而言与普通文件相同
+// 没有文件头的文件按明文读写, 因此开启加密前创建的文件仍然可以读取
+type File struct {
+	fs vfs.FS
+	f  vfs.File
+	// 创建或打开时的文件名, 截断后 f 来自 rename 前的临时文件, 其 Name 不再有效
+	name string
+
+	// 以下字段为 nil 时表示明文文件
+	block cipher.Block
+	iv    []byte
+	// 截断时使用同一个密钥写入新的文件头
+	keyID string
+	key   []byte
+
+	headerSize int64
+	// 内容大小, 不包括文件头
+	size int64
+}
+
+// 创建新文件, keys 为 nil 时不加密
+func Create(fs vfs.FS, name string, keys KeyProvider) (*File, error) {
+	f, err := fs.Create(name)
+	return newFile(fs, f, err, true, keys)
+}
+
+// 以只读方式打开已有的文件
+func Open(fs vfs.FS, name string, keys KeyProvider) (*File, error) {
+	f, err := fs.Open(name)
+	return newFile(fs, f, err, false, keys)
+}
+
+// 以追加方式打开文件, 不存在时创建
+// 空文件视为新文件, keys 不为 nil 时写入文件头
+func OpenAppend(fs vfs.FS, name string, keys KeyProvider) (*File, error) {
+	f, err := fs.OpenAppend(name)
+	return newFile(fs, f, err, true, keys)
+}
+
+func newFile(fs vfs.FS, f vfs.File, err error, writable bool, keys KeyProvider) (*File, error) {
+	if err != nil {
+		return nil, err
+	}
+	file, err := initFile(fs, f, writable, keys)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("open %s: %w", f.Name(), err)
+	}
+	return file, nil
+}
+
+func initFile(fs vfs.FS, f vfs.File, writable bool, keys KeyProvider) (*File, error) {
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	file := &File{fs: fs, f: f, name: f.Name(), size: size}
+
+	if size == 0 && writable {
+		if keys == nil {
+			return file, nil
+		}
+		id, key, err := keys.CurrentKey()
+		if err != nil {
+			return nil, err
+		}
+		return file, file.writeHeader(id, key)
+	}
+
+	prefix := make([]byte, len(magic))
+	if _, err := f.ReadAt(prefix, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if string(prefix) != magic {
+		return file, nil
+	}
+	if keys == nil {
+		return nil, ErrNoKeyProvider
+	}
+	return file, file.readHeader(keys)
+}
+
+// 使用新的随机 iv 写入文件头
+func (file *File) writeHeader(id string, key []byte) error {
+	if len(id) > math.MaxUint8 {
+		return fmt.Errorf("key id %q is too long", id)
+	}
+	var err error
+	if file.block, err = aes.NewCipher(key); err != nil {
+		return err
+	}
+	file.keyID, file.key = id, key
+	file.iv = make([]byte, ivSize)
+	if _, err := rand.Read(file.iv); err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, len(magic)+1+len(id)+ivSize+checkSize)
+	header = append(header, magic...)
+	header = append(header, byte(len(id)))
+	header = append(header, id...)
+	header = append(header, file.iv...)
+	header = append(header, keyCheck(key, header)...)
+	if _, err := file.f.Write(header); err != nil {
+		return err
+	}
+	file.headerSize = int64(len(header))
+	file.size = 0
+	return nil
+}
+
+func (file *File) readHeader(keys KeyProvider) error {
+	offset := int64(len(magic))
+	idLen := make([]byte, 1)
+	if _, err := file.f.ReadAt(idLen, offset); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+	}
+	rest := make([]byte, int(idLen[0])+ivSize+checkSize)
+	if _, err := file.f.ReadAt(rest, offset+1); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+	}
+	id := string(rest[:idLen[0]])
+	iv := rest[idLen[0] : int(idLen[0])+ivSize]
+	check := rest[int(idLen[0])+ivSize:]
+
+	key, err := keys.Key(id)
+	if err != nil {
+		return err
+	}
+	header := append([]byte(magic), idLen[0])
+	header = append(header, rest[:int(idLen[0])+ivSize]...)
+	if !hmac.Equal(check, keyCheck(key, header)) {
+		return fmt.Errorf("%w: key id %q", ErrKeyMismatch, id)
+	}
+	if file.block, err = aes.NewCipher(key); err != nil {
+		return err
+	}
+	file.keyID, file.key = id, key
+	file.iv = bytes.Clone(iv)
+	file.headerSize = int64(len(header) + checkSize)
+	file.size -= file.headerSize
+	return nil
+}
+
+func keyCheck(key, header []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(header)
+	return mac.Sum(nil)[:checkSize]
+}
+
+// 将 data 与内容中 offset 处开始的密钥流异或
+func (file *File) xorKeyStream(data []byte, offset int64) {
+	// 计数器 = iv + offset/blockSize, 按 128 位大端整数相加
+	counter := make([]byte, ivSize)
+	copy(counter, file.iv)
+	hi := binary.BigEndian.Uint64(counter[:8])
+	lo := binary.BigEndian.Uint64(counter[8:])
+	n := uint64(offset / aes.BlockSize)
+	if lo+n < lo {
+		hi++
+	}
+	lo += n
+	binary.BigEndian.PutUint64(counter[:8], hi)
+	binary.BigEndian.PutUint64(counter[8:], lo)
+
+	stream := cipher.NewCTR(file.block, counter)
+	if skip := offset % aes.BlockSize; skip > 0 {
+		discard := make([]byte, skip)
+		stream.XORKeyStream(discard, discard)
+	}
+	stream.XORKeyStream(data, data)
+}
+
+func (file *File) Encrypted() bool {
+	return file.block != nil
+}
+
+func (file *File) ReadAt(p []byte, off int64) (int, error) {
+	n, err := file.f.ReadAt(p, off+file.headerSize)
+	if file.Encrypted() {
+		file.xorKeyStream(p[:n], off)
+	}
+	return n, err
+}
+
+// 追加写入 p
+func (file *File) Write(p []byte) (int, error) {
+	data := p
+	if file.Encrypted() {
+		data = bytes.Clone(p)
+		file.xorKeyStream(data, file.size)
+	}
+	n, err := file.f.Write(data)
+	file.size += int64(n)
+	return n, err
+}
+
+// 截断内容到 size
+//
+// 加密文件截断后继续写入会在被截断的位置再次使用同一段密钥流, 因此不能原地截断:
+// 保留的内容用新的 iv 重新加密写入临时文件, sync 后通过 rename 原子地替换原文件
+// 代价与保留的内容大小成正比, 只适用于 wal 恢复与回滚这类不频繁的截断
+func (file *File) Truncate(size int64) error {
+	if file.Encrypted() {
+		return file.rekey(size)
+	}
+	if err := file.f.Truncate(size); err != nil {
+		return err
+	}
+	file.size = size
+	return nil
+}
+
+func (file *File) rekey(size int64) error {
+	name := file.name
+	// 不以数字开头, 不会被当作 wal segment 或 sstable
+	tmpName := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".rekey")
+	f, err := file.fs.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	tmp := &File{fs: file.fs, f: f, name: tmpName}
+	if err := file.copyTo(tmp, size); err != nil {
+		f.Close()
+		file.fs.Remove(tmpName)
+		return err
+	}
+
+	// rename 之后 f 即为原文件, 原来的文件描述符不再需要
+	file.f.Close()
+	*file = *tmp
+	file.name = name
+	return nil
+}
+
+// 将前 size 字节的内容用新的 iv 写入 tmp, 并用 tmp 替换 file 对应的文件
+func (file *File) copyTo(tmp *File, size int64) error {
+	if err := tmp.writeHeader(file.keyID, file.key); err != nil {
+		return err
+	}
+	buf := make([]byte, rekeyBufferSize)
+	for off := int64(0); off < size; {
+		n := int(min(int64(len(buf)), size-off))
+		if _, err := file.ReadAt(buf[:n], off); err != nil {
+			return err
+		}
+		if _, err := tmp.Write(buf[:n]); err != nil {
+			return err
+		}
+		off += int64(n)
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	return file.fs.Rename(tmp.Name(), file.Name())
+}
+
+// 内容大小, 不包括文件头
+func (file *File) Size() int64 {
+	return file.size
+}
+
+func (file *File) Name() string {
+	return file.name
+}
+
+func (file *File) Sync() error {
+	return file.f.Sync()
+}
+
+func (file *File) Close() error {
+	return file.f.Close()
+}
@@ -0,0 +1,157 @@
+package encryption
+
+import (
+	"bytes"
+	"lsm/pkg/vfs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKeys() *StaticKeyProvider {
+	return &StaticKeyProvider{
+		CurrentID: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+			"k2": bytes.Repeat([]byte{2}, 16),
+		},
+	}
+}
+
+func TestFile(t *testing.T) {
+	fs, name := vfs.NewMemFS(), "file"
+	keys := testKeys()
+	data := bytes.Repeat([]byte("0123456789abcdef-"), 1000)
+
+	f, err := OpenAppend(fs, name, keys)
+	assert.Nil(t, err)
+	assert.True(t, f.Encrypted())
+	// 分多次写入, 偏移量不与 aes block 对齐
+	for i := 0; i < len(data); i += 1001 {
+		_, err := f.Write(data[i:min(i+1001, len(data))])
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, int64(len(data)), f.Size())
+	assert.Nil(t, f.Close())
+
+	// 磁盘上是密文
+	raw, err := vfs.ReadFile(fs, name)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(raw, data[:32]))
+
+	// 重新打开后追加写入, 并从任意位置读取
+	f, err = OpenAppend(fs, name, keys)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("tail"))
+	assert.Nil(t, err)
+	data = append(data, "tail"...)
+	for _, off := range []int{0, 1, 15, 16, 17, 1000, len(data) - 4} {
+		buf := make([]byte, min(100, len(data)-off))
+		_, err := f.ReadAt(buf, int64(off))
+		assert.Nil(t, err)
+		assert.Equal(t, data[off:off+len(buf)], buf)
+	}
+
+	// 截断后写入的内容不能复用原来的密钥流, 即使写入相同的数据, 密文也不同
+	before, err := vfs.ReadFile(fs, name)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Truncate(10))
+	assert.Equal(t, int64(10), f.Size())
+	_, err = f.Write(data[10:20])
+	assert.Nil(t, err)
+	after, err := vfs.ReadFile(fs, name)
+	assert.Nil(t, err)
+	assert.Equal(t, len(before)-len(data)+20, len(after))
+	assert.NotEqual(t, before[len(after)-20:len(after)], after[len(after)-20:])
+	_, err = f.Write([]byte("after"))
+	assert.Nil(t, err)
+	buf := make([]byte, 25)
+	_, err = f.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, append(bytes.Clone(data[:20]), "after"...), buf)
+	assert.Nil(t, f.Close())
+
+	// 临时文件已被替换, 不会留在目录中
+	names, err := fs.List(".")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{name}, names)
+
+	// 更换密钥后, 旧文件仍使用原来的密钥读取
+	keys.CurrentID = "k2"
+	f, err = Open(fs, name, keys)
+	assert.Nil(t, err)
+	_, err = f.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+}
+
+// 截断后 Name 仍是原来的文件名, 可以再次截断与删除
+func TestFileTruncateName(t *testing.T) {
+	fs, name := vfs.NewMemFS(), "file"
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	f, err := Create(fs, name, testKeys())
+	assert.Nil(t, err)
+	_, err = f.Write(data)
+	assert.Nil(t, err)
+
+	assert.Nil(t, f.Truncate(50))
+	assert.Equal(t, name, f.Name())
+	assert.Nil(t, f.Truncate(20))
+	assert.Equal(t, name, f.Name())
+	names, err := fs.List(".")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{name}, names)
+
+	buf := make([]byte, 20)
+	_, err = f.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, data[:20], buf)
+	assert.Nil(t, f.Close())
+
+	assert.Nil(t, fs.Remove(f.Name()))
+	names, err = fs.List(".")
+	assert.Nil(t, err)
+	assert.Empty(t, names)
+}
+
+func TestFileWrongKey(t *testing.T) {
+	fs, name := vfs.NewMemFS(), "file"
+	f, err := Create(fs, name, testKeys())
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("secret"))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	_, err = Open(fs, name, &StaticKeyProvider{Keys: map[string][]byte{"k1": bytes.Repeat([]byte{3}, 32)}})
+	assert.ErrorIs(t, err, ErrKeyMismatch)
+
+	_, err = Open(fs, name, &StaticKeyProvider{Keys: map[string][]byte{"k2": bytes.Repeat([]byte{2}, 16)}})
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	_, err = Open(fs, name, nil)
+	assert.ErrorIs(t, err, ErrNoKeyProvider)
+}
+
+func TestFilePlaintext(t *testing.T) {
+	fs, name := vfs.NewMemFS(), "file"
+	f, err := Create(fs, name, nil)
+	assert.Nil(t, err)
+	assert.False(t, f.Encrypted())
+	_, err = f.Write([]byte("plain"))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	raw, err := vfs.ReadFile(fs, name)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("plain"), raw)
+
+	// 开启加密前的文件仍然可以读取
+	f, err = Open(fs, name, testKeys())
+	assert.Nil(t, err)
+	assert.False(t, f.Encrypted())
+	buf := make([]byte, 5)
+	_, err = f.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("plain"), buf)
+	assert.Nil(t, f.Close())
+}
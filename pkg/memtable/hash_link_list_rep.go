@@ -0,0 +1,109 @@
+package memtable
+
+import (
+	"hash/fnv"
+	"lsm/internal/key"
+	"slices"
+	"sync/atomic"
+	"unsafe"
+)
+
+const DefaultHashBucketCount = 1 << 16
+
+// 从 user key 中取出用于分桶的前缀, 返回值是 userKey 的一部分
+type PrefixExtractor func(userKey []byte) []byte
+
+// 取 user key 的前 n 个字节, 不足 n 个字节时取整个 user key
+func FixedPrefix(n int) PrefixExtractor {
+	return func(userKey []byte) []byte {
+		return userKey[:min(n, len(userKey))]
+	}
+}
+
+type hashNode struct {
+	key  []byte
+	next atomic.Pointer[hashNode]
+}
+
+// 按 user key 前缀的哈希分桶, 每个桶是一个有序链表
+//
+// 相同前缀的点查只需遍历一个桶, 适合按前缀查询、每个前缀下记录不多的场景;
+// 全量遍历(flush 与迭代器)需要对所有记录排序, 代价较高
+// 与 ConcurrentSkiplist 相同, next 通过原子操作发布, 读取不加锁
+type hashLinkListRep struct {
+	prefix  PrefixExtractor
+	cmp     func(a, b []byte) int
+	buckets []atomic.Pointer[hashNode]
+	size    atomic.Int64
+	memory  atomic.Uint64
+}
+
+// prefix 为 nil 时按整个 user key 分桶, bucketCount <= 0 时使用 DefaultHashBucketCount
+func NewHashLinkListRepFactory(prefix PrefixExtractor, bucketCount int) RepFactory {
+	if prefix == nil {
+		prefix = func(userKey []byte) []byte { return userKey }
+	}
+	if bucketCount <= 0 {
+		bucketCount = DefaultHashBucketCount
+	}
+	return func(maxSize uint64, cmp func(a, b []byte) int) Rep {
+		return &hashLinkListRep{
+			prefix:  prefix,
+			cmp:     cmp,
+			buckets: make([]atomic.Pointer[hashNode], bucketCount),
+		}
+	}
+}
+
+func (r *hashLinkListRep) bucket(userKey []byte) *atomic.Pointer[hashNode] {
+	h := fnv.New32a()
+	h.Write(r.prefix(userKey))
+	return &r.buckets[h.Sum32()%uint32(len(r.buckets))]
+}
+
+func (r *hashLinkListRep) Insert(ik *key.InternalKey) {
+	n := &hashNode{key: ik.EncodeTo()}
+	// 找到最后一个 < n.key 的位置, 先设置 n.next 再发布 n
+	prev := r.bucket(ik.UserKey)
+	for next := prev.Load(); next != nil && r.cmp(next.key, n.key) < 0; next = prev.Load() {
+		prev = &next.next
+	}
+	n.next.Store(prev.Load())
+	prev.Store(n)
+
+	r.size.Add(1)
+	r.memory.Add(uint64(unsafe.Sizeof(hashNode{})) + uint64(len(n.key)))
+}
+
+func (r *hashLinkListRep) Get(userKey []byte, lookup []byte, fn func(encoded []byte) bool) {
+	n := r.bucket(userKey).Load()
+	for n != nil && r.cmp(n.key, lookup) < 0 {
+		n = n.next.Load()
+	}
+	for ; n != nil && fn(n.key); n = n.next.Load() {
+	}
+}
+
+// 遍历开始时对所有桶做快照并排序, 之后插入的记录不可见
+func (r *hashLinkListRep) Iterator() Iterator {
+	keys := make([][]byte, 0, r.Len())
+	for i := range r.buckets {
+		for n := r.buckets[i].Load(); n != nil; n = n.next.Load() {
+			keys = append(keys, n.key)
+		}
+	}
+	slices.SortFunc(keys, r.cmp)
+	return newSliceIterator(keys, r.cmp)
+}
+
+func (r *hashLinkListRep) Len() int {
+	return int(r.size.Load())
+}
+
+// 只统计记录占用的内存, 桶数组是与写入量无关的固定开销, 不计入 memtable 的大小上限,
+// 否则默认的桶数(约 512KB)会使较小的 memtable 在第一次写入后就被视为已满
+func (r *hashLinkListRep) ApproximateMemoryUsage() uint64 {
+	return r.memory.Load()
+}
+
+func (r *hashLinkListRep) MarkReadOnly() {}
@@ -3,64 +3,212 @@ package memtable
 import (
 	"bytes"
 	"lsm/internal/key"
-	"lsm/pkg/skiplist"
+	"lsm/pkg/bloom"
+	"lsm/pkg/comparator"
+	"lsm/pkg/merge"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// memtable bloom filter 的误判率
+const bloomFalsePositive = 0.01
+
+type Option struct {
+	// 大小上限, 达到后 Full 返回 true
+	MaxSize uint64
+
+	// Get 遇到 merge operand 时使用, 为 nil 时无法读取 merge 写入的 key
+	MergeOperator merge.MergeOperator
+
+	// 记录的存储结构, 为 nil 时使用 NewSkiplistRep
+	Rep RepFactory
+
+	// bloom filter 预期的元素个数, 0 表示不使用 bloom filter
+	// 使用时 Get 先检查 bloom filter, 不存在的 key 不需要查找 Rep
+	BloomExpectedKeys uint64
+
+	// bloom filter 中保存 user key 的哪一部分, 为 nil 时保存整个 user key
+	BloomPrefix PrefixExtractor
+
+	// Get 判断记录是否过期时使用的时钟, 为 nil 时使用 time.Now
+	Clock func() time.Time
+
+	// user key 的排序方式, 为 nil 时使用 comparator.Bytewise
+	Comparator comparator.Comparator
+}
+
+// Memtable 允许一个写入方与任意多个读取方并发访问
+// 写入(Add/Insert)需要由调用方串行化, 读取是否会被写入阻塞取决于 Rep
 type Memtable struct {
-	skl  *skiplist.Skiplist
-	size uint64
+	rep Rep
+	// range tombstone 单独保存, 不参与 rep 的遍历
+	// 写入方只在 rangeDelBuf 末尾追加, 之后发布长度与容量固定的前缀,
+	// 读取方拿到的切片不会再被修改, 也不会因 append 写入共享的底层数组
+	rangeDels   atomic.Pointer[key.RangeTombstones]
+	rangeDelBuf key.RangeTombstones
+	// range tombstone 占用的字节数
+	rangeDelSize atomic.Uint64
+	// 为 nil 表示不使用
+	bloom *bloom.Bloom
 
-	maxSize uint64
+	option Option
+}
+
+func (o *Option) comparator() comparator.Comparator {
+	return comparator.OrDefault(o.Comparator)
 }
 
 func NewMemtable(maxSize uint64) *Memtable {
-	return &Memtable{
-		skl:     skiplist.New(skiplist.CompareFunc(key.InternalKeyCompareFunc)),
-		maxSize: maxSize,
+	return New(Option{MaxSize: maxSize})
+}
+
+func New(option Option) *Memtable {
+	newRep := option.Rep
+	if newRep == nil {
+		newRep = NewSkiplistRep
+	}
+	mem := &Memtable{
+		rep:    newRep(option.MaxSize, key.InternalKeyComparer(option.comparator().Compare)),
+		option: option,
+	}
+	if option.BloomExpectedKeys > 0 {
+		mem.bloom = bloom.NewBloom(option.BloomExpectedKeys, bloomFalsePositive)
 	}
+	return mem
 }
 
 func (mem *Memtable) Add(seq uint64, tp key.KeyType, userKey []byte, userValue []byte) {
-	ik := key.New(userKey, userValue, seq, tp)
+	// Rep 保存的是编码后的副本, 不需要复制 userKey 与 userValue
+	ik := key.InternalKey{UserKey: userKey, UserValue: userValue, Seq: seq, Type: tp}
+	mem.Insert(&ik)
+}
+
+// 插入完整的 InternalKey, 保留 ExpireAt 等 Add 无法指定的字段
+func (mem *Memtable) Insert(ik *key.InternalKey) {
+	if ik.Type == key.KTypeRangeDeletion {
+		t := key.RangeTombstoneFrom(ik)
+		t.Start, t.End = bytes.Clone(t.Start), bytes.Clone(t.End)
+		mem.rangeDelBuf = append(mem.rangeDelBuf, t)
+		n := len(mem.rangeDelBuf)
+		rangeDels := mem.rangeDelBuf[:n:n]
+		mem.rangeDels.Store(&rangeDels)
+		mem.rangeDelSize.Add(ik.Size())
+		return
+	}
+	if mem.bloom != nil {
+		mem.bloom.Add(mem.bloomKey(ik.UserKey))
+	}
+	mem.rep.Insert(ik)
+}
+
+func (mem *Memtable) bloomKey(userKey []byte) []byte {
+	if mem.option.BloomPrefix != nil {
+		return mem.option.BloomPrefix(userKey)
+	}
+	return userKey
+}
 
-	mem.skl.Insert(ik.EncodeTo())
-	mem.size += ik.Size()
+// bloom filter 确定 userKey 不在 rep 中时返回 false
+func (mem *Memtable) mayContain(userKey []byte) bool {
+	return mem.bloom == nil || mem.bloom.Contains(mem.bloomKey(userKey))
 }
 
-// 返回 <= seq 的最新记录
+// 返回 <= seq 的最新记录, merge operand 会与更旧的记录合并, 已过期的 value 视为不存在
 func (mem *Memtable) Get(userKey []byte, seq uint64) (value []byte, ok bool) {
+	ctx := merge.NewGetContext(mem.option.MergeOperator, userKey)
+	ctx.SetNow(mem.now())
+	mem.Lookup(ctx, seq)
+	return ctx.Result()
+}
+
+func (mem *Memtable) now() time.Time {
+	if mem.option.Clock != nil {
+		return mem.option.Clock()
+	}
+	return time.Now()
+}
+
+// 将 ctx.UserKey() 在 <= seq 时的记录从新到旧交给 ctx
+// 返回 true 表示 ctx 已得到结果, 不需要继续查找更旧的数据
+func (mem *Memtable) Lookup(ctx *merge.GetContext, seq uint64) bool {
+	ucmp := mem.option.comparator().Compare
+	ctx.AddRangeDeletion(mem.RangeTombstones().MaxCoveringSeq(ucmp, ctx.UserKey(), seq))
+	if !mem.mayContain(ctx.UserKey()) {
+		return false
+	}
+
+	lookup := key.NewLookupKey(ctx.UserKey(), seq)
+	done := false
+	mem.rep.Get(ctx.UserKey(), lookup.EncodeTo(), func(encoded []byte) bool {
+		var ik key.InternalKey
+		ik.DecodeFrom(encoded)
+		if ucmp(ctx.UserKey(), ik.UserKey) != 0 {
+			return false
+		}
+		done = ctx.Add(&ik)
+		return !done
+	})
+	return done
+}
+
+// 返回 userKey 在 <= seq 时的最新记录,包括删除记录
+func (mem *Memtable) Find(userKey []byte, seq uint64) (*key.InternalKey, bool) {
+	if !mem.mayContain(userKey) {
+		return nil, false
+	}
 	lookup := key.NewLookupKey(userKey, seq)
-	iter := mem.skl.Iterator()
-	iter.Seek(lookup.EncodeTo())
-	if !iter.Valid() {
+	var encoded []byte
+	mem.rep.Get(userKey, lookup.EncodeTo(), func(e []byte) bool {
+		encoded = e
+		return false
+	})
+	if encoded == nil {
 		return nil, false
 	}
 
 	var exactKey key.InternalKey
-	exactKey.DecodeFrom(iter.Key())
+	exactKey.DecodeFrom(encoded)
 
 	logrus.Debugf("memtable get, lookupKey=%s, exactKey=%s", lookup.Debug(), exactKey.Debug())
 
-	// 只需要比较 userKey,seek 保证返回的是 seq 最大的记录
-	if bytes.Equal(userKey, exactKey.UserKey) {
-		switch exactKey.Type {
-		case key.KTypeValue:
-			return exactKey.UserValue, true
-		case key.KTypeDeletion:
-			return nil, false
-		default:
-			panic("unexpected type")
-		}
+	// 只需要比较 userKey,Get 保证返回的是 seq 最大的记录
+	if mem.option.comparator().Compare(userKey, exactKey.UserKey) != 0 {
+		return nil, false
+	}
+	return &exactKey, true
+}
+
+// 返回的切片不能修改
+func (mem *Memtable) RangeTombstones() key.RangeTombstones {
+	if rangeDels := mem.rangeDels.Load(); rangeDels != nil {
+		return *rangeDels
 	}
-	return nil, false
+	return nil
 }
 
-func (mem *Memtable) Iterator() *skiplist.Iterator {
-	return mem.skl.Iterator()
+func (mem *Memtable) Iterator() Iterator {
+	return mem.rep.Iterator()
 }
 
+// 近似的内存占用, 包括 rep 中的记录, 以及 range tombstone
+// bloom filter 的大小在创建时已经确定, 不计入
+func (mem *Memtable) ApproximateMemoryUsage() uint64 {
+	return mem.rep.ApproximateMemoryUsage() + mem.rangeDelSize.Load()
+}
+
+// 切换为 imm 后调用, 之后不能再写入
+// 部分 Rep 会在此时整理数据, 如 vector rep 排序
+func (mem *Memtable) MarkImmutable() {
+	mem.rep.MarkReadOnly()
+}
+
+// 空的 memtable 不会是满的, rep 的固定开销(如 arena 中的 head 节点)可能已超过很小的 MaxSize
 func (mem *Memtable) Full() bool {
-	return mem.size >= mem.maxSize
+	return !mem.Empty() && mem.ApproximateMemoryUsage() >= mem.option.MaxSize
+}
+
+func (mem *Memtable) Empty() bool {
+	return mem.rep.Len() == 0 && len(mem.RangeTombstones()) == 0
 }
@@ -1,9 +1,17 @@
 package memtable
 
 import (
+	"bytes"
+	"fmt"
 	"lsm/internal/key"
+	"lsm/pkg/merge"
 	"math"
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -45,3 +53,329 @@ func TestMemTableBasic(t *testing.T) {
 	assert.False(t, ok)
 	assert.Nil(t, v6)
 }
+
+func TestMemTableMerge(t *testing.T) {
+	mem := New(Option{MaxSize: math.MaxUint64, MergeOperator: merge.StringAppendOperator{Delimiter: []byte(",")}})
+	mem.Add(1, key.KTypeMerge, []byte("list"), []byte("a"))
+	mem.Add(2, key.KTypeMerge, []byte("list"), []byte("b"))
+	mem.Add(3, key.KTypeDeletion, []byte("list"), nil)
+	mem.Add(4, key.KTypeMerge, []byte("list"), []byte("c"))
+	mem.Add(5, key.KTypeValue, []byte("list"), []byte("x"))
+	mem.Add(6, key.KTypeMerge, []byte("list"), []byte("y"))
+
+	cases := []struct {
+		seq   uint64
+		value string
+	}{
+		{1, "a"},
+		{2, "a,b"},
+		// 删除之后的 operand 以空值为基础
+		{4, "c"},
+		{5, "x"},
+		{6, "x,y"},
+	}
+	for _, c := range cases {
+		value, ok := mem.Get([]byte("list"), c.seq)
+		assert.True(t, ok)
+		assert.Equal(t, []byte(c.value), value)
+	}
+	_, ok := mem.Get([]byte("list"), 3)
+	assert.False(t, ok)
+
+	// 未设置 MergeOperator 时无法读取
+	mem = NewMemtable(math.MaxUint64)
+	mem.Add(1, key.KTypeMerge, []byte("list"), []byte("a"))
+	_, ok = mem.Get([]byte("list"), 1)
+	assert.False(t, ok)
+}
+
+func TestMemTableRangeDeletion(t *testing.T) {
+	mem := NewMemtable(math.MaxUint64)
+	mem.Add(1, key.KTypeValue, []byte("a"), []byte("1"))
+	mem.Add(2, key.KTypeValue, []byte("b"), []byte("2"))
+	mem.Add(3, key.KTypeValue, []byte("c"), []byte("3"))
+	// 删除 [a, c)
+	mem.Add(4, key.KTypeRangeDeletion, []byte("a"), []byte("c"))
+	mem.Add(5, key.KTypeValue, []byte("b"), []byte("5"))
+
+	_, ok := mem.Get([]byte("a"), 100)
+	assert.False(t, ok)
+	v, ok := mem.Get([]byte("b"), 100)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("5"), v)
+	v, ok = mem.Get([]byte("c"), 100)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("3"), v)
+
+	// seq=3 时 tombstone 还不可见
+	v, ok = mem.Get([]byte("a"), 3)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), v)
+
+	// tombstone 与点数据分开保存
+	assert.Equal(t, key.RangeTombstones{{Start: []byte("a"), End: []byte("c"), Seq: 4}}, mem.RangeTombstones())
+}
+
+// 大量 range tombstone 写入同一个 memtable 时, 每次写入不复制之前的 tombstone
+func TestMemTableManyRangeDeletions(t *testing.T) {
+	const N = 20000
+	mem := NewMemtable(math.MaxUint64)
+	userKey := func(i int) []byte {
+		return fmt.Appendf(nil, "key-%05d", i)
+	}
+	mem.Add(1, key.KTypeRangeDeletion, userKey(0), userKey(1))
+	first := mem.RangeTombstones()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 1; i < N; i++ {
+		mem.Add(uint64(i+1), key.KTypeRangeDeletion, userKey(i), userKey(i+1))
+	}
+	runtime.ReadMemStats(&after)
+	// 每次复制全部 tombstone 时共需分配约 N*N/2 个 RangeTombstone, 远超这里的上限
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(N*1024))
+
+	// 之前返回的切片不受之后的写入影响
+	assert.Equal(t, key.RangeTombstones{{Start: userKey(0), End: userKey(1), Seq: 1}}, first)
+	tombstones := mem.RangeTombstones()
+	assert.Equal(t, N, len(tombstones))
+	assert.Equal(t, len(tombstones), cap(tombstones))
+	assert.Equal(t, uint64(N), tombstones.MaxCoveringSeq(bytes.Compare, userKey(N-1), math.MaxUint64))
+}
+
+var testReps = map[string]RepFactory{
+	"skiplist":     NewSkiplistRep,
+	"hashLinkList": NewHashLinkListRepFactory(FixedPrefix(6), 16),
+	"vector":       NewVectorRep,
+}
+
+func TestMemTableTTL(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	mem := New(Option{MaxSize: math.MaxUint64, Clock: func() time.Time { return now }})
+	ik := key.New([]byte("name"), []byte("xiao ming"), 0, key.KTypeValue)
+	ik.ExpireAt = now.Add(time.Minute).UnixNano()
+	mem.Insert(&ik)
+
+	// 过期判断使用注入的时钟, 而不是当前时间
+	value, ok := mem.Get([]byte("name"), 0)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("xiao ming"), value)
+
+	now = now.Add(time.Minute)
+	_, ok = mem.Get([]byte("name"), 0)
+	assert.False(t, ok)
+}
+
+func TestMemTableRep(t *testing.T) {
+	for name, newRep := range testReps {
+		t.Run(name, func(t *testing.T) {
+			const N = 200
+			mem := New(Option{MaxSize: math.MaxUint64, Rep: newRep, BloomExpectedKeys: N})
+			assert.True(t, mem.Empty())
+			userKey := func(i int) []byte {
+				return fmt.Appendf(nil, "key-%03d", i)
+			}
+
+			// seq=i+1 时写入 key i, 偶数 key 在 seq=N+i+1 时被删除, 插入顺序随机
+			for _, i := range rand.Perm(N) {
+				mem.Add(uint64(i+1), key.KTypeValue, userKey(i), userKey(i))
+			}
+			for _, i := range rand.Perm(N) {
+				if i%2 == 0 {
+					mem.Add(uint64(N+i+1), key.KTypeDeletion, userKey(i), nil)
+				}
+			}
+			assert.Greater(t, mem.ApproximateMemoryUsage(), uint64(0))
+
+			check := func() {
+				for i := range N {
+					_, ok := mem.Get(userKey(i), uint64(i))
+					assert.False(t, ok)
+					value, ok := mem.Get(userKey(i), uint64(N+i))
+					assert.True(t, ok)
+					assert.Equal(t, userKey(i), value)
+					_, ok = mem.Get(userKey(i), math.MaxUint64)
+					assert.Equal(t, i%2 == 1, ok)
+				}
+				_, ok := mem.Find(userKey(N), math.MaxUint64)
+				assert.False(t, ok)
+
+				// 全量遍历按 InternalKey 有序
+				var prev []byte
+				n := 0
+				iter := mem.Iterator()
+				for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+					if prev != nil {
+						assert.Less(t, key.InternalKeyCompareFunc(prev, iter.Key()), 0)
+					}
+					prev = iter.Key()
+					n++
+				}
+				assert.Equal(t, N+N/2, n)
+
+				lookup := key.NewLookupKey(userKey(N/2), math.MaxUint64)
+				iter.Seek(lookup.EncodeTo())
+				assert.True(t, iter.Valid())
+				ik, ok := mem.Find(userKey(N/2), math.MaxUint64)
+				assert.True(t, ok)
+				assert.Equal(t, ik.EncodeTo(), iter.Key())
+				assert.Equal(t, key.KTypeDeletion, ik.Type)
+			}
+			check()
+
+			mem.MarkImmutable()
+			check()
+		})
+	}
+}
+
+func TestMemTableConcurrentReadWrite(t *testing.T) {
+	for name, newRep := range testReps {
+		t.Run(name, func(t *testing.T) {
+			const N = 5000
+			mem := New(Option{MaxSize: math.MaxUint64, Rep: newRep, BloomExpectedKeys: N})
+			userKey := func(i int) []byte {
+				return fmt.Appendf(nil, "key-%05d", i)
+			}
+
+			// 写入方依次写入 value、覆盖与 range tombstone, 读取方不加锁地并发读取
+			var seq atomic.Uint64
+			var wg sync.WaitGroup
+			for range 4 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						last := seq.Load()
+						if last >= 2*N {
+							return
+						}
+						i := rand.IntN(N)
+						value, ok := mem.Get(userKey(i), last)
+						// seq=i+1 时写入 key i, seq=N+i+1 时覆盖
+						switch {
+						case last < uint64(i+1):
+							assert.False(t, ok)
+						case last < uint64(N+i+1):
+							assert.True(t, ok)
+							assert.Equal(t, []byte("v1"), value)
+						default:
+							assert.True(t, ok)
+							assert.Equal(t, []byte("v2"), value)
+						}
+
+						iter := mem.Iterator()
+						for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+						}
+						mem.RangeTombstones().MaxCoveringSeq(bytes.Compare, userKey(i), last)
+					}
+				}()
+			}
+
+			for i := range N {
+				mem.Add(seq.Load()+1, key.KTypeValue, userKey(i), []byte("v1"))
+				seq.Add(1)
+			}
+			for i := range N {
+				mem.Add(seq.Load()+1, key.KTypeValue, userKey(i), []byte("v2"))
+				seq.Add(1)
+				// 不覆盖任何被读取的 key, 只用于检查并发访问
+				if i%10 == 0 {
+					mem.Add(uint64(3*N+i), key.KTypeRangeDeletion, userKey(N), userKey(N+1))
+				}
+			}
+			wg.Wait()
+			assert.False(t, mem.Empty())
+		})
+	}
+}
+
+func TestMemTableBloom(t *testing.T) {
+	const N = 1000
+	for name, prefix := range map[string]PrefixExtractor{"key": nil, "prefix": FixedPrefix(8)} {
+		t.Run(name, func(t *testing.T) {
+			mem := New(Option{MaxSize: math.MaxUint64, BloomExpectedKeys: N, BloomPrefix: prefix})
+			// 每个前缀 user-xxx 下有两个 key
+			for i := range N {
+				mem.Add(uint64(i+1), key.KTypeValue, fmt.Appendf(nil, "user-%03d/%d", i/2, i%2), []byte("value"))
+			}
+			for i := range N {
+				value, ok := mem.Get(fmt.Appendf(nil, "user-%03d/%d", i/2, i%2), math.MaxUint64)
+				assert.True(t, ok)
+				assert.Equal(t, []byte("value"), value)
+			}
+
+			// 不存在的 key 绝大部分被 bloom filter 过滤
+			skipped := 0
+			for i := range N {
+				userKey := fmt.Appendf(nil, "other-%03d/%d", i/2, i%2)
+				if !mem.mayContain(userKey) {
+					skipped++
+				}
+				_, ok := mem.Get(userKey, math.MaxUint64)
+				assert.False(t, ok)
+			}
+			assert.Greater(t, skipped, N*9/10)
+
+			// 相同前缀的 key 不会被过滤, 需要查找 rep
+			assert.Equal(t, prefix != nil, mem.mayContain([]byte("user-000/2")))
+			_, ok := mem.Get([]byte("user-000/2"), math.MaxUint64)
+			assert.False(t, ok)
+
+			// range tombstone 不经过 bloom filter
+			mem.Add(N+1, key.KTypeRangeDeletion, []byte("user-000"), []byte("user-001"))
+			_, ok = mem.Get([]byte("user-000/0"), math.MaxUint64)
+			assert.False(t, ok)
+			_, ok = mem.Find([]byte("user-001/0"), math.MaxUint64)
+			assert.True(t, ok)
+		})
+	}
+}
+
+func TestMemTableArenaMemoryUsage(t *testing.T) {
+	mem := NewMemtable(64 << 10)
+	assert.True(t, mem.Empty())
+
+	usage := mem.ApproximateMemoryUsage()
+	var encoded uint64
+	for i := 0; !mem.Full(); i++ {
+		ik := key.New(fmt.Appendf(nil, "key-%06d", i), []byte("value"), uint64(i), key.KTypeValue)
+		mem.Insert(&ik)
+		encoded += ik.Size()
+
+		// 每条记录至少占用编码后的大小, 额外的开销只有节点头与 next 指针
+		assert.Greater(t, mem.ApproximateMemoryUsage(), usage+ik.Size()-1)
+		usage = mem.ApproximateMemoryUsage()
+	}
+	assert.False(t, mem.Empty())
+	assert.GreaterOrEqual(t, usage, uint64(64<<10))
+	assert.Greater(t, usage, encoded)
+
+	// 记录指向 arena, 修改写入时传入的切片不影响已插入的数据
+	userKey, userValue := []byte("k"), []byte("v1")
+	mem.Add(math.MaxUint32, key.KTypeValue, userKey, userValue)
+	userValue[1] = '2'
+	v, ok := mem.Get([]byte("k"), math.MaxUint32)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("v1"), v)
+
+	mem.Add(math.MaxUint32+1, key.KTypeRangeDeletion, userKey, []byte("l"))
+	userKey[0] = 'x'
+	_, ok = mem.Get([]byte("k"), math.MaxUint32+1)
+	assert.False(t, ok)
+}
+
+func BenchmarkMemTableAdd(b *testing.B) {
+	keys := make([][]byte, b.N)
+	for i := range keys {
+		keys[i] = fmt.Appendf(nil, "key-%016d", rand.Uint64())
+	}
+	value := make([]byte, 100)
+	mem := NewMemtable(math.MaxUint64)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range b.N {
+		mem.Add(uint64(i), key.KTypeValue, keys[i], value)
+	}
+}
@@ -0,0 +1,147 @@
+package memtable
+
+import (
+	"lsm/internal/key"
+	"lsm/pkg/arena"
+	"lsm/pkg/skiplist"
+	"slices"
+	"sort"
+)
+
+const (
+	minArenaChunkSize = 4 << 10
+	maxArenaChunkSize = arena.DefaultChunkSize
+)
+
+// Rep 是 memtable 中记录的存储结构, 记录按创建时传入的 InternalKey 比较函数排序
+//
+// Insert 由 Memtable 串行调用, 其余方法可以与 Insert 并发调用
+type Rep interface {
+	Insert(ik *key.InternalKey)
+
+	// 从第一个 >= lookup 的记录开始, 将 user key 为 userKey 的记录按顺序交给 fn,
+	// 直到 fn 返回 false 或没有更多记录, lookup 是 userKey 编码后的 LookupKey
+	// 实现可以只查找 userKey 所在的部分, 不保证 fn 能看到其它 user key 的记录
+	Get(userKey []byte, lookup []byte, fn func(encoded []byte) bool)
+
+	// 按顺序遍历所有记录
+	Iterator() Iterator
+
+	Len() int
+
+	// 近似的内存占用, 用于判断 memtable 是否已满
+	ApproximateMemoryUsage() uint64
+
+	// memtable 切换为 imm 时调用, 之后不会再有 Insert
+	MarkReadOnly()
+}
+
+// Iterator 遍历 Rep 中的记录, Key 返回编码后的 InternalKey, 不能修改
+type Iterator interface {
+	Valid() bool
+	Key() []byte
+	Next()
+	// seek to first key that >= target
+	Seek(target []byte)
+	SeekToFirst()
+}
+
+// 按 memtable 的大小上限创建 Rep, cmp 比较编码后的 InternalKey,
+// 由 key.InternalKeyComparer 根据 memtable 的 Comparator 生成
+type RepFactory func(maxSize uint64, cmp func(a, b []byte) int) Rep
+
+// 基于 arena 的 skiplist, 读取不加锁, 各种访问模式下都比较均衡, 是默认的 Rep
+type skiplistRep struct {
+	skl *skiplist.ConcurrentSkiplist
+}
+
+func NewSkiplistRep(maxSize uint64, cmp func(a, b []byte) int) Rep {
+	// chunk 不超过 maxSize, 避免小 memtable 占用过多内存
+	chunkSize := min(max(maxSize, minArenaChunkSize), maxArenaChunkSize)
+	return &skiplistRep{
+		skl: skiplist.NewConcurrent(cmp, arena.New(int(chunkSize))),
+	}
+}
+
+func (r *skiplistRep) Insert(ik *key.InternalKey) {
+	// 直接编码到 arena 中, 不需要额外的内存分配
+	r.skl.InsertWith(int(ik.Size()), ik.EncodeInto)
+}
+
+func (r *skiplistRep) Get(userKey []byte, lookup []byte, fn func(encoded []byte) bool) {
+	iter := r.skl.Iterator()
+	for iter.Seek(lookup); iter.Valid() && fn(iter.Key()); iter.Next() {
+	}
+}
+
+func (r *skiplistRep) Iterator() Iterator {
+	return r.skl.Iterator()
+}
+
+func (r *skiplistRep) Len() int {
+	return r.skl.Len()
+}
+
+func (r *skiplistRep) ApproximateMemoryUsage() uint64 {
+	return r.skl.MemoryUsage()
+}
+
+func (r *skiplistRep) MarkReadOnly() {}
+
+// 遍历有序且不再修改的 keys
+type sliceIterator struct {
+	keys [][]byte
+	pos  int
+	cmp  func(a, b []byte) int
+}
+
+func newSliceIterator(keys [][]byte, cmp func(a, b []byte) int) *sliceIterator {
+	return &sliceIterator{keys: keys, pos: len(keys), cmp: cmp}
+}
+
+func (it *sliceIterator) Valid() bool {
+	return it.pos < len(it.keys)
+}
+
+func (it *sliceIterator) Key() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.keys[it.pos]
+}
+
+func (it *sliceIterator) Next() {
+	if !it.Valid() {
+		panic("Iterator is not valid")
+	}
+	it.pos++
+}
+
+func (it *sliceIterator) Seek(target []byte) {
+	it.pos = sort.Search(len(it.keys), func(i int) bool {
+		return it.cmp(it.keys[i], target) >= 0
+	})
+}
+
+func (it *sliceIterator) SeekToFirst() {
+	it.pos = 0
+}
+
+// 对 keys 排序后, 将 [lookup, userKey 的最旧记录] 范围内的记录按顺序交给 fn
+func getFromUnsorted(keys [][]byte, userKey []byte, lookup []byte, cmp func(a, b []byte) int, fn func(encoded []byte) bool) {
+	// seq 为 0 的记录是 userKey 最旧的记录
+	last := key.NewLookupKey(userKey, 0)
+	upper := last.EncodeTo()
+	var matched [][]byte
+	for _, k := range keys {
+		if cmp(k, lookup) >= 0 && cmp(k, upper) <= 0 {
+			matched = append(matched, k)
+		}
+	}
+	slices.SortFunc(matched, cmp)
+	for _, k := range matched {
+		if !fn(k) {
+			return
+		}
+	}
+}
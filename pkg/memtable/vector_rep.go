@@ -0,0 +1,93 @@
+package memtable
+
+import (
+	"lsm/internal/key"
+	"slices"
+	"sync"
+	"unsafe"
+)
+
+// 插入时只追加到数组末尾, 切换为 imm 时才排序, 适合批量导入
+//
+// 可写期间的读取需要复制并排序全部记录, 代价较高, 且会与写入竞争锁;
+// 排序后的数组不再修改, 读取不加锁
+type vectorRep struct {
+	mu       sync.RWMutex
+	keys     [][]byte
+	readOnly bool
+	memory   uint64
+	cmp      func(a, b []byte) int
+}
+
+func NewVectorRep(maxSize uint64, cmp func(a, b []byte) int) Rep {
+	return &vectorRep{cmp: cmp}
+}
+
+func (r *vectorRep) Insert(ik *key.InternalKey) {
+	encoded := ik.EncodeTo()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.readOnly {
+		panic("insert into read only vector rep")
+	}
+	r.keys = append(r.keys, encoded)
+	r.memory += uint64(unsafe.Sizeof(encoded)) + uint64(len(encoded))
+}
+
+func (r *vectorRep) Get(userKey []byte, lookup []byte, fn func(encoded []byte) bool) {
+	if keys, ok := r.sorted(); ok {
+		it := newSliceIterator(keys, r.cmp)
+		for it.Seek(lookup); it.Valid() && fn(it.Key()); it.Next() {
+		}
+		return
+	}
+
+	r.mu.RLock()
+	keys := r.keys[:len(r.keys):len(r.keys)]
+	r.mu.RUnlock()
+	// 追加不会修改已有的元素, 可以在锁外遍历
+	getFromUnsorted(keys, userKey, lookup, r.cmp, fn)
+}
+
+func (r *vectorRep) Iterator() Iterator {
+	if keys, ok := r.sorted(); ok {
+		return newSliceIterator(keys, r.cmp)
+	}
+
+	r.mu.RLock()
+	keys := slices.Clone(r.keys)
+	r.mu.RUnlock()
+	slices.SortFunc(keys, r.cmp)
+	return newSliceIterator(keys, r.cmp)
+}
+
+// 已排序时返回全部记录
+func (r *vectorRep) sorted() ([][]byte, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys, r.readOnly
+}
+
+func (r *vectorRep) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.keys)
+}
+
+func (r *vectorRep) ApproximateMemoryUsage() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.memory
+}
+
+func (r *vectorRep) MarkReadOnly() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.readOnly {
+		// 可写期间的 Get 可能仍在锁外读取原数组, 排序副本而不是原地排序
+		keys := slices.Clone(r.keys)
+		slices.SortFunc(keys, r.cmp)
+		r.keys = keys
+		r.readOnly = true
+	}
+}
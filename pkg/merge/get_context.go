@@ -0,0 +1,130 @@
+package merge
+
+import (
+	"lsm/internal/key"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type getState int
+
+const (
+	getNotFound getState = iota
+	getFound
+	getDeleted
+	getCorrupt
+)
+
+// GetContext 记录一次点查的中间状态
+//
+// memtable、imm 和各层 sstable 按从新到旧的顺序把同一个 userKey 的记录交给 Add,
+// 遇到 merge operand 时继续查找更旧的记录, 直到遇到 value 或删除记录
+type GetContext struct {
+	op      MergeOperator
+	userKey []byte
+	// 从新到旧
+	operands [][]byte
+	state    getState
+	value    []byte
+	done     bool
+	// seq 小于该值的记录已被 range tombstone 删除
+	rangeDelSeq uint64
+	// 当前时间(unix 纳秒), 用于判断 value 是否过期, 0 表示不检查
+	now int64
+	// 交给 Add 的第一条, 即最新的记录的 seq
+	latestSeq uint64
+}
+
+func NewGetContext(op MergeOperator, userKey []byte) *GetContext {
+	return &GetContext{
+		op:      op,
+		userKey: userKey,
+	}
+}
+
+func (ctx *GetContext) UserKey() []byte {
+	return ctx.userKey
+}
+
+// 处理 userKey 的一条记录, 调用方需按从新到旧的顺序传入
+// 返回 true 表示结果已经确定, 不需要继续查找更旧的记录
+func (ctx *GetContext) Add(ik *key.InternalKey) bool {
+	if ctx.done {
+		return true
+	}
+	if ctx.latestSeq == 0 {
+		ctx.latestSeq = ik.Seq
+	}
+
+	tp := ik.Type
+	if ik.Seq < ctx.rangeDelSeq || (tp == key.KTypeValue && ik.Expired(ctx.now)) {
+		tp = key.KTypeDeletion
+	}
+	switch tp {
+	case key.KTypeValue:
+		if len(ctx.operands) == 0 {
+			ctx.state, ctx.value = getFound, ik.UserValue
+		} else {
+			ctx.fullMerge(ik.UserValue)
+		}
+	case key.KTypeDeletion:
+		if len(ctx.operands) == 0 {
+			ctx.state = getDeleted
+		} else {
+			ctx.fullMerge(nil)
+		}
+	case key.KTypeMerge:
+		ctx.operands = append(ctx.operands, ik.UserValue)
+		return false
+	default:
+		panic("unexpected type")
+	}
+	ctx.done = true
+	return true
+}
+
+// 记录覆盖 userKey 的 range tombstone, 之后 seq 更小的记录均视为已删除
+// 调用方需按从新到旧的顺序, 在交给 Add 记录之前调用
+func (ctx *GetContext) AddRangeDeletion(seq uint64) {
+	ctx.rangeDelSeq = max(ctx.rangeDelSeq, seq)
+}
+
+// 设置读取时刻, 在此之前过期的 value 视为已删除
+func (ctx *GetContext) SetNow(now time.Time) {
+	ctx.now = now.UnixNano()
+}
+
+// 返回已交给 ctx 的记录与 range tombstone 中最大的 seq, 0 表示没有任何记录
+// 用于判断 userKey 在某个 seq 之后是否被修改过
+func (ctx *GetContext) LatestSeq() uint64 {
+	return max(ctx.latestSeq, ctx.rangeDelSeq)
+}
+
+// 返回最终结果, 只有 merge operand 而没有更旧的记录时, 以空值为基础合并
+func (ctx *GetContext) Result() ([]byte, bool) {
+	if !ctx.done && len(ctx.operands) > 0 {
+		ctx.fullMerge(nil)
+		ctx.done = true
+	}
+	return ctx.value, ctx.state == getFound
+}
+
+func (ctx *GetContext) fullMerge(existingValue []byte) {
+	if ctx.op == nil {
+		logrus.Errorf("merge operand found for key %s, but no merge operator is set", ctx.userKey)
+		ctx.state = getCorrupt
+		return
+	}
+
+	operands := slices.Clone(ctx.operands)
+	slices.Reverse(operands)
+	value, ok := ctx.op.FullMerge(ctx.userKey, existingValue, operands)
+	if !ok {
+		logrus.Errorf("merge failed for key %s", ctx.userKey)
+		ctx.state = getCorrupt
+		return
+	}
+	ctx.state, ctx.value = getFound, value
+}
@@ -0,0 +1,64 @@
+package merge
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// MergeOperator 定义 read-modify-write 的合并逻辑, 如计数器累加、列表追加
+//
+// Db.Merge 只写入 operand, 不需要先读取旧值.
+// 读取时才将 operand 作用于更旧的 value 得到结果, compaction 时会把 operand 尽量合并,
+// 避免 operand 无限堆积
+//
+// 实现需要保证并发安全
+type MergeOperator interface {
+	// 将 operands(从旧到新) 依次作用于 existingValue, existingValue 为 nil 表示不存在旧值
+	// 返回 false 表示合并失败
+	FullMerge(userKey, existingValue []byte, operands [][]byte) ([]byte, bool)
+
+	// 将两个相邻的 operand 合并为一个, leftOperand 更旧
+	// 返回 false 表示无法合并, 两个 operand 都会保留
+	PartialMerge(userKey, leftOperand, rightOperand []byte) ([]byte, bool)
+}
+
+// UInt64AddOperator 将 value 和 operand 视为小端编码的 uint64 并累加, 用于计数器
+type UInt64AddOperator struct{}
+
+func (UInt64AddOperator) FullMerge(userKey, existingValue []byte, operands [][]byte) ([]byte, bool) {
+	var sum uint64
+	if existingValue != nil {
+		if len(existingValue) != 8 {
+			return nil, false
+		}
+		sum = binary.LittleEndian.Uint64(existingValue)
+	}
+	for _, operand := range operands {
+		if len(operand) != 8 {
+			return nil, false
+		}
+		sum += binary.LittleEndian.Uint64(operand)
+	}
+	return binary.LittleEndian.AppendUint64(nil, sum), true
+}
+
+func (op UInt64AddOperator) PartialMerge(userKey, leftOperand, rightOperand []byte) ([]byte, bool) {
+	return op.FullMerge(userKey, leftOperand, [][]byte{rightOperand})
+}
+
+// StringAppendOperator 将 operand 以 Delimiter 分隔追加到 value 末尾, 用于只追加的列表
+type StringAppendOperator struct {
+	Delimiter []byte
+}
+
+func (op StringAppendOperator) FullMerge(userKey, existingValue []byte, operands [][]byte) ([]byte, bool) {
+	parts := operands
+	if existingValue != nil {
+		parts = append([][]byte{existingValue}, operands...)
+	}
+	return bytes.Join(parts, op.Delimiter), true
+}
+
+func (op StringAppendOperator) PartialMerge(userKey, leftOperand, rightOperand []byte) ([]byte, bool) {
+	return bytes.Join([][]byte{leftOperand, rightOperand}, op.Delimiter), true
+}
@@ -0,0 +1,75 @@
+package merge
+
+import (
+	"encoding/binary"
+	"lsm/internal/key"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func u64(n uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, n)
+}
+
+func TestUInt64AddOperator(t *testing.T) {
+	var op UInt64AddOperator
+	value, ok := op.FullMerge([]byte("counter"), u64(10), [][]byte{u64(1), u64(2)})
+	assert.True(t, ok)
+	assert.Equal(t, u64(13), value)
+
+	value, ok = op.FullMerge([]byte("counter"), nil, [][]byte{u64(1)})
+	assert.True(t, ok)
+	assert.Equal(t, u64(1), value)
+
+	value, ok = op.PartialMerge([]byte("counter"), u64(1), u64(2))
+	assert.True(t, ok)
+	assert.Equal(t, u64(3), value)
+
+	_, ok = op.FullMerge([]byte("counter"), []byte("bad"), nil)
+	assert.False(t, ok)
+}
+
+func TestGetContext(t *testing.T) {
+	op := StringAppendOperator{Delimiter: []byte(",")}
+	userKey := []byte("list")
+	record := func(tp key.KeyType, value string) *key.InternalKey {
+		ik := key.New(userKey, []byte(value), 0, tp)
+		return &ik
+	}
+
+	// 从新到旧: merge(c) merge(b) value(a)
+	ctx := NewGetContext(op, userKey)
+	assert.False(t, ctx.Add(record(key.KTypeMerge, "c")))
+	assert.False(t, ctx.Add(record(key.KTypeMerge, "b")))
+	assert.True(t, ctx.Add(record(key.KTypeValue, "a")))
+	value, ok := ctx.Result()
+	assert.True(t, ok)
+	assert.Equal(t, []byte("a,b,c"), value)
+
+	// 删除记录之后的 operand 以空值为基础
+	ctx = NewGetContext(op, userKey)
+	assert.False(t, ctx.Add(record(key.KTypeMerge, "b")))
+	assert.True(t, ctx.Add(record(key.KTypeDeletion, "")))
+	value, ok = ctx.Result()
+	assert.True(t, ok)
+	assert.Equal(t, []byte("b"), value)
+
+	// 没有更旧的记录
+	ctx = NewGetContext(op, userKey)
+	assert.False(t, ctx.Add(record(key.KTypeMerge, "b")))
+	value, ok = ctx.Result()
+	assert.True(t, ok)
+	assert.Equal(t, []byte("b"), value)
+
+	ctx = NewGetContext(op, userKey)
+	assert.True(t, ctx.Add(record(key.KTypeDeletion, "")))
+	_, ok = ctx.Result()
+	assert.False(t, ok)
+
+	// 未设置 MergeOperator
+	ctx = NewGetContext(nil, userKey)
+	assert.False(t, ctx.Add(record(key.KTypeMerge, "b")))
+	_, ok = ctx.Result()
+	assert.False(t, ok)
+}
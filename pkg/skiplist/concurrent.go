@@ -0,0 +1,204 @@
+package skiplist
+
+import (
+	"encoding/binary"
+	"fmt"
+	"lsm/pkg/arena"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// 节点保存在 arena 中, 布局为
+//
+//	keyLen(uint32) | height(uint32) | next[height](uint64) | key
+//
+// next 为后继节点在 arena 中的 offset, 0 表示没有后继
+// 节点与 key 在一次分配中完成, 每次插入不会产生需要 GC 扫描的指针
+const (
+	nodeHeaderSize = 8
+	nodeNextSize   = 8
+)
+
+// ConcurrentSkiplist 是单写多读的 skiplist, 用于 memtable
+//
+// 节点与 key 都分配在 arena 中, 用 offset 互相引用.
+// next 通过原子操作读写, 新节点从底层向上逐层发布,
+// 因此读取(Contains 与迭代器)不需要加锁, 也不会被写入阻塞, 只会看到完整插入的节点.
+// 同一时刻只能有一个 goroutine 调用 Insert, 由调用方保证, 如 db.mu
+//
+// 不支持删除, 节点在 skiplist 被丢弃之前一直有效
+type ConcurrentSkiplist struct {
+	arena *arena.Arena
+	head  uint64
+	comp  CompareFunc
+	// 当前最高的层数, 只增不减
+	level atomic.Int32
+	size  atomic.Int64
+	// 只由写入方使用
+	seed *rand.Rand
+}
+
+// a 为 nil 时使用 arena.DefaultChunkSize 创建
+func NewConcurrent(comp CompareFunc, a *arena.Arena) *ConcurrentSkiplist {
+	if a == nil {
+		a = arena.New(arena.DefaultChunkSize)
+	}
+	s := &ConcurrentSkiplist{
+		arena: a,
+		comp:  comp,
+		seed:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	s.head = s.newNode(maxLevel, 0)
+	s.level.Store(1)
+	return s
+}
+
+// 插入 key 的副本, key 已存在时 panic
+// 不能与其它 Insert 并发调用, 可以与读取并发
+func (s *ConcurrentSkiplist) Insert(key []byte) {
+	s.InsertWith(len(key), func(dst []byte) {
+		copy(dst, key)
+	})
+}
+
+// 插入长度为 size 的 key, 由 fill 直接写入 arena 中的内存, 避免调用方先分配再复制
+// fill 返回后 key 不能再修改, 其它要求同 Insert
+func (s *ConcurrentSkiplist) InsertWith(size int, fill func(dst []byte)) {
+	newLevel := s.randomLevel()
+	n := s.newNode(newLevel, size)
+	key := s.key(n)
+	fill(key)
+
+	var prev [maxLevel]uint64
+	level := int(s.level.Load())
+	h := s.head
+	for i := level - 1; i >= 0; i-- {
+		h = s.findLessThan(h, i, key)
+		if next := s.next(h, i); next != 0 && s.comp(s.key(next), key) == 0 {
+			panic(fmt.Sprintf("same key %v already exist", key))
+		}
+		prev[i] = h
+	}
+	for i := level; i < newLevel; i++ {
+		prev[i] = s.head
+	}
+
+	// 先设置新节点的 next, 再从底层向上发布,
+	// 读取方在任意一层看到新节点时, 其下层已经可以访问到该节点
+	for i := range newLevel {
+		s.setNext(n, i, s.next(prev[i], i))
+		s.setNext(prev[i], i, n)
+	}
+	if newLevel > level {
+		// 读取方看到更高的 level 时, 若该层尚未发布新节点, 只会从 head 直接下降
+		s.level.Store(int32(newLevel))
+	}
+	s.size.Add(1)
+}
+
+func (s *ConcurrentSkiplist) Contains(key []byte) bool {
+	n := s.findGreaterOrEqual(key)
+	return n != 0 && s.comp(s.key(n), key) == 0
+}
+
+func (s *ConcurrentSkiplist) Len() int {
+	return int(s.size.Load())
+}
+
+// 已从 arena 分配的字节数, 包括节点与 key
+func (s *ConcurrentSkiplist) MemoryUsage() uint64 {
+	return s.arena.Size()
+}
+
+func (s *ConcurrentSkiplist) Iterator() *ConcurrentIterator {
+	return &ConcurrentIterator{s: s}
+}
+
+func (s *ConcurrentSkiplist) newNode(height int, keyLen int) uint64 {
+	n := s.arena.Allocate(nodeHeaderSize + nodeNextSize*height + keyLen)
+	header := s.arena.Bytes(n, nodeHeaderSize)
+	binary.LittleEndian.PutUint32(header, uint32(keyLen))
+	binary.LittleEndian.PutUint32(header[4:], uint32(height))
+	return n
+}
+
+// 返回的切片指向 arena, 不能修改
+func (s *ConcurrentSkiplist) key(n uint64) []byte {
+	header := s.arena.Bytes(n, nodeHeaderSize)
+	keyLen := binary.LittleEndian.Uint32(header)
+	height := binary.LittleEndian.Uint32(header[4:])
+	return s.arena.Bytes(n+nodeHeaderSize+nodeNextSize*uint64(height), int(keyLen))
+}
+
+func (s *ConcurrentSkiplist) next(n uint64, level int) uint64 {
+	return s.arena.LoadUint64(n + nodeHeaderSize + nodeNextSize*uint64(level))
+}
+
+func (s *ConcurrentSkiplist) setNext(n uint64, level int, next uint64) {
+	s.arena.StoreUint64(n+nodeHeaderSize+nodeNextSize*uint64(level), next)
+}
+
+// 返回第 level 层中最后一个 < target 的节点
+func (s *ConcurrentSkiplist) findLessThan(begin uint64, level int, target []byte) uint64 {
+	h := begin
+	for next := s.next(h, level); next != 0; next = s.next(h, level) {
+		if s.comp(s.key(next), target) >= 0 {
+			break
+		}
+		h = next
+	}
+	return h
+}
+
+// 返回第一个 >= target 的节点, 不存在时返回 0
+func (s *ConcurrentSkiplist) findGreaterOrEqual(target []byte) uint64 {
+	h := s.head
+	for i := int(s.level.Load()) - 1; i >= 0; i-- {
+		h = s.findLessThan(h, i, target)
+	}
+	return s.next(h, 0)
+}
+
+func (s *ConcurrentSkiplist) randomLevel() int {
+	level := 1
+	for level < maxLevel && s.seed.Float64() < p {
+		level++
+	}
+	return level
+}
+
+// ConcurrentIterator 遍历 ConcurrentSkiplist, 可以与 Insert 并发使用
+// 遍历期间插入的节点可能被看到, 也可能看不到
+type ConcurrentIterator struct {
+	s   *ConcurrentSkiplist
+	cur uint64
+}
+
+func (it *ConcurrentIterator) Valid() bool {
+	return it.cur != 0
+}
+
+// 返回的切片指向 arena, 不能修改
+func (it *ConcurrentIterator) Key() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.s.key(it.cur)
+}
+
+func (it *ConcurrentIterator) Next() {
+	if !it.Valid() {
+		panic("Iterator is not valid")
+	}
+	it.cur = it.s.next(it.cur, 0)
+}
+
+// seek to first node that >= target
+func (it *ConcurrentIterator) Seek(target []byte) {
+	it.cur = it.s.findGreaterOrEqual(target)
+}
+
+func (it *ConcurrentIterator) SeekToFirst() {
+	it.cur = it.s.next(it.s.head, 0)
+}
@@ -0,0 +1,246 @@
+// Package generic 提供按 key 排序的泛型 skiplist, 可以作为有序 map 使用
+//
+// 与 lsm/pkg/skiplist 不同, 支持更新与删除, 并记录每一层指针跨越的节点数(span),
+// 因此可以在 O(log n) 内按排名查找
+// 不是并发安全的, 并发访问需要由调用方加锁
+package generic
+
+import (
+	"cmp"
+	"iter"
+	"math/rand"
+	"time"
+)
+
+const (
+	maxLevel = 32
+	p        = 0.5
+)
+
+type link[K, V any] struct {
+	node *node[K, V]
+	// 从当前节点沿该层指针到达 node 时, 在底层跨越的节点数
+	// node 为 nil 时为到末尾的节点数
+	span int
+}
+
+type node[K, V any] struct {
+	key   K
+	value V
+	next  []link[K, V]
+}
+
+type Skiplist[K, V any] struct {
+	head  *node[K, V]
+	level int
+	size  int
+	cmp   func(a, b K) int
+	seed  *rand.Rand
+}
+
+func New[K, V any](cmp func(a, b K) int) *Skiplist[K, V] {
+	return &Skiplist[K, V]{
+		head:  &node[K, V]{next: make([]link[K, V], maxLevel)},
+		level: 1,
+		cmp:   cmp,
+		seed:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// key 按 cmp.Compare 排序
+func NewOrdered[K cmp.Ordered, V any]() *Skiplist[K, V] {
+	return New[K, V](cmp.Compare[K])
+}
+
+func (s *Skiplist[K, V]) Len() int {
+	return s.size
+}
+
+func (s *Skiplist[K, V]) Get(key K) (V, bool) {
+	if n := s.findGreaterOrEqual(key); n != nil && s.cmp(n.key, key) == 0 {
+		return n.value, true
+	}
+	var zero V
+	return zero, false
+}
+
+// 写入 key, key 已存在时更新 value 并返回 true
+func (s *Skiplist[K, V]) Set(key K, value V) bool {
+	var update [maxLevel]*node[K, V]
+	// rank[i] 为 update[i] 的排名, head 为 0
+	var rank [maxLevel]int
+	h := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		if i < s.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for next := h.next[i]; next.node != nil && s.cmp(next.node.key, key) < 0; next = h.next[i] {
+			rank[i] += next.span
+			h = next.node
+		}
+		update[i] = h
+	}
+	if next := h.next[0].node; next != nil && s.cmp(next.key, key) == 0 {
+		next.value = value
+		return true
+	}
+
+	newLevel := s.randomLevel()
+	for i := s.level; i < newLevel; i++ {
+		update[i] = s.head
+		rank[i] = 0
+		s.head.next[i].span = s.size
+	}
+	s.level = max(s.level, newLevel)
+
+	n := &node[K, V]{key: key, value: value, next: make([]link[K, V], newLevel)}
+	for i := range newLevel {
+		prev := &update[i].next[i]
+		// rank[0]-rank[i] 为 update[i] 与新节点前一个节点之间的距离
+		n.next[i] = link[K, V]{node: prev.node, span: prev.span - (rank[0] - rank[i])}
+		*prev = link[K, V]{node: n, span: rank[0] - rank[i] + 1}
+	}
+	// 更高的层跨过了新节点
+	for i := newLevel; i < s.level; i++ {
+		update[i].next[i].span++
+	}
+	s.size++
+	return false
+}
+
+// 删除 key, 返回 key 是否存在
+func (s *Skiplist[K, V]) Delete(key K) bool {
+	var update [maxLevel]*node[K, V]
+	h := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		h = s.findLessThan(h, i, key)
+		update[i] = h
+	}
+	n := h.next[0].node
+	if n == nil || s.cmp(n.key, key) != 0 {
+		return false
+	}
+
+	for i := range s.level {
+		prev := &update[i].next[i]
+		if prev.node == n {
+			*prev = link[K, V]{node: n.next[i].node, span: prev.span + n.next[i].span - 1}
+		} else {
+			prev.span--
+		}
+	}
+	for s.level > 1 && s.head.next[s.level-1].node == nil {
+		s.level--
+	}
+	s.size--
+	return true
+}
+
+// 返回 key 的排名, 从 0 开始, key 不存在时返回 false
+func (s *Skiplist[K, V]) Rank(key K) (int, bool) {
+	rank := 0
+	h := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for next := h.next[i]; next.node != nil && s.cmp(next.node.key, key) <= 0; next = h.next[i] {
+			rank += next.span
+			h = next.node
+		}
+		if h != s.head && s.cmp(h.key, key) == 0 {
+			return rank - 1, true
+		}
+	}
+	return 0, false
+}
+
+// 返回排名为 index 的记录, 从 0 开始, 越界时返回 false
+func (s *Skiplist[K, V]) At(index int) (K, V, bool) {
+	if n := s.nodeAt(index); n != nil {
+		return n.key, n.value, true
+	}
+	var (
+		zeroK K
+		zeroV V
+	)
+	return zeroK, zeroV, false
+}
+
+// 按顺序遍历所有记录
+func (s *Skiplist[K, V]) All() iter.Seq2[K, V] {
+	return s.iterate(s.head.next[0].node, nil)
+}
+
+// 按顺序遍历 [lower, upper) 内的记录
+func (s *Skiplist[K, V]) Range(lower, upper K) iter.Seq2[K, V] {
+	return s.iterate(s.findGreaterOrEqual(lower), func(key K) bool {
+		return s.cmp(key, upper) < 0
+	})
+}
+
+// 按顺序遍历排名在 [start, end) 内的记录
+func (s *Skiplist[K, V]) RangeByRank(start, end int) iter.Seq2[K, V] {
+	remain := end - max(start, 0)
+	return s.iterate(s.nodeAt(max(start, 0)), func(K) bool {
+		remain--
+		return remain >= 0
+	})
+}
+
+// 从 n 开始遍历, 直到 inRange 返回 false, inRange 为 nil 时遍历到末尾
+// 遍历期间修改 skiplist 的结果是未定义的
+func (s *Skiplist[K, V]) iterate(n *node[K, V], inRange func(key K) bool) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		for ; n != nil; n = n.next[0].node {
+			if inRange != nil && !inRange(n.key) {
+				return
+			}
+			if !yield(n.key, n.value) {
+				return
+			}
+		}
+	}
+}
+
+func (s *Skiplist[K, V]) nodeAt(index int) *node[K, V] {
+	if index < 0 || index >= s.size {
+		return nil
+	}
+	// 排名从 1 开始计算, head 为 0
+	target, rank := index+1, 0
+	h := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for next := h.next[i]; next.node != nil && rank+next.span <= target; next = h.next[i] {
+			rank += next.span
+			h = next.node
+		}
+		if rank == target {
+			return h
+		}
+	}
+	return nil
+}
+
+// 返回第 level 层中最后一个 < target 的节点
+func (s *Skiplist[K, V]) findLessThan(begin *node[K, V], level int, target K) *node[K, V] {
+	h := begin
+	for next := h.next[level].node; next != nil && s.cmp(next.key, target) < 0; next = h.next[level].node {
+		h = next
+	}
+	return h
+}
+
+// 返回第一个 >= target 的节点, 不存在时返回 nil
+func (s *Skiplist[K, V]) findGreaterOrEqual(target K) *node[K, V] {
+	h := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		h = s.findLessThan(h, i, target)
+	}
+	return h.next[0].node
+}
+
+func (s *Skiplist[K, V]) randomLevel() int {
+	level := 1
+	for level < maxLevel && s.seed.Float64() < p {
+		level++
+	}
+	return level
+}
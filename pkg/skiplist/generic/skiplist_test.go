@@ -0,0 +1,130 @@
+package generic
+
+import (
+	"cmp"
+	"iter"
+	"maps"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkiplist(t *testing.T) {
+	s := NewOrdered[string, int]()
+	assert.False(t, s.Set("b", 2))
+	assert.False(t, s.Set("a", 1))
+	assert.False(t, s.Set("c", 3))
+	assert.True(t, s.Set("b", 20))
+	assert.Equal(t, 3, s.Len())
+
+	v, ok := s.Get("b")
+	assert.True(t, ok)
+	assert.Equal(t, 20, v)
+	_, ok = s.Get("d")
+	assert.False(t, ok)
+
+	assert.Equal(t, []string{"a", "b", "c"}, slices.Collect(keys(s.All())))
+	assert.Equal(t, map[string]int{"a": 1, "b": 20}, maps.Collect(s.Range("", "c")))
+
+	rank, ok := s.Rank("c")
+	assert.True(t, ok)
+	assert.Equal(t, 2, rank)
+	_, ok = s.Rank("bb")
+	assert.False(t, ok)
+	k, v, ok := s.At(1)
+	assert.True(t, ok)
+	assert.Equal(t, "b", k)
+	assert.Equal(t, 20, v)
+	_, _, ok = s.At(3)
+	assert.False(t, ok)
+
+	assert.True(t, s.Delete("b"))
+	assert.False(t, s.Delete("b"))
+	assert.Equal(t, []string{"a", "c"}, slices.Collect(keys(s.All())))
+	rank, _ = s.Rank("c")
+	assert.Equal(t, 1, rank)
+
+	// 提前结束遍历
+	for k := range s.All() {
+		assert.Equal(t, "a", k)
+		break
+	}
+
+	// 自定义比较函数, 按长度再按字典序
+	byLen := New[string, struct{}](func(a, b string) int {
+		return cmp.Or(cmp.Compare(len(a), len(b)), strings.Compare(a, b))
+	})
+	for _, k := range []string{"ccc", "a", "bb", "b"} {
+		byLen.Set(k, struct{}{})
+	}
+	assert.Equal(t, []string{"a", "b", "bb", "ccc"}, slices.Collect(keys(byLen.All())))
+}
+
+func TestSkiplistRandom(t *testing.T) {
+	const N = 2000
+	s := NewOrdered[int, int]()
+	model := map[int]int{}
+
+	for i := range 20 * N {
+		k := rand.Intn(N)
+		if rand.Intn(3) == 0 {
+			_, exist := model[k]
+			assert.Equal(t, exist, s.Delete(k))
+			delete(model, k)
+		} else {
+			_, exist := model[k]
+			assert.Equal(t, exist, s.Set(k, i))
+			model[k] = i
+		}
+	}
+
+	sorted := slices.Sorted(maps.Keys(model))
+	assert.Equal(t, len(sorted), s.Len())
+	assert.Equal(t, sorted, slices.Collect(keys(s.All())))
+	for i, k := range sorted {
+		v, ok := s.Get(k)
+		assert.True(t, ok)
+		assert.Equal(t, model[k], v)
+
+		rank, ok := s.Rank(k)
+		assert.True(t, ok)
+		assert.Equal(t, i, rank)
+
+		atK, atV, ok := s.At(i)
+		assert.True(t, ok)
+		assert.Equal(t, k, atK)
+		assert.Equal(t, model[k], atV)
+	}
+
+	// [lower, upper) 与按排名的区间
+	lower, upper := N/4, N/2
+	var expected []int
+	for _, k := range sorted {
+		if k >= lower && k < upper {
+			expected = append(expected, k)
+		}
+	}
+	assert.Equal(t, expected, slices.Collect(keys(s.Range(lower, upper))))
+	assert.Equal(t, sorted[10:20], slices.Collect(keys(s.RangeByRank(10, 20))))
+	assert.Equal(t, sorted[len(sorted)-5:], slices.Collect(keys(s.RangeByRank(len(sorted)-5, len(sorted)+5))))
+	assert.Empty(t, slices.Collect(keys(s.RangeByRank(len(sorted), len(sorted)+5))))
+
+	for _, k := range sorted {
+		assert.True(t, s.Delete(k))
+	}
+	assert.Equal(t, 0, s.Len())
+	assert.Empty(t, slices.Collect(keys(s.All())))
+}
+
+func keys[K, V any](seq iter.Seq2[K, V]) iter.Seq[K] {
+	return func(yield func(K) bool) {
+		for k := range seq {
+			if !yield(k) {
+				return
+			}
+		}
+	}
+}
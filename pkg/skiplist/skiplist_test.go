@@ -1,10 +1,15 @@
 package skiplist
 
 import (
+	"bytes"
 	"cmp"
+	"fmt"
+	"lsm/pkg/arena"
 	"math"
 	"math/rand"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -103,3 +108,51 @@ func generate(N int) []int {
 	}
 	return data
 }
+
+func TestConcurrentSkiplist(t *testing.T) {
+	const N = 10_000
+	s := NewConcurrent(bytes.Compare, arena.New(4096))
+	key := func(i int) []byte {
+		return fmt.Appendf(nil, "%08d", i)
+	}
+
+	// 一个写入方按随机顺序插入, 多个读取方同时遍历
+	var inserted atomic.Int64
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for inserted.Load() < N {
+				// 遍历开始前已经插入的节点一定可以看到
+				published := int(inserted.Load())
+				n := 0
+				var prev []byte
+				it := s.Iterator()
+				for it.SeekToFirst(); it.Valid(); it.Next() {
+					assert.Less(t, string(prev), string(it.Key()))
+					prev = it.Key()
+					n++
+				}
+				assert.GreaterOrEqual(t, n, published)
+			}
+		}()
+	}
+
+	for _, i := range rand.Perm(N) {
+		s.Insert(key(i))
+		inserted.Add(1)
+	}
+	wg.Wait()
+
+	assert.Equal(t, N, s.Len())
+	for i := range N {
+		assert.True(t, s.Contains(key(i)))
+	}
+	assert.False(t, s.Contains(key(N)))
+
+	it := s.Iterator()
+	it.Seek(key(N / 2))
+	assert.True(t, it.Valid())
+	assert.Equal(t, key(N/2), it.Key())
+}
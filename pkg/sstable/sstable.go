@@ -3,9 +3,12 @@ package sstable
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"lsm/internal/block"
 	"lsm/internal/key"
-	"os"
+	"lsm/pkg/comparator"
+	"lsm/pkg/encryption"
+	"lsm/pkg/vfs"
 
 	"github.com/sirupsen/logrus"
 )
@@ -14,36 +17,71 @@ const (
 	// 4KB
 	maxDataBlockSize = 4 * 1024
 	magicNumber      = 0xdb4775248b80fb57
+	// 带有 range-del meta block 的 footer
+	rangeDelMagicNumber = 0xdb4775248b80fb58
+
+	maxFooterSize = 8 + 8 + 8
 )
 
+var ErrInvalidMagicNumber = errors.New("invalid magic number")
+
+// 没有 range tombstone 时使用旧格式: indexBlockHandler + magicNumber
+// 否则为: rangeDelBlockHandler + indexBlockHandler + rangeDelMagicNumber
+// 通过末尾的 magic number 区分, 旧文件仍然可以读取
 type Footer struct {
 	// TODO
 	// metaIndexBlockHandler block.BlockHandler
 	indexBlockHandler block.BlockHandler
+
+	hasRangeDel          bool
+	rangeDelBlockHandler block.BlockHandler
 }
 
 func (f Footer) Size() int {
+	if f.hasRangeDel {
+		return 8 + 8 + 8
+	}
 	// blockHandler + magicNumber
 	return 8 + 8
 }
 
 func (f *Footer) encodeTo() (data []byte) {
+	if f.hasRangeDel {
+		data = f.rangeDelBlockHandler.EncodeTo()
+		data = append(data, f.indexBlockHandler.EncodeTo()...)
+		return binary.LittleEndian.AppendUint64(data, rangeDelMagicNumber)
+	}
 	data = f.indexBlockHandler.EncodeTo()
 	data = binary.LittleEndian.AppendUint64(data, magicNumber)
 	return data
 }
 
-func (f *Footer) decodeFrom(data []byte) {
-	f.indexBlockHandler.DecodeFrom(data[:8])
-	magic := binary.LittleEndian.Uint64(data[8:])
-	if magic != magicNumber {
-		panic("invalid magic number")
+// data 为文件末尾的至多 maxFooterSize 字节
+func (f *Footer) decodeFrom(data []byte) error {
+	if len(data) < 16 {
+		return ErrInvalidMagicNumber
+	}
+	n := len(data)
+	switch binary.LittleEndian.Uint64(data[n-8:]) {
+	case magicNumber:
+	case rangeDelMagicNumber:
+		if n < 24 {
+			return ErrInvalidMagicNumber
+		}
+		f.hasRangeDel = true
+		f.rangeDelBlockHandler.DecodeFrom(data[n-24 : n-16])
+	default:
+		return ErrInvalidMagicNumber
 	}
+	f.indexBlockHandler.DecodeFrom(data[n-16 : n-8])
+	return nil
 }
 
 // TODO meta block，如 bloom filter
 type TableBuilder struct {
-	fd *os.File
+	fs       vfs.FS
+	filename string
+	fd       *encryption.File
 
 	fileSize uint64
 
@@ -60,20 +98,33 @@ type TableBuilder struct {
 	hasPendingIndexEntry bool
 	maxKey               []byte
 	pendingIndexEntry    block.BlockHandler
+
+	// range tombstone 不写入 data block, 而是单独保存在 range-del meta block 中
+	rangeDelBlockBuilder *block.BlockBuilder
 }
 
-func NewTableBuilder(filename string) (*TableBuilder, error) {
-	fd, err := os.Create(filename)
+// keys 不为 nil 时加密文件中的所有 block
+func NewTableBuilder(fs vfs.FS, filename string, keys encryption.KeyProvider) (*TableBuilder, error) {
+	fd, err := encryption.Create(fs, filename, keys)
 	if err != nil {
 		return nil, err
 	}
 	return &TableBuilder{
-		fd:                fd,
-		dataBlockBuilder:  block.NewBlockBuilder(),
-		indexBlockBuilder: block.NewBlockBuilder(),
+		fs:                   fs,
+		filename:             filename,
+		fd:                   fd,
+		dataBlockBuilder:     block.NewBlockBuilder(),
+		indexBlockBuilder:    block.NewBlockBuilder(),
+		rangeDelBlockBuilder: block.NewBlockBuilder(),
 	}, nil
 }
 
+// range tombstone 可以按任意顺序添加
+func (tb *TableBuilder) AddRangeTombstone(t key.RangeTombstone) {
+	ik := t.InternalKey()
+	tb.rangeDelBlockBuilder.Add(ik.EncodeTo(), nil)
+}
+
 func (tb *TableBuilder) Add(key, value []byte) error {
 	if tb.hasPendingIndexEntry {
 		tb.indexBlockBuilder.Add(tb.maxKey, tb.pendingIndexEntry.EncodeTo())
@@ -104,6 +155,17 @@ func (tb *TableBuilder) Finish() error {
 		tb.hasPendingIndexEntry = false
 	}
 
+	// range-del meta block
+	var footer Footer
+	if !tb.rangeDelBlockBuilder.Empty() {
+		bh, err := tb.writeBlock(tb.rangeDelBlockBuilder)
+		if err != nil {
+			return err
+		}
+		footer.hasRangeDel = true
+		footer.rangeDelBlockHandler = bh
+	}
+
 	// index block
 	bh, err := tb.writeBlock(tb.indexBlockBuilder)
 	if err != nil {
@@ -111,9 +173,7 @@ func (tb *TableBuilder) Finish() error {
 	}
 
 	// write footer
-	footer := Footer{
-		indexBlockHandler: bh,
-	}
+	footer.indexBlockHandler = bh
 	footerData := footer.encodeTo()
 	_, err = tb.fd.Write(footerData)
 	tb.fileSize += uint64(footer.Size())
@@ -128,6 +188,16 @@ func (tb *TableBuilder) Finish() error {
 	return tb.fd.Close()
 }
 
+// 放弃构建: 关闭文件并删除已写入的部分内容
+// 用于 Add 或 Finish 失败后的清理, 错误只记录日志
+func (tb *TableBuilder) Abandon() {
+	// Finish 失败时文件可能已经关闭, 忽略重复关闭的错误
+	tb.fd.Close()
+	if err := tb.fs.Remove(tb.filename); err != nil {
+		logrus.Warnf("remove abandoned table %s: %v", tb.filename, err)
+	}
+}
+
 func (tb *TableBuilder) flush() error {
 	if tb.dataBlockBuilder.Empty() {
 		return nil
@@ -168,42 +238,86 @@ func (tb *TableBuilder) FileSize() uint64 {
 }
 
 type SSTable struct {
-	fd    *os.File
-	index *block.Block
+	fd     *encryption.File
+	index  *block.Block
+	footer Footer
+	// 按 user key 的 Comparator 比较 InternalKey
+	cmp func(a, b []byte) int
 }
 
-func Open(filename string) (*SSTable, error) {
-	fd, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
-
-	info, err := fd.Stat()
+// 加密的文件需要 keys 提供对应的密钥, 密钥错误时返回 encryption.ErrKeyMismatch
+// ucmp 需与写入时记录的顺序一致, 为 nil 时使用 comparator.Bytewise
+func Open(fs vfs.FS, filename string, keys encryption.KeyProvider, ucmp comparator.Comparator) (*SSTable, error) {
+	fd, err := encryption.Open(fs, filename, keys)
 	if err != nil {
 		return nil, err
 	}
 
 	// read footer
 	var footer Footer
-	footerData := make([]byte, footer.Size())
-	if _, err := fd.ReadAt(footerData, info.Size()-int64(footer.Size())); err != nil {
+	footerData := make([]byte, min(fd.Size(), maxFooterSize))
+	if _, err := fd.ReadAt(footerData, fd.Size()-int64(len(footerData))); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if err := footer.decodeFrom(footerData); err != nil {
+		fd.Close()
 		return nil, err
 	}
-	footer.decodeFrom(footerData)
 
 	// load index block from footer
 	index, err := block.NewBlock(fd, footer.indexBlockHandler)
 	if err != nil {
+		fd.Close()
 		return nil, err
 	}
 
 	return &SSTable{
-		fd:    fd,
-		index: index,
+		fd:     fd,
+		index:  index,
+		footer: footer,
+		cmp:    key.InternalKeyComparer(comparator.OrDefault(ucmp).Compare),
 	}, nil
 }
 
+// 读取 range-del meta block 中的所有 range tombstone
+func (s *SSTable) RangeTombstones() (key.RangeTombstones, error) {
+	if !s.footer.hasRangeDel {
+		return nil, nil
+	}
+	b, err := block.NewBlock(s.fd, s.footer.rangeDelBlockHandler)
+	if err != nil {
+		return nil, err
+	}
+
+	tombstones := make(key.RangeTombstones, 0, b.Size())
+	for iter := b.NewIterator(s.cmp); iter.Valid(); iter.Next() {
+		var ik key.InternalKey
+		ik.DecodeFrom(iter.Key())
+		tombstones = append(tombstones, key.RangeTombstoneFrom(&ik))
+	}
+	return tombstones, nil
+}
+
 func (s *SSTable) Get(lookupKey key.InternalKey) ([]byte, bool) {
+	internalKey, ok := s.Find(lookupKey)
+	if !ok {
+		return nil, false
+	}
+	// TODO 引入 snapshot 后考虑是否可见
+
+	if internalKey.Type == key.KTypeDeletion {
+		return nil, false
+	}
+
+	// userKey 和 userValue 会合并为 internalKey
+	// 作为 data block 的 key,对应的 value 为 nil
+	return internalKey.UserValue, true
+}
+
+// 返回 lookupKey.UserKey 在 seq <= lookupKey.Seq 下的最新记录,包括删除记录
+// 调用方可据此区分 "不存在" 与 "已删除"
+func (s *SSTable) Find(lookupKey key.InternalKey) (*key.InternalKey, bool) {
 	iter := s.NewIterator()
 	iter.Seek(lookupKey.EncodeTo())
 	if !iter.Valid() {
@@ -217,15 +331,11 @@ func (s *SSTable) Get(lookupKey key.InternalKey) ([]byte, bool) {
 	if !bytes.Equal(internalKey.UserKey, lookupKey.UserKey) {
 		return nil, false
 	}
-	// TODO 引入 snapshot 后考虑是否可见
-
-	if internalKey.Type == key.KTypeDeletion {
-		return nil, false
-	}
+	return &internalKey, true
+}
 
-	// userKey 和 userValue 会合并为 internalKey
-	// 作为 data block 的 key,对应的 value 为 nil
-	return internalKey.UserValue, true
+func (s *SSTable) Close() error {
+	return s.fd.Close()
 }
 
 type SSTableIterator struct {
@@ -238,16 +348,22 @@ type SSTableIterator struct {
 func (s *SSTable) NewIterator() *SSTableIterator {
 	iter := &SSTableIterator{
 		sst:            s,
-		indexBlockIter: s.index.NewIterator(),
+		indexBlockIter: s.index.NewIterator(s.cmp),
 	}
+	iter.SeekToFirst()
+	return iter
+}
+
+// 定位到第一条记录
+func (si *SSTableIterator) SeekToFirst() {
+	si.dataBlockIter = nil
+	si.indexBlockIter.Rewind()
 	// load first data block
-	if iter.indexBlockIter.Valid() {
-		if err := iter.loadDataBlockFromIndex(); err != nil {
+	if si.indexBlockIter.Valid() {
+		if err := si.loadDataBlockFromIndex(); err != nil {
 			panic(err)
 		}
 	}
-
-	return iter
 }
 
 // seek to the first position where the key >= target
@@ -306,6 +422,6 @@ func (si *SSTableIterator) loadDataBlockFromIndex() error {
 	if err != nil {
 		return err
 	}
-	si.dataBlockIter = dataBlock.NewIterator()
+	si.dataBlockIter = dataBlock.NewIterator(si.sst.cmp)
 	return nil
 }
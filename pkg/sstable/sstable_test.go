@@ -6,6 +6,7 @@ import (
 	"io"
 	"lsm/internal/block"
 	"lsm/internal/key"
+	"lsm/pkg/vfs"
 	"math"
 	"math/rand/v2"
 	"os"
@@ -41,7 +42,7 @@ func TestFooterEncode(t *testing.T) {
 
 func TestFooterDecode(t *testing.T) {
 	f := Footer{}
-	f.decodeFrom([]byte{
+	err := f.decodeFrom([]byte{
 		// offset
 		0x78, 0x56, 0x34, 0x12,
 		// size
@@ -49,12 +50,13 @@ func TestFooterDecode(t *testing.T) {
 		// magic number
 		0x57, 0xfb, 0x80, 0x8b, 0x24, 0x75, 0x47, 0xdb,
 	})
+	assert.Nil(t, err)
 	assert.Equal(t, uint32(0x12345678), f.indexBlockHandler.Offset)
 	assert.Equal(t, uint32(0x78563412), f.indexBlockHandler.Size)
 }
 
 func TestSSTableBasic(t *testing.T) {
-	tb, err := NewTableBuilder("TestSSTableBasic.sst")
+	tb, err := NewTableBuilder(vfs.Default, "TestSSTableBasic.sst", nil)
 	assert.Nil(t, err)
 	defer os.Remove("TestSSTableBasic.sst")
 
@@ -139,7 +141,7 @@ func TestSSTableBasic(t *testing.T) {
 }
 
 func TestSSTableMultipleDataBlock(t *testing.T) {
-	tb, err := NewTableBuilder("TestSSTableMultipleDataBlock.sst")
+	tb, err := NewTableBuilder(vfs.Default, "TestSSTableMultipleDataBlock.sst", nil)
 	assert.Nil(t, err)
 	defer os.Remove("TestSSTableMultipleDataBlock.sst")
 
@@ -155,14 +157,14 @@ func TestSSTableMultipleDataBlock(t *testing.T) {
 	}
 	tb.Finish()
 
-	sstable, err := Open("TestSSTableMultipleDataBlock.sst")
+	sstable, err := Open(vfs.Default, "TestSSTableMultipleDataBlock.sst", nil, nil)
 	assert.Nil(t, err)
 
 	assert.Equal(t, 782, sstable.index.Size())
 }
 
 func TestSSTableGet(t *testing.T) {
-	tb, err := NewTableBuilder("TestSSTableGet.sst")
+	tb, err := NewTableBuilder(vfs.Default, "TestSSTableGet.sst", nil)
 	assert.Nil(t, err)
 	defer os.Remove("TestSSTableGet.sst")
 
@@ -179,20 +181,22 @@ func TestSSTableGet(t *testing.T) {
 	for i := range keyN {
 		userKey := fmt.Appendf(nil, userKeyFormat, i)
 		userValue := fmt.Appendf(nil, userValueFormat, i)
-		keyForInsert := key.New(userKey, userValue, uint64(i), key.KTypeValue)
-		err := tb.Add(keyForInsert.EncodeTo(), nil)
-		assert.Nil(t, err)
 
 		// 如果对同一个 key 的插入和删除使用同一个 seq,是否可见?
+		// userKey 相同时按 seq 降序排列,删除记录需要先写入
 		if _, ok := deleteMap[i]; ok {
 			keyForDelete := key.New(userKey, nil, uint64(i+1), key.KTypeDeletion)
 			err := tb.Add(keyForDelete.EncodeTo(), nil)
 			assert.Nil(t, err)
 		}
+
+		keyForInsert := key.New(userKey, userValue, uint64(i), key.KTypeValue)
+		err := tb.Add(keyForInsert.EncodeTo(), nil)
+		assert.Nil(t, err)
 	}
 	tb.Finish()
 
-	st, err := Open("TestSSTableGet.sst")
+	st, err := Open(vfs.Default, "TestSSTableGet.sst", nil, nil)
 	assert.Nil(t, err)
 
 	iter := st.NewIterator()
@@ -223,3 +227,36 @@ func TestSSTableGet(t *testing.T) {
 		}
 	}
 }
+
+func TestSSTableRangeTombstone(t *testing.T) {
+	const filename = "TestSSTableRangeTombstone.sst"
+	tb, err := NewTableBuilder(vfs.Default, filename, nil)
+	assert.Nil(t, err)
+	defer os.Remove(filename)
+
+	for i := range 10 {
+		ik := key.New(fmt.Appendf(nil, "key-%02d", i), fmt.Appendf(nil, "value-%02d", i), uint64(i), key.KTypeValue)
+		assert.Nil(t, tb.Add(ik.EncodeTo(), nil))
+	}
+	expected := key.RangeTombstones{
+		{Start: []byte("key-02"), End: []byte("key-05"), Seq: 10},
+		{Start: []byte("key-04"), End: []byte("key-08"), Seq: 11},
+	}
+	for _, ts := range expected {
+		tb.AddRangeTombstone(ts)
+	}
+	assert.Nil(t, tb.Finish())
+
+	st, err := Open(vfs.Default, filename, nil, nil)
+	assert.Nil(t, err)
+	assert.True(t, st.footer.hasRangeDel)
+
+	actual, err := st.RangeTombstones()
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+
+	// 点查不受 range tombstone 影响, 由上层判断是否被删除
+	value, ok := st.Get(key.NewLookupKey([]byte("key-03"), math.MaxUint64))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value-03"), value)
+}
@@ -1,25 +1,58 @@
 package version
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
-	"lsm/internal/key"
 	"lsm/internal/util"
-	"lsm/pkg/sstable"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
 
 // compact sstable file inputs[0] at level with inputs[1] at level+1
-type compaction struct {
-	level  int
-	inputs [2][]*FileMetaData
+// 合并结果写入 outputLevel, leveled compaction 中 outputLevel 总是 level+1
+type Compaction struct {
+	level       int
+	outputLevel int
+	inputs      [2][]*FileMetaData
+
+	// 只删除 inputs, 不产生输出文件, 用于 FIFO compaction
+	deletionCompaction bool
+
+	// 输出之下不存在与本次 compaction 重叠的更旧数据, 由 Version.PickCompaction 设置
+	bottommost bool
+
+	// 选中时仍存活的 snapshot, 升序排列
+	snapshots []uint64
+
+	// 开始执行的时刻(unix 纳秒), 在此之前过期的 value 按删除记录处理
+	now int64
+}
+
+func NewCompaction(level, outputLevel int, inputs [2][]*FileMetaData) *Compaction {
+	return &Compaction{
+		level:       level,
+		outputLevel: outputLevel,
+		inputs:      inputs,
+	}
 }
 
-func (c *compaction) String() string {
+// 删除 level 中的 inputs, 不读取也不产生任何文件
+func NewDeletionCompaction(level int, inputs []*FileMetaData) *Compaction {
+	return &Compaction{
+		level:              level,
+		outputLevel:        level,
+		inputs:             [2][]*FileMetaData{inputs, nil},
+		deletionCompaction: true,
+	}
+}
+
+func (c *Compaction) String() string {
 	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("compaction,level:%d\n", c.level))
+	sb.WriteString(fmt.Sprintf("compaction,level:%d,outputLevel:%d,deletion:%t\n", c.level, c.outputLevel, c.deletionCompaction))
 
 	sb.WriteString("inputs[0]:")
 	for _, f := range c.inputs[0] {
@@ -35,12 +68,68 @@ func (c *compaction) String() string {
 	return sb.String()
 }
 
-func (c *compaction) isTrivialMove() bool {
-	return len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0
+// 设置 compaction 需要保护的 snapshot, 需在 RunCompaction 之前调用
+func (c *Compaction) SetSnapshots(snapshots []uint64) {
+	c.snapshots = slices.Sorted(slices.Values(snapshots))
+}
+
+// 返回 seq 所在的段, 即第一个能看到 seq 的 snapshot 的下标
+// seq 大于所有 snapshot 时返回 len(c.snapshots), 没有 snapshot 时所有记录都在同一段
+func (c *Compaction) snapshotStripe(seq uint64) int {
+	return sort.Search(len(c.snapshots), func(i int) bool {
+		return c.snapshots[i] >= seq
+	})
+}
+
+func (c *Compaction) isTrivialMove() bool {
+	return c.outputLevel != c.level && len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0
+}
+
+func (c *Compaction) markBeingCompacted(beingCompacted bool) {
+	for _, files := range c.inputs {
+		for _, f := range files {
+			f.beingCompacted = beingCompacted
+		}
+	}
+}
+
+// compaction 结束(无论成功与否)后调用, 其输入文件可以再次被选中
+func (c *Compaction) Release() {
+	c.markBeingCompacted(false)
+}
+
+func anyBeingCompacted(files []*FileMetaData) bool {
+	for _, f := range files {
+		if f.beingCompacted {
+			return true
+		}
+	}
+	return false
+}
+
+// CompactionPicker 决定下一次 compaction 的输入文件和输出 level
+// 返回 nil 表示当前 version 不需要 compaction
+//
+// 多个 compaction 可以并发执行, picker 不能选择 beingCompacted 的文件,
+// 也不能选择会与正在进行的 compaction 产生重叠输出的文件
+type CompactionPicker interface {
+	PickCompaction(v *Version) *Compaction
+}
+
+// 默认的 leveled compaction, 参考 leveldb
+type LeveledCompactionPicker struct{}
+
+func NewLeveledCompactionPicker() *LeveledCompactionPicker {
+	return &LeveledCompactionPicker{}
+}
+
+func (p *LeveledCompactionPicker) PickCompaction(v *Version) *Compaction {
+	return v.pickLeveledCompaction()
 }
 
 // copy from leveldb/db/version_set.cc VersionSet::Finalize()
-func (v *Version) pickCompactionLevel() int {
+// 返回所有需要 compaction 的 level, 按 score 从高到低排列
+func (v *Version) pickCompactionLevels() []int {
 	// We treat level-0 specially by bounding the number of files
 	// instead of number of bytes for two reasons:
 	//
@@ -52,32 +141,42 @@ func (v *Version) pickCompactionLevel() int {
 	// file size is small (perhaps because of a small write-buffer
 	// setting, or very high compression ratios, or lots of
 	// overwrites/deletions).
-	compactionLevel := -1
-	bestScore := 1.0
-	score := 0.0
-	for level := range DefaultLevels {
+	var (
+		levels []int
+		scores [DefaultLevels]float64
+	)
+	// 最后一层没有下一层可以合并
+	for level := range DefaultLevels - 1 {
 		if level == 0 {
-			score = float64(len(v.files[0])) / float64(L0_CompactionTrigger)
+			scores[level] = float64(len(v.files[0])) / float64(L0_CompactionTrigger)
 		} else {
-			score = float64(totalFileSize(v.files[level])) / maxBytesForLevel(level)
+			scores[level] = float64(totalFileSize(v.files[level])) / maxBytesForLevel(level)
 		}
 
-		if score > bestScore {
-			bestScore = score
-			compactionLevel = level
+		if scores[level] > 1.0 {
+			levels = append(levels, level)
 		}
-
 	}
-	return compactionLevel
+	sort.SliceStable(levels, func(i, j int) bool {
+		return scores[levels[i]] > scores[levels[j]]
+	})
+	return levels
 }
 
-func (v *Version) pickCompaction() *compaction {
-	level := v.pickCompactionLevel()
-	if level < 0 {
-		return nil
+// 当 score 最高的 level 与正在进行的 compaction 冲突时, 尝试下一个 level
+func (v *Version) pickLeveledCompaction() *Compaction {
+	for _, level := range v.pickCompactionLevels() {
+		if c := v.pickLeveledCompactionAt(level); c != nil {
+			return c
+		}
 	}
-	c := &compaction{
-		level: level,
+	return nil
+}
+
+func (v *Version) pickLeveledCompactionAt(level int) *Compaction {
+	c := &Compaction{
+		level:       level,
+		outputLevel: level + 1,
 	}
 
 	// set inputs[0]
@@ -86,26 +185,39 @@ func (v *Version) pickCompaction() *compaction {
 	// files in level 0 is not sorted globally
 	// so pick up all
 	if level == 0 {
+		// level 0 的文件互相重叠, 同一时刻只能有一个 level 0 compaction
+		if anyBeingCompacted(v.files[0]) {
+			return nil
+		}
 		c.inputs[0] = append(c.inputs[0], v.files[0]...)
 		for _, f := range c.inputs[0] {
-			if smallest == nil || key.InternalKeyCompareFunc(f.smallest.EncodeTo(), smallest) < 0 {
+			if smallest == nil || v.icmp(f.smallest.EncodeTo(), smallest) < 0 {
 				smallest = f.smallest.EncodeTo()
 			}
-			if largest == nil || key.InternalKeyCompareFunc(f.largest.EncodeTo(), largest) > 0 {
+			if largest == nil || v.icmp(f.largest.EncodeTo(), largest) > 0 {
 				largest = f.largest.EncodeTo()
 			}
 		}
 	} else {
 		// files in other level is sorted globally
 		// pick the first file that comes after compactPointer
-		for i := range v.files[level] {
-			if v.compactPointer[level] == nil || key.InternalKeyCompareFunc(v.files[level][i].largest.EncodeTo(), v.compactPointer[level]) > 0 {
-				c.inputs[0] = append(c.inputs[0], v.files[level][i])
+		// and is not being compacted
+		files := v.files[level]
+		start := 0
+		for i := range files {
+			if v.compactPointer[level] == nil || v.icmp(files[i].largest.EncodeTo(), v.compactPointer[level]) > 0 {
+				start = i
+				break
+			}
+		}
+		for i := range files {
+			if f := files[(start+i)%len(files)]; !f.beingCompacted {
+				c.inputs[0] = append(c.inputs[0], f)
 				break
 			}
 		}
 		if len(c.inputs[0]) == 0 {
-			c.inputs[0] = append(c.inputs[0], v.files[level][0])
+			return nil
 		}
 		smallest = c.inputs[0][0].smallest.EncodeTo()
 		largest = c.inputs[0][0].largest.EncodeTo()
@@ -113,114 +225,144 @@ func (v *Version) pickCompaction() *compaction {
 
 	// set inputs[1]
 	for _, f := range v.files[level+1] {
-		if key.InternalKeyCompareFunc(f.largest.EncodeTo(), smallest) < 0 || key.InternalKeyCompareFunc(f.smallest.EncodeTo(), largest) > 0 {
+		if v.icmp(f.largest.EncodeTo(), smallest) < 0 || v.icmp(f.smallest.EncodeTo(), largest) > 0 {
 			// not overlap at all
 		} else {
 			c.inputs[1] = append(c.inputs[1], f)
 		}
 	}
+	// level+1 中重叠的文件正在被其它 compaction 使用
+	if anyBeingCompacted(c.inputs[1]) {
+		return nil
+	}
 
+	if level > 0 {
+		// 下次从该文件之后开始
+		v.compactPointer[level] = largest
+	}
 	return c
 }
 
 // 返回 inputs 经过合并后的结果
-// 合并后的数据会被写入到 level+1 中
+// 合并后的数据会被写入到 outputLevel 中
 // 同时 inputs 中的文件会被删除
-func (v *Version) getCompactOutput(c *compaction) ([]*FileMetaData, error) {
-	// just move file from c.level to c.level+1
+func (v *Version) getCompactOutput(c *Compaction) ([]*FileMetaData, error) {
+	// just move file from c.level to c.outputLevel
 	if c.isTrivialMove() {
 		return c.inputs[0], nil
 	}
 
-	iters := make([]*sstable.SSTableIterator, 0, len(c.inputs[0])+len(c.inputs[1]))
-	for _, f := range c.inputs[0] {
-		st, err := f.Load()
-		if err != nil {
-			return nil, err
-		}
-		iters = append(iters, st.NewIterator())
+	if c.deletionCompaction {
+		return nil, nil
 	}
 
-	for _, f := range c.inputs[1] {
-		st, err := f.Load()
-		if err != nil {
-			return nil, err
-		}
-		iters = append(iters, st.NewIterator())
+	c.now = v.now().UnixNano()
+	ranges := v.subcompactionRanges(c)
+	if len(ranges) == 1 {
+		return v.runSubcompaction(c, ranges[0])
 	}
 
-	mi := NewMergeIterator(iters)
+	// 每个 subcompaction 在独立的 goroutine 中执行, 拥有各自的迭代器与 TableBuilder
+	// 各个 range 互不重叠且有序, 按顺序拼接即为整体的输出
+	logrus.Debugf("split compaction into %d subcompactions", len(ranges))
+	outputs := make([][]*FileMetaData, len(ranges))
+	errs := make([]error, len(ranges))
+	var wg sync.WaitGroup
+	for i, r := range ranges {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outputs[i], errs[i] = v.runSubcompaction(c, r)
+		}()
+	}
+	wg.Wait()
 
-	var (
-		currentKey *key.InternalKey = nil
-		metas                       = make([]*FileMetaData, 0)
-	)
-	for ; mi.Valid(); mi.Next() {
-		meta := &FileMetaData{
-			allowSeeks: 1 << 30,
-			number:     v.nextFileNumber,
-			smallest:   new(key.InternalKey),
-			largest:    new(key.InternalKey),
+	if err := errors.Join(errs...); err != nil {
+		// 失败的 subcompaction 已自行清理, 这里删除其余 subcompaction 的输出
+		for _, output := range outputs {
+			v.removeOutputs(output)
 		}
-		v.nextFileNumber++
-		meta.smallest.DecodeFrom(mi.Key())
+		return nil, err
+	}
+	metas := make([]*FileMetaData, 0)
+	for _, output := range outputs {
+		metas = append(metas, output...)
+	}
+	return metas, nil
+}
 
-		builder, err := sstable.NewTableBuilder(util.SstableFileName(v.dbName, meta.number))
-		if err != nil {
-			return nil, err
+// 删除未加入 version 的输出文件, 用于 compaction 失败后的清理
+func (v *Version) removeOutputs(metas []*FileMetaData) {
+	for _, meta := range metas {
+		name := util.SstableFileName(v.dbName, meta.number)
+		if err := v.option.FS.Remove(name); err != nil {
+			logrus.Warnf("remove compaction output %s: %v", name, err)
 		}
+	}
+}
 
-		for ; mi.Valid(); mi.Next() {
-			var nextKey key.InternalKey
-			nextKey.DecodeFrom(mi.Key())
-			if currentKey != nil {
-				compareResult := bytes.Compare(currentKey.UserKey, nextKey.UserKey)
-				if compareResult == 0 {
-					// 重复的记录
-					// 注意 记录是按照 userKey 升序,seq 降序排列的
-					// userKey 相同时，第一条记录是最新的,只需要保留最新的记录
-					// TODO 考虑 snapshot,则此处应该保留所有 >= snapshot.seq 的记录
-					continue
-				} else if compareResult < 0 {
-					logrus.Fatalf("%s < %s", string(currentKey.UserKey), string(nextKey.UserKey))
-				}
-				currentKey = &nextKey
-			} else {
-				currentKey = &nextKey
-			}
-			meta.largest.DecodeFrom(mi.Key())
-			builder.Add(mi.Key(), nil)
+// 选出下一个 compaction, 并将其输入文件标记为 beingCompacted
+// 调用方需保证 PickCompaction 与 Release 不会并发调用, 如持有 db 的锁
+func (v *Version) PickCompaction() *Compaction {
+	c := v.option.CompactionPicker.PickCompaction(v)
+	if c == nil {
+		return nil
+	}
+	c.markBeingCompacted(true)
+	c.bottommost = v.isBottommost(c)
+	return c
+}
 
-			// 这里的 FileSize 只是估计值, 实际值更大
-			if builder.FileSize() > v.maxFileSize {
-				break
+// 输出之下(更旧的位置)是否不存在与 c 的输入重叠的文件
+func (v *Version) isBottommost(c *Compaction) bool {
+	ucmp := v.option.Comparator.Compare
+	var smallest, largest []byte
+	for _, files := range c.inputs {
+		for _, f := range files {
+			if smallest == nil || ucmp(f.smallest.UserKey, smallest) < 0 {
+				smallest = f.smallest.UserKey
+			}
+			if largest == nil || ucmp(f.largest.UserKey, largest) > 0 {
+				largest = f.largest.UserKey
 			}
 		}
-		if err := builder.Finish(); err != nil {
-			return nil, err
-		}
-		// 这里的 FileSize 是准确值
-		meta.fileSize = builder.FileSize()
-		metas = append(metas, meta)
+	}
+	if smallest == nil {
+		return false
 	}
 
-	return metas, nil
-}
-
-// major compact
-func (v *Version) Compact() bool {
-	c := v.pickCompaction()
-	if c == nil {
+	// 输出到 level 0 时, level 0 中比输入更旧的文件也在输出之下
+	if c.outputLevel == 0 && (len(v.files[0]) == 0 || len(c.inputs[0]) == 0 || v.files[0][0] != c.inputs[0][0]) {
 		return false
 	}
+	for level := c.outputLevel + 1; level < DefaultLevels; level++ {
+		for _, f := range v.files[level] {
+			if ucmp(f.largest.UserKey, smallest) >= 0 && ucmp(f.smallest.UserKey, largest) <= 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
 
+// 执行 compaction, 返回输出文件, 不修改 version
+// 可以在不持有锁的情况下执行, 期间 version 可能已被替换
+func (v *Version) RunCompaction(c *Compaction) ([]*FileMetaData, error) {
 	logrus.Debugf("compact begin")
 	logrus.Debug(c.String())
+	return v.getCompactOutput(c)
+}
 
-	compactOutput, err := v.getCompactOutput(c)
-	if err != nil {
-		logrus.Errorf("getCompactOutput failed, err:%v", err)
-		return false
+// 从 version 中删除 c 的输入文件, 并加入 outputs
+// v 可以是 RunCompaction 所用 version 之后的新版本
+func (v *Version) ApplyCompaction(c *Compaction, outputs []*FileMetaData) {
+	// level 0 的文件按新旧排列, 输出需要放在原先输入的位置,
+	// 否则会被视为比 compaction 期间新 flush 的文件更新
+	pos := -1
+	if c.outputLevel == 0 && len(c.inputs[0]) > 0 {
+		pos = slices.IndexFunc(v.files[0], func(f *FileMetaData) bool {
+			return f.number == c.inputs[0][0].number
+		})
 	}
 
 	for _, f := range c.inputs[0] {
@@ -228,12 +370,32 @@ func (v *Version) Compact() bool {
 	}
 
 	for _, f := range c.inputs[1] {
-		v.deleteFile(c.level+1, f)
+		v.deleteFile(c.outputLevel, f)
+	}
+
+	if pos >= 0 {
+		v.files[0] = slices.Insert(v.files[0], pos, outputs...)
+		return
+	}
+	for _, f := range outputs {
+		v.addFile(c.outputLevel, f)
+	}
+}
+
+// major compact
+func (v *Version) Compact() bool {
+	c := v.PickCompaction()
+	if c == nil {
+		return false
 	}
+	defer c.Release()
 
-	for _, f := range compactOutput {
-		v.addFile(c.level+1, f)
+	compactOutput, err := v.RunCompaction(c)
+	if err != nil {
+		logrus.Errorf("getCompactOutput failed, err:%v", err)
+		return false
 	}
 
+	v.ApplyCompaction(c, compactOutput)
 	return true
 }
@@ -0,0 +1,38 @@
+package version
+
+type CompactionFilterDecision int
+
+const (
+	// 保留该记录
+	CompactionFilterKeep CompactionFilterDecision = iota
+	// 删除该记录
+	CompactionFilterRemove
+	// 用返回的 newValue 替换原来的 value
+	CompactionFilterChangeValue
+)
+
+type CompactionFilterContext struct {
+	// 正在 compaction 的 level
+	Level int
+	// 输出之下不存在与本次 compaction 重叠的更旧数据
+	Bottommost bool
+}
+
+// CompactionFilter 在 compaction 时按业务逻辑删除或改写记录,
+// 如清理过期的会话或已注销租户的数据
+//
+// 只对每个 userKey 最新的、且不被任何 snapshot 可见的 value 调用,
+// 删除记录以及为 snapshot 保留的旧版本不会经过 filter.
+// 与 rocksdb 相同, compaction 开始之后创建的 snapshot 不受保护
+//
+// 多个 compaction 会并发调用 Filter, 实现需要保证并发安全
+type CompactionFilter interface {
+	Filter(ctx CompactionFilterContext, userKey, value []byte) (decision CompactionFilterDecision, newValue []byte)
+}
+
+// 适配普通函数
+type CompactionFilterFunc func(ctx CompactionFilterContext, userKey, value []byte) (CompactionFilterDecision, []byte)
+
+func (f CompactionFilterFunc) Filter(ctx CompactionFilterContext, userKey, value []byte) (CompactionFilterDecision, []byte) {
+	return f(ctx, userKey, value)
+}
@@ -0,0 +1,66 @@
+package version
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type FIFOOption struct {
+	// level 0 文件总大小上限, 超出后从最旧的文件开始删除, 0 表示不限制
+	MaxTableFilesSize uint64
+
+	// 文件创建后的存活时间, 超出后删除, 0 表示不过期
+	TTL time.Duration
+}
+
+// FIFOCompactionPicker 实现 FIFO compaction
+//
+// 所有文件都保存在 level 0,不做任何合并,
+// 只按照文件编号(即 files[0] 中的顺序)从旧到新删除整个文件.
+// 适用于只关心最近数据的场景,如监控指标的缓存
+// 文件的创建时间与过期判断都使用 Version 的 Option.Clock
+type FIFOCompactionPicker struct {
+	option FIFOOption
+}
+
+func NewFIFOCompactionPicker(option FIFOOption) *FIFOCompactionPicker {
+	return &FIFOCompactionPicker{
+		option: option,
+	}
+}
+
+func (p *FIFOCompactionPicker) PickCompaction(v *Version) *Compaction {
+	files := v.files[0]
+	expired := 0
+
+	// 上一次淘汰尚未完成
+	if anyBeingCompacted(files) {
+		return nil
+	}
+
+	// files[0] 按文件编号递增,即按创建时间从旧到新排列
+	if p.option.TTL > 0 {
+		now := v.now()
+		for expired < len(files) && now.Sub(files[expired].CreatedAt()) > p.option.TTL {
+			expired++
+		}
+	}
+
+	if p.option.MaxTableFilesSize > 0 {
+		total := totalFileSize(files[expired:])
+		for expired < len(files) && total > p.option.MaxTableFilesSize {
+			total -= files[expired].fileSize
+			expired++
+		}
+	}
+
+	if expired == 0 {
+		return nil
+	}
+
+	logrus.Debugf("fifo compaction: drop %d files", expired)
+	inputs := make([]*FileMetaData, expired)
+	copy(inputs, files[:expired])
+	return NewDeletionCompaction(0, inputs)
+}
@@ -0,0 +1,138 @@
+package version
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"lsm/internal/util"
+	"lsm/pkg/encryption"
+	"lsm/pkg/vfs"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrNoFamily = errors.New("manifest contains no column family")
+	// 打开时使用的 Comparator 与创建 column family 时的名字不同, 已有文件的顺序不再有效
+	ErrComparatorMismatch = errors.New("comparator does not match the one recorded in manifest")
+)
+
+// Family 是 manifest 中记录的一个 column family
+// 各个 column family 拥有独立的 level, 但共享文件编号与 seq
+type Family struct {
+	ID      uint32
+	Name    string
+	Version *Version
+}
+
+// 将所有 column family 的文件与 Comparator 名字写入新的 manifest, 返回其文件编号
+// families 中的 version 需共享计数器, 见 Version.NewSibling
+// manifest 写入第一个 family 的 Option.FS, 其 Option.KeyProvider 不为 nil 时 manifest 会被加密
+// 任意一次写入失败时删除未完成的 manifest 并返回错误, 调用方不应更新 CURRENT
+func SaveManifest(dbName string, families []Family) (uint64, error) {
+	if len(families) == 0 {
+		return 0, ErrNoFamily
+	}
+	counter := families[0].Version.counter
+	number := families[0].Version.newFileNumber()
+	option := families[0].Version.option
+	name := util.ManifestFileName(dbName, number)
+	file, err := encryption.Create(option.FS, name, option.KeyProvider)
+	if err != nil {
+		return number, err
+	}
+	if err := writeManifest(file, counter, families); err != nil {
+		file.Close()
+		// 不完整的 manifest 没有被 CURRENT 引用, 删除失败时只是留下一个无用的文件
+		if err := option.FS.Remove(name); err != nil {
+			logrus.Warnf("remove manifest %s error:%v", name, err)
+		}
+		return number, err
+	}
+	return number, file.Close()
+}
+
+func writeManifest(file *encryption.File, counter *counter, families []Family) error {
+	for _, v := range []any{counter.nextFileNumber.Load(), counter.seq.Load(), uint32(len(families))} {
+		if err := binary.Write(file, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	for _, f := range families {
+		if err := binary.Write(file, binary.LittleEndian, f.ID); err != nil {
+			return err
+		}
+		if _, err := file.Write(util.LenPrefixSlice([]byte(f.Name))); err != nil {
+			return err
+		}
+		if _, err := file.Write(util.LenPrefixSlice([]byte(f.Version.option.Comparator.Name()))); err != nil {
+			return err
+		}
+		if err := f.Version.encodeFiles(file); err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
+
+// 从 manifest 中恢复所有 column family, option 返回每个 column family 的选项
+// manifest 被加密时需要 keys 提供对应的密钥, 密钥错误时返回 encryption.ErrKeyMismatch
+// option 中的 Comparator 与 manifest 记录的名字不同时返回 ErrComparatorMismatch
+func LoadManifest(fs vfs.FS, dbName string, number uint64, keys encryption.KeyProvider, option func(name string) Option) ([]Family, error) {
+	f, err := encryption.Open(vfs.OrDefault(fs), util.ManifestFileName(dbName, number), keys)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	file := io.NewSectionReader(f, 0, f.Size())
+
+	var (
+		nextFileNumber, seq uint64
+		numFamilies         uint32
+	)
+	binary.Read(file, binary.LittleEndian, &nextFileNumber)
+	binary.Read(file, binary.LittleEndian, &seq)
+	if err := binary.Read(file, binary.LittleEndian, &numFamilies); err != nil {
+		return nil, err
+	}
+	if numFamilies == 0 {
+		return nil, ErrNoFamily
+	}
+
+	families := make([]Family, 0, numFamilies)
+	lenPrefix := make([]byte, 4)
+	for range numFamilies {
+		var id uint32
+		binary.Read(file, binary.LittleEndian, &id)
+		if _, err := io.ReadFull(file, lenPrefix); err != nil {
+			return nil, err
+		}
+		name := make([]byte, binary.LittleEndian.Uint32(lenPrefix))
+		if _, err := io.ReadFull(file, name); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(file, lenPrefix); err != nil {
+			return nil, err
+		}
+		cmpName := make([]byte, binary.LittleEndian.Uint32(lenPrefix))
+		if _, err := io.ReadFull(file, cmpName); err != nil {
+			return nil, err
+		}
+
+		var v *Version
+		if len(families) == 0 {
+			v = New(dbName, option(string(name)))
+			v.counter.nextFileNumber.Store(nextFileNumber)
+			v.counter.seq.Store(seq)
+		} else {
+			v = families[0].Version.NewSibling(option(string(name)))
+		}
+		if v.option.Comparator.Name() != string(cmpName) {
+			return nil, fmt.Errorf("%w: column family %s, %s != %s", ErrComparatorMismatch, name, v.option.Comparator.Name(), cmpName)
+		}
+		v.decodeFiles(file)
+		families = append(families, Family{ID: id, Name: string(name), Version: v})
+	}
+	return families, nil
+}
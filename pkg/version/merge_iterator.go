@@ -2,30 +2,62 @@ package version
 
 import (
 	"container/heap"
-	"lsm/internal/key"
-	"lsm/pkg/sstable"
 )
 
-// 用于合并多个有序的SSTable文件
+// 按 InternalKey 有序的迭代器, 如 sstable.SSTableIterator 和 memtable 的 skiplist.Iterator
+type InternalIterator interface {
+	Valid() bool
+	Key() []byte
+	Next()
+	// seek to the first position where the key >= target
+	Seek(target []byte)
+	SeekToFirst()
+}
+
+// 用于合并多个有序的SSTable文件, 以及 memtable
+// cmp 比较编码后的 InternalKey, 需要与各迭代器的排序方式一致
 type mergeIterator struct {
-	iterators []*sstable.SSTableIterator
+	iterators []InternalIterator
 	hp        hp
 }
 
-func NewMergeIterator(iterators []*sstable.SSTableIterator) *mergeIterator {
+func NewMergeIterator[T InternalIterator](iterators []T, cmp func(a, b []byte) int) *mergeIterator {
 	mi := &mergeIterator{
-		iterators: iterators,
-		hp:        make(hp, 0),
+		iterators: make([]InternalIterator, len(iterators)),
+		hp:        hp{cmp: cmp},
 	}
 	for i, it := range iterators {
-		if it.Valid() {
-			heap.Push(&mi.hp, info{
-				k:   it.Key(),
+		mi.iterators[i] = it
+	}
+	mi.rebuild()
+	return mi
+}
+
+func (it *mergeIterator) rebuild() {
+	it.hp.infos = make([]info, 0, len(it.iterators))
+	for i, iter := range it.iterators {
+		if iter.Valid() {
+			heap.Push(&it.hp, info{
+				k:   iter.Key(),
 				idx: i,
 			})
 		}
 	}
-	return mi
+}
+
+// 所有迭代器 seek 到第一个 >= target 的位置
+func (it *mergeIterator) Seek(target []byte) {
+	for _, iter := range it.iterators {
+		iter.Seek(target)
+	}
+	it.rebuild()
+}
+
+func (it *mergeIterator) SeekToFirst() {
+	for _, iter := range it.iterators {
+		iter.SeekToFirst()
+	}
+	it.rebuild()
 }
 
 func (it *mergeIterator) Valid() bool {
@@ -33,12 +65,12 @@ func (it *mergeIterator) Valid() bool {
 }
 
 func (it *mergeIterator) Key() []byte {
-	idx := it.hp[0].idx
+	idx := it.hp.infos[0].idx
 	return it.iterators[idx].Key()
 }
 
 func (it *mergeIterator) Next() {
-	idx := it.hp[0].idx
+	idx := it.hp.infos[0].idx
 	it.iterators[idx].Next()
 	heap.Pop(&it.hp)
 	if it.iterators[idx].Valid() {
@@ -53,18 +85,21 @@ type info struct {
 	k   []byte
 	idx int
 }
-type hp []info
+type hp struct {
+	infos []info
+	cmp   func(a, b []byte) int
+}
 
-func (h hp) Len() int           { return len(h) }
-func (h hp) Less(i, j int) bool { return key.InternalKeyCompareFunc(h[i].k, h[j].k) < 0 }
-func (h hp) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *hp) Len() int           { return len(h.infos) }
+func (h *hp) Less(i, j int) bool { return h.cmp(h.infos[i].k, h.infos[j].k) < 0 }
+func (h *hp) Swap(i, j int)      { h.infos[i], h.infos[j] = h.infos[j], h.infos[i] }
 func (h *hp) Push(x any) {
-	*h = append(*h, x.(info))
+	h.infos = append(h.infos, x.(info))
 }
 func (h *hp) Pop() any {
-	old := *h
+	old := h.infos
 	n := len(old)
 	x := old[n-1]
-	*h = old[0 : n-1]
+	h.infos = old[0 : n-1]
 	return x
 }
@@ -0,0 +1,41 @@
+package version
+
+import (
+	"lsm/pkg/comparator"
+	"lsm/pkg/encryption"
+	"lsm/pkg/merge"
+	"lsm/pkg/vfs"
+	"time"
+)
+
+type Option struct {
+	// 决定 compaction 的策略, 为 nil 时使用 LeveledCompactionPicker
+	CompactionPicker CompactionPicker
+
+	// 一次 compaction 最多拆分为多少个并行执行的 subcompaction, <= 1 表示不拆分
+	MaxSubcompactions int
+
+	// compaction 时按业务逻辑删除或改写记录, 为 nil 时不过滤
+	CompactionFilter CompactionFilter
+
+	// 读取时合并 merge operand, compaction 时折叠 operand
+	MergeOperator merge.MergeOperator
+
+	// 判断记录是否过期时使用的时钟, 为 nil 时使用 time.Now
+	Clock func() time.Time
+
+	// 不为 nil 时加密新生成的 sstable 与 manifest
+	KeyProvider encryption.KeyProvider
+
+	// sstable 与 manifest 所在的文件系统, 为 nil 时使用 vfs.Default
+	FS vfs.FS
+
+	// user key 的排序方式, 为 nil 时使用 comparator.Bytewise
+	// 名字写入 manifest, 重新打开时必须使用同名的 Comparator
+	Comparator comparator.Comparator
+}
+
+var DefaultOptions = Option{
+	CompactionPicker:  NewLeveledCompactionPicker(),
+	MaxSubcompactions: 1,
+}
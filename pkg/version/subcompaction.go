@@ -0,0 +1,410 @@
+package version
+
+import (
+	"lsm/internal/key"
+	"lsm/internal/util"
+	"lsm/pkg/merge"
+	"lsm/pkg/sstable"
+	"math"
+	"slices"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 按 userKey 划分的左闭右开区间 [start, end), nil 表示无界
+// 同一个 userKey 的所有版本总是落在同一个区间内
+type keyRange struct {
+	start []byte
+	end   []byte
+}
+
+func (r keyRange) beforeEnd(ucmp func(a, b []byte) int, userKey []byte) bool {
+	return r.end == nil || ucmp(userKey, r.end) < 0
+}
+
+// 以输入文件的边界(smallest/largest 的 userKey)作为候选分割点,
+// 将 compaction 拆分为至多 MaxSubcompactions 个互不重叠的区间
+func (v *Version) subcompactionRanges(c *Compaction) []keyRange {
+	n := v.option.MaxSubcompactions
+	if n <= 1 || len(c.inputs[0])+len(c.inputs[1]) <= 1 {
+		return []keyRange{{}}
+	}
+
+	boundaries := make([][]byte, 0, 2*(len(c.inputs[0])+len(c.inputs[1])))
+	for _, files := range c.inputs {
+		for _, f := range files {
+			boundaries = append(boundaries, f.smallest.UserKey, f.largest.UserKey)
+		}
+	}
+	ucmp := v.option.Comparator.Compare
+	slices.SortFunc(boundaries, ucmp)
+	boundaries = slices.CompactFunc(boundaries, func(a, b []byte) bool { return ucmp(a, b) == 0 })
+
+	// 第一个边界之前没有数据, 不能作为分割点
+	boundaries = boundaries[1:]
+	n = min(n, len(boundaries))
+	if n <= 1 {
+		return []keyRange{{}}
+	}
+
+	ranges := make([]keyRange, 0, n)
+	var start []byte
+	for i := 1; i < n; i++ {
+		split := boundaries[i*len(boundaries)/n]
+		if start != nil && ucmp(start, split) == 0 {
+			continue
+		}
+		ranges = append(ranges, keyRange{start: start, end: split})
+		start = split
+	}
+	ranges = append(ranges, keyRange{start: start})
+	return ranges
+}
+
+// 合并 inputs 中位于 r 内的记录, 写入新的 sstable
+// 失败时不会留下任何输出文件
+func (v *Version) runSubcompaction(c *Compaction, r keyRange) (_ []*FileMetaData, err error) {
+	ucmp := v.option.Comparator.Compare
+	tables := make([]*sstable.SSTable, 0, len(c.inputs[0])+len(c.inputs[1]))
+	defer func() {
+		for _, st := range tables {
+			st.Close()
+		}
+	}()
+
+	// 先读取所有输入文件中位于 r 内的 range tombstone
+	var tombstones key.RangeTombstones
+	for _, files := range c.inputs {
+		for _, f := range files {
+			st, err := f.Load()
+			if err != nil {
+				return nil, err
+			}
+			tables = append(tables, st)
+			ts, err := st.RangeTombstones()
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range ts {
+				if t, ok := t.Clip(ucmp, r.start, r.end); ok {
+					tombstones = append(tombstones, t)
+				}
+			}
+		}
+	}
+
+	iters := make([]*sstable.SSTableIterator, 0, len(tables))
+	i := 0
+	for _, files := range c.inputs {
+		for _, f := range files {
+			st := tables[i]
+			i++
+			if c.coveredByTombstone(ucmp, f, tombstones) {
+				logrus.Debugf("sstable %d is covered by range tombstone, drop it", f.number)
+				continue
+			}
+			iter := st.NewIterator()
+			if r.start != nil {
+				// seq 最大的 lookupKey 排在该 userKey 所有记录之前
+				lookupKey := key.NewLookupKey(r.start, math.MaxUint64)
+				iter.Seek(lookupKey.EncodeTo())
+			}
+			iters = append(iters, iter)
+		}
+	}
+
+	// 没有更旧的数据, 且对所有 snapshot 可见时, tombstone 覆盖的记录已在本次 compaction 中删除,
+	// tombstone 本身也不再需要
+	outputTombstones := make(key.RangeTombstones, 0, len(tombstones))
+	for _, t := range tombstones {
+		if !c.bottommost || c.snapshotStripe(t.Seq) != 0 {
+			outputTombstones = append(outputTombstones, t)
+		}
+	}
+
+	mi := NewMergeIterator(iters, v.icmp)
+
+	var (
+		// 当前 userKey 的所有记录, seq 降序
+		entries []key.InternalKey
+		metas   = make([]*FileMetaData, 0)
+		meta    *FileMetaData
+		builder *sstable.TableBuilder
+		// 当前输出文件负责的范围的起点, 文件中的 range tombstone 被截断到该范围内
+		lower = r.start
+		// 当前文件已超过大小上限, 下一个 userKey 写入新的文件
+		split bool
+	)
+	// 失败时关闭并删除未完成的文件, 已完成的输出也不再需要
+	defer func() {
+		if err == nil {
+			return
+		}
+		if builder != nil {
+			builder.Abandon()
+		}
+		v.removeOutputs(metas)
+	}()
+	newOutput := func() error {
+		meta = &FileMetaData{
+			allowSeeks: 1 << 30,
+			dbName:     v.dbName,
+			number:     v.newFileNumber(),
+			createdAt:  v.now().UnixNano(),
+			fs:         v.option.FS,
+			keys:       v.option.KeyProvider,
+			ucmp:       v.option.Comparator,
+		}
+		builder, err = sstable.NewTableBuilder(meta.fs, util.SstableFileName(v.dbName, meta.number), meta.keys)
+		return err
+	}
+	// 结束当前文件, 其范围为 [lower, upper)
+	// 同一个 tombstone 可能被截断后写入多个文件, 使同一 level 的文件互不重叠
+	finishOutput := func(upper []byte) error {
+		defer func() { lower = upper }()
+		for _, t := range outputTombstones {
+			t, ok := t.Clip(ucmp, lower, upper)
+			if !ok {
+				continue
+			}
+			if builder == nil {
+				if err := newOutput(); err != nil {
+					return err
+				}
+			}
+			meta.extend(t.SmallestKey())
+			meta.extend(t.LargestKey())
+			meta.maxSeq = max(meta.maxSeq, t.Seq)
+			builder.AddRangeTombstone(t)
+		}
+		if builder == nil {
+			return nil
+		}
+
+		if err := builder.Finish(); err != nil {
+			return err
+		}
+		// 这里的 FileSize 是准确值
+		meta.fileSize = builder.FileSize()
+		metas = append(metas, meta)
+		builder = nil
+		return nil
+	}
+	// 同一个 userKey 的记录总是写入同一个文件, 查找时只需要读取一个文件
+	addEntries := func() error {
+		if split {
+			if err := finishOutput(entries[0].UserKey); err != nil {
+				return err
+			}
+			split = false
+		}
+		for _, ik := range v.compactKey(c, entries) {
+			if builder == nil {
+				if err := newOutput(); err != nil {
+					return err
+				}
+			}
+			meta.extend(ik)
+			meta.maxSeq = max(meta.maxSeq, ik.Seq)
+			if err := builder.Add(ik.EncodeTo(), nil); err != nil {
+				return err
+			}
+		}
+		entries = entries[:0]
+
+		// 这里的 FileSize 只是估计值, 实际值更大
+		split = builder != nil && builder.FileSize() > v.maxFileSize
+		return nil
+	}
+
+	for ; mi.Valid(); mi.Next() {
+		var nextKey key.InternalKey
+		nextKey.DecodeFrom(mi.Key())
+		if !r.beforeEnd(ucmp, nextKey.UserKey) {
+			break
+		}
+		// 注意 记录是按照 userKey 升序,seq 降序排列的
+		if len(entries) > 0 && ucmp(entries[0].UserKey, nextKey.UserKey) != 0 {
+			if ucmp(entries[0].UserKey, nextKey.UserKey) > 0 {
+				logrus.Fatalf("%s > %s", string(entries[0].UserKey), string(nextKey.UserKey))
+			}
+			if err := addEntries(); err != nil {
+				return nil, err
+			}
+		}
+		if !c.deletedByTombstone(ucmp, &nextKey, tombstones) {
+			entries = append(entries, nextKey)
+		}
+	}
+
+	if len(entries) > 0 {
+		if err := addEntries(); err != nil {
+			return nil, err
+		}
+	}
+	if err := finishOutput(r.end); err != nil {
+		return nil, err
+	}
+
+	return metas, nil
+}
+
+// ik 被 seq 更大的 tombstone 覆盖, 且两者之间没有 snapshot
+func (c *Compaction) deletedByTombstone(ucmp func(a, b []byte) int, ik *key.InternalKey, tombstones key.RangeTombstones) bool {
+	for _, t := range tombstones {
+		if t.Seq > ik.Seq && t.Contains(ucmp, ik.UserKey) && c.snapshotStripe(t.Seq) == c.snapshotStripe(ik.Seq) {
+			return true
+		}
+	}
+	return false
+}
+
+// f 的整个范围被一个 seq 大于 f 中所有记录的 tombstone 覆盖, 且没有 snapshot 能看到 f 中的记录,
+// 此时不需要读取 f
+func (c *Compaction) coveredByTombstone(ucmp func(a, b []byte) int, f *FileMetaData, tombstones key.RangeTombstones) bool {
+	for _, t := range tombstones {
+		if t.Seq > f.maxSeq && c.snapshotStripe(t.Seq) == 0 &&
+			ucmp(t.Start, f.smallest.UserKey) <= 0 && ucmp(f.largest.UserKey, t.End) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回同一个 userKey 的记录(seq 降序)经过去重、折叠 merge operand 与 CompactionFilter 后的结果
+//
+// 按 snapshot 将记录划分为若干段, 同一段内的记录对同样的 snapshot 可见,
+// 段内只需保留最新的记录, 旧记录已被完全覆盖; 不同段之间的记录需要各自保留
+func (v *Version) compactKey(c *Compaction, entries []key.InternalKey) []key.InternalKey {
+	// 过期对所有 snapshot 同样生效, 过期的 value 可以直接替换为删除记录
+	for i := range entries {
+		if entries[i].Type == key.KTypeValue && entries[i].Expired(c.now) {
+			entries[i] = key.New(entries[i].UserKey, nil, entries[i].Seq, key.KTypeDeletion)
+		}
+	}
+
+	outputs := make([]key.InternalKey, 0, 1)
+	for i := 0; i < len(entries); {
+		stripe := c.snapshotStripe(entries[i].Seq)
+		j := i + 1
+		for j < len(entries) && c.snapshotStripe(entries[j].Seq) == stripe {
+			j++
+		}
+		outputs = append(outputs, v.compactStripe(c, entries[i:j], j == len(entries))...)
+		i = j
+	}
+
+	// 只对最新的、且不被任何 snapshot 可见的 value 调用 filter
+	newest := outputs[0]
+	if v.option.CompactionFilter != nil && newest.Type == key.KTypeValue && c.snapshotStripe(newest.Seq) == len(c.snapshots) {
+		filtered, keep := v.filter(c, &newest)
+		if !keep {
+			outputs = outputs[1:]
+		} else {
+			outputs[0] = filtered
+		}
+	}
+
+	// 之下不存在更旧的数据时, 最旧的删除记录已没有需要屏蔽的记录
+	if c.bottommost {
+		for len(outputs) > 0 && outputs[len(outputs)-1].Type == key.KTypeDeletion {
+			outputs = outputs[:len(outputs)-1]
+		}
+	}
+	return outputs
+}
+
+// entries 属于同一段, oldest 表示本次 compaction 中不存在该 userKey 更旧的记录
+func (v *Version) compactStripe(c *Compaction, entries []key.InternalKey, oldest bool) []key.InternalKey {
+	if entries[0].Type != key.KTypeMerge {
+		return entries[:1]
+	}
+
+	// 收集 operand, 直到遇到作为基础的 value 或删除记录
+	n := 1
+	for n < len(entries) && entries[n].Type == key.KTypeMerge {
+		n++
+	}
+	operands := entries[:n]
+	var base *key.InternalKey
+	if n < len(entries) {
+		base = &entries[n]
+	}
+
+	op := v.option.MergeOperator
+	if op == nil {
+		if base != nil {
+			return entries[:n+1]
+		}
+		return operands
+	}
+
+	// 找到基础记录, 或者确定不存在更旧的数据时, 可以得到完整的 value
+	userKey := entries[0].UserKey
+	if base != nil || (oldest && c.bottommost) {
+		var existing []byte
+		if base != nil && base.Type == key.KTypeValue {
+			existing = base.UserValue
+		}
+		values := make([][]byte, 0, len(operands))
+		for i := len(operands) - 1; i >= 0; i-- {
+			values = append(values, operands[i].UserValue)
+		}
+		if value, ok := op.FullMerge(userKey, existing, values); ok {
+			merged := key.New(userKey, value, entries[0].Seq, key.KTypeValue)
+			// 合并结果沿用基础 value 的过期时间
+			if base != nil {
+				merged.ExpireAt = base.ExpireAt
+			}
+			return []key.InternalKey{merged}
+		}
+		logrus.Errorf("merge failed for key %s, keep operands", userKey)
+	}
+
+	// 否则尽量将 operand 合并为一个, 基础记录保持不变
+	outputs := partialMerge(op, operands)
+	if base != nil {
+		outputs = append(outputs, *base)
+	}
+	return outputs
+}
+
+// 从旧到新两两合并 operands(seq 降序), 任意一次合并失败时保留全部 operand
+func partialMerge(op merge.MergeOperator, operands []key.InternalKey) []key.InternalKey {
+	if len(operands) <= 1 {
+		return operands
+	}
+	userKey := operands[0].UserKey
+	acc := operands[len(operands)-1].UserValue
+	for i := len(operands) - 2; i >= 0; i-- {
+		merged, ok := op.PartialMerge(userKey, acc, operands[i].UserValue)
+		if !ok {
+			return operands
+		}
+		acc = merged
+	}
+	return []key.InternalKey{key.New(userKey, acc, operands[0].Seq, key.KTypeMerge)}
+}
+
+// 对 ik 调用 CompactionFilter, 返回需要写入的记录, keep 为 false 时丢弃该记录
+func (v *Version) filter(c *Compaction, ik *key.InternalKey) (filtered key.InternalKey, keep bool) {
+	ctx := CompactionFilterContext{
+		Level:      c.level,
+		Bottommost: c.bottommost,
+	}
+	decision, newValue := v.option.CompactionFilter.Filter(ctx, ik.UserKey, ik.UserValue)
+	switch decision {
+	case CompactionFilterRemove:
+		// 更旧的数据不存在时直接丢弃, 否则写入删除记录将其屏蔽
+		if c.bottommost && len(c.snapshots) == 0 {
+			return key.InternalKey{}, false
+		}
+		return key.New(ik.UserKey, nil, ik.Seq, key.KTypeDeletion), true
+	case CompactionFilterChangeValue:
+		changed := key.New(ik.UserKey, newValue, ik.Seq, key.KTypeValue)
+		changed.ExpireAt = ik.ExpireAt
+		return changed, true
+	default:
+		return *ik, true
+	}
+}
@@ -0,0 +1,134 @@
+package version
+
+import (
+	"math"
+
+	"github.com/sirupsen/logrus"
+)
+
+type UniversalOption struct {
+	// sorted run 数量达到多少开始 compaction
+	Trigger int
+
+	// 一次 compaction 最少/最多合并的 sorted run 数量
+	MinMergeWidth int
+	MaxMergeWidth int
+
+	// 百分比, 下一个 sorted run 的大小不超过已选中总大小的 (100+SizeRatio)% 时,一并合并
+	SizeRatio int
+
+	// 百分比, 除最旧的 sorted run 外其余 run 的总大小超过最旧 run 的该比例时,进行全量合并
+	MaxSizeAmplificationPercent int
+}
+
+var DefaultUniversalOptions = UniversalOption{
+	Trigger:                     L0_CompactionTrigger,
+	MinMergeWidth:               2,
+	MaxMergeWidth:               math.MaxInt32,
+	SizeRatio:                   1,
+	MaxSizeAmplificationPercent: 200,
+}
+
+// UniversalCompactionPicker 实现 size-tiered(universal) compaction
+//
+// 所有数据都保存在 level 0,每个文件视为一个 sorted run,
+// files[0] 按写入顺序排列,越靠后越新.
+// 每次合并都从最新的 run 开始选取连续的若干个 run,
+// 合并结果放在原先输入的位置(见 Version.ApplyCompaction),新旧顺序仍然成立.
+// 正在 compaction 的 run 及其之前更旧的 run 不会被选中,
+// 保证同一时刻的多个 compaction 选取的 run 互不重叠且各自连续
+//
+// 相比 leveled compaction,写放大更低,但空间放大和读放大更高
+type UniversalCompactionPicker struct {
+	option UniversalOption
+}
+
+func NewUniversalCompactionPicker(option UniversalOption) *UniversalCompactionPicker {
+	if option.MinMergeWidth < 2 {
+		option.MinMergeWidth = 2
+	}
+	if option.MaxMergeWidth < option.MinMergeWidth {
+		option.MaxMergeWidth = option.MinMergeWidth
+	}
+	return &UniversalCompactionPicker{option: option}
+}
+
+func (p *UniversalCompactionPicker) PickCompaction(v *Version) *Compaction {
+	all := v.files[0]
+	if len(all) < max(p.option.Trigger, 2) {
+		return nil
+	}
+
+	// 只能选择最后一个正在 compaction 的 run 之后的 run
+	busy := -1
+	for i, f := range all {
+		if f.beingCompacted {
+			busy = i
+		}
+	}
+	runs := all[busy+1:]
+	if len(runs) < p.option.MinMergeWidth {
+		return nil
+	}
+
+	// 全量合并需要所有 run 都空闲
+	if busy < 0 {
+		if c := p.pickForSizeAmplification(runs); c != nil {
+			logrus.Debugf("universal compaction: size amplification, runs=%d", len(c.inputs[0]))
+			return c
+		}
+	}
+
+	if c := p.pickForSizeRatio(runs); c != nil {
+		logrus.Debugf("universal compaction: size ratio, runs=%d", len(c.inputs[0]))
+		return c
+	}
+
+	// 各个 run 大小悬殊,无法按 size ratio 合并,
+	// 此时合并最新的若干个 run,使 run 的数量回落到 Trigger 之下
+	n := len(all) - p.option.Trigger + 1
+	n = max(n, p.option.MinMergeWidth)
+	n = min(n, p.option.MaxMergeWidth, len(runs))
+	logrus.Debugf("universal compaction: reduce sorted runs, runs=%d", n)
+	return p.newCompaction(runs[len(runs)-n:])
+}
+
+// 空间放大: 除最旧的 run 之外,其余 run 的总大小相对最旧 run 的比例
+func (p *UniversalCompactionPicker) pickForSizeAmplification(runs []*FileMetaData) *Compaction {
+	if p.option.MaxSizeAmplificationPercent <= 0 || len(runs) > p.option.MaxMergeWidth {
+		return nil
+	}
+
+	oldest := runs[0].fileSize
+	newer := totalFileSize(runs[1:])
+	if oldest == 0 || newer*100 < uint64(p.option.MaxSizeAmplificationPercent)*oldest {
+		return nil
+	}
+	return p.newCompaction(runs)
+}
+
+// 从最新的 run 开始,依次向前累加,
+// 直到某个 run 比已选中的总大小大出 SizeRatio% 为止
+func (p *UniversalCompactionPicker) pickForSizeRatio(runs []*FileMetaData) *Compaction {
+	i := len(runs) - 1
+	candidateSize := runs[i].fileSize
+	for i > 0 && len(runs)-i < p.option.MaxMergeWidth {
+		next := runs[i-1].fileSize
+		if float64(next) > float64(candidateSize)*float64(100+p.option.SizeRatio)/100 {
+			break
+		}
+		candidateSize += next
+		i--
+	}
+
+	if len(runs)-i < p.option.MinMergeWidth {
+		return nil
+	}
+	return p.newCompaction(runs[i:])
+}
+
+func (p *UniversalCompactionPicker) newCompaction(runs []*FileMetaData) *Compaction {
+	inputs := make([]*FileMetaData, len(runs))
+	copy(inputs, runs)
+	return NewCompaction(0, 0, [2][]*FileMetaData{inputs, nil})
+}
@@ -1,18 +1,22 @@
 package version
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"lsm/internal/key"
 	"lsm/internal/util"
+	"lsm/pkg/comparator"
+	"lsm/pkg/encryption"
 	"lsm/pkg/memtable"
+	"lsm/pkg/merge"
 	"lsm/pkg/sstable"
-	"os"
+	"lsm/pkg/vfs"
 	"slices"
 	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -30,6 +34,22 @@ type FileMetaData struct {
 
 	fileSize uint64
 
+	// 文件的创建时间, unix 纳秒, 取自 Option.Clock, 用于 FIFO compaction 的过期判断
+	createdAt int64
+
+	// 文件中所有记录(包括 range tombstone)的最大 seq
+	// 被 seq 更大的 range tombstone 完全覆盖时, compaction 可以直接丢弃整个文件
+	maxSeq uint64
+
+	// 读取 sstable 时使用, 来自 Option.FS, Option.KeyProvider 与 Option.Comparator, 不写入 manifest
+	fs   vfs.FS
+	keys encryption.KeyProvider
+	ucmp comparator.Comparator
+
+	// 是否正在被某个 compaction 使用, 不写入 manifest
+	// FileMetaData 在 version 副本之间共享, 由 db 的锁保护
+	beingCompacted bool
+
 	// Smallest/largest key in the sstable
 	// 对应 internalKey 的二进制表达
 	smallest *key.InternalKey
@@ -41,18 +61,24 @@ func (meta *FileMetaData) Size() int {
 		4 + len(meta.dbName) + // dbName
 		8 + // number
 		8 + // fileSize
+		8 + // createdAt
+		8 + // maxSeq
 		4 + len(meta.smallest.EncodeTo()) + // smallest
 		4 + len(meta.largest.EncodeTo()) // largest
 }
 
-// TODO error handling
-func (meta *FileMetaData) EncodeTo(w io.Writer) {
-	binary.Write(w, binary.LittleEndian, meta.allowSeeks)
-	w.Write(util.LenPrefixSlice([]byte(meta.dbName)))
-	binary.Write(w, binary.LittleEndian, meta.number)
-	binary.Write(w, binary.LittleEndian, meta.fileSize)
-	w.Write(util.LenPrefixSlice(meta.smallest.EncodeTo()))
-	w.Write(util.LenPrefixSlice(meta.largest.EncodeTo()))
+func (meta *FileMetaData) EncodeTo(w io.Writer) error {
+	buf := make([]byte, 0, meta.Size())
+	buf = binary.LittleEndian.AppendUint64(buf, meta.allowSeeks)
+	buf = append(buf, util.LenPrefixSlice([]byte(meta.dbName))...)
+	buf = binary.LittleEndian.AppendUint64(buf, meta.number)
+	buf = binary.LittleEndian.AppendUint64(buf, meta.fileSize)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(meta.createdAt))
+	buf = binary.LittleEndian.AppendUint64(buf, meta.maxSeq)
+	buf = append(buf, util.LenPrefixSlice(meta.smallest.EncodeTo())...)
+	buf = append(buf, util.LenPrefixSlice(meta.largest.EncodeTo())...)
+	_, err := w.Write(buf)
+	return err
 }
 
 func (meta *FileMetaData) DecodeFrom(r io.Reader) {
@@ -62,6 +88,8 @@ func (meta *FileMetaData) DecodeFrom(r io.Reader) {
 		dbName     []byte
 		number     uint64
 		fileSize   uint64
+		createdAt  int64
+		maxSeq     uint64
 		smallest   []byte
 		largest    []byte
 	)
@@ -76,6 +104,10 @@ func (meta *FileMetaData) DecodeFrom(r io.Reader) {
 
 	binary.Read(r, binary.LittleEndian, &fileSize)
 
+	binary.Read(r, binary.LittleEndian, &createdAt)
+
+	binary.Read(r, binary.LittleEndian, &maxSeq)
+
 	r.Read(lenPrefix)
 	smallest = make([]byte, binary.LittleEndian.Uint32(lenPrefix))
 	r.Read(smallest)
@@ -88,19 +120,98 @@ func (meta *FileMetaData) DecodeFrom(r io.Reader) {
 	meta.dbName = string(dbName)
 	meta.number = number
 	meta.fileSize = fileSize
+	meta.createdAt = createdAt
+	meta.maxSeq = maxSeq
 	meta.smallest.DecodeFrom(smallest)
 	meta.largest.DecodeFrom(largest)
 }
 
+func (meta *FileMetaData) Number() uint64 {
+	return meta.number
+}
+
+func (meta *FileMetaData) FileSize() uint64 {
+	return meta.fileSize
+}
+
+func (meta *FileMetaData) CreatedAt() time.Time {
+	return time.Unix(0, meta.createdAt)
+}
+
+func (meta *FileMetaData) MaxSeq() uint64 {
+	return meta.maxSeq
+}
+
+// 将 ik 纳入文件的 [smallest, largest] 范围
+func (meta *FileMetaData) extend(ik key.InternalKey) {
+	encoded := ik.EncodeTo()
+	if meta.smallest == nil || key.CompareInternalKey(meta.ucmp.Compare, encoded, meta.smallest.EncodeTo()) < 0 {
+		meta.smallest = &ik
+	}
+	if meta.largest == nil || key.CompareInternalKey(meta.ucmp.Compare, encoded, meta.largest.EncodeTo()) > 0 {
+		meta.largest = &ik
+	}
+}
+
+func (meta *FileMetaData) Smallest() *key.InternalKey {
+	return meta.smallest
+}
+
+func (meta *FileMetaData) Largest() *key.InternalKey {
+	return meta.largest
+}
+
 // load a sstable file from disk
+// 调用方负责 Close
 func (meta *FileMetaData) Load() (*sstable.SSTable, error) {
-	sstable, err := sstable.Open(util.SstableFileName(meta.dbName, meta.number))
+	sstable, err := sstable.Open(meta.fs, util.SstableFileName(meta.dbName, meta.number), meta.keys, meta.ucmp)
 	if err != nil {
 		return nil, err
 	}
 	return sstable, nil
 }
 
+func (meta *FileMetaData) find(lookupKey key.InternalKey) (*key.InternalKey, bool) {
+	st, err := meta.Load()
+	if err != nil {
+		logrus.Errorf("load sstable %d error:%v", meta.number, err)
+		return nil, false
+	}
+	defer st.Close()
+	return st.Find(lookupKey)
+}
+
+// 将 ctx.UserKey() 在 <= seq 时的记录从新到旧交给 ctx, 返回 ctx 是否已得到结果
+func (meta *FileMetaData) lookup(ctx *merge.GetContext, seq uint64) bool {
+	st, err := meta.Load()
+	if err != nil {
+		logrus.Errorf("load sstable %d error:%v", meta.number, err)
+		return false
+	}
+	defer st.Close()
+
+	tombstones, err := st.RangeTombstones()
+	if err != nil {
+		logrus.Errorf("load range tombstones of sstable %d error:%v", meta.number, err)
+		return false
+	}
+	ctx.AddRangeDeletion(tombstones.MaxCoveringSeq(meta.ucmp.Compare, ctx.UserKey(), seq))
+
+	lookupKey := key.NewLookupKey(ctx.UserKey(), seq)
+	iter := st.NewIterator()
+	for iter.Seek(lookupKey.EncodeTo()); iter.Valid(); iter.Next() {
+		var ik key.InternalKey
+		ik.DecodeFrom(iter.Key())
+		if meta.ucmp.Compare(ik.UserKey, ctx.UserKey()) != 0 {
+			return false
+		}
+		if ctx.Add(&ik) {
+			return true
+		}
+	}
+	return false
+}
+
 const (
 	DefaultLevels = 7
 
@@ -118,17 +229,24 @@ const (
 //
 // version enable us to read from a snapshot of the db in leveldb,
 // which remains a todo in out project
+// determine next newly created sstable file name,
+// and the seq when call memtable.Add()
+//
+// flush 与 compaction 在不同的 version 副本上并发分配文件编号,
+// 因此计数器需要在副本之间共享
+type counter struct {
+	nextFileNumber atomic.Uint64
+	seq            atomic.Uint64
+}
+
 type Version struct {
 	// TODO table cache
 	// tableCache     *TableCache
 
 	dbName string
 
-	// determine next newly created sstable file name
-	nextFileNumber uint64
-
-	// determine the seq when call memtable.Add()
-	seq uint64
+	// 文件编号与 seq, 由同一个 db 的所有 version 共享
+	counter *counter
 
 	// sstable is organized by level
 	files [DefaultLevels][]*FileMetaData
@@ -137,76 +255,77 @@ type Version struct {
 	// Either an empty string, or a valid InternalKey.
 	compactPointer [DefaultLevels][]byte
 
+	// 已经刷入 sstable 的最大 seq, 重放 wal 时跳过不大于该值的记录
+	// 否则 merge operand 等不幂等的记录会被重复写入
+	flushedSeq uint64
+
 	maxFileSize uint64
+
+	option Option
 }
 
-func New(dbName string) *Version {
-	if err := os.MkdirAll(dbName, 0755); err != nil {
+func New(dbName string, option Option) *Version {
+	option.FS = vfs.OrDefault(option.FS)
+	if err := option.FS.MkdirAll(dbName, 0755); err != nil {
 		panic(err)
 	}
-	return &Version{
-		dbName:         dbName,
-		seq:            0,
-		nextFileNumber: 1,
-		maxFileSize:    MaxSSTableFileSize,
+	if option.CompactionPicker == nil {
+		option.CompactionPicker = NewLeveledCompactionPicker()
 	}
-}
-
-// load a version from manifest file
-func Load(dbName string, number uint64) (*Version, error) {
-	fileName := util.ManifestFileName(dbName, number)
-	fd, err := os.Open(fileName)
-	if err != nil {
-		return nil, err
-	}
-	defer fd.Close()
-
-	v := New(dbName)
-	err = v.decodeFrom(fd)
-	if err != nil {
-		return nil, err
+	option.Comparator = comparator.OrDefault(option.Comparator)
+	v := &Version{
+		dbName:      dbName,
+		counter:     new(counter),
+		maxFileSize: MaxSSTableFileSize,
+		option:      option,
 	}
-	return v, nil
+	v.counter.nextFileNumber.Store(1)
+	return v
 }
 
-func (v *Version) Save() (uint64, error) {
-	tmp := v.nextFileNumber
-	fileName := util.ManifestFileName(v.dbName, v.nextFileNumber)
-	v.nextFileNumber++
-	file, err := os.Create(fileName)
-	if err != nil {
-		return tmp, err
-	}
-	defer file.Close()
-	v.encodeTo(file)
-	return tmp, nil
+// 创建与 v 共享文件编号与 seq 的空 version, 用于新的 column family
+// 所有 column family 的文件位于同一目录, 编号不能重复
+func (v *Version) NewSibling(option Option) *Version {
+	sibling := New(v.dbName, option)
+	sibling.counter = v.counter
+	return sibling
 }
 
-func (v *Version) encodeTo(w io.Writer) error {
-	binary.Write(w, binary.LittleEndian, v.nextFileNumber)
-	binary.Write(w, binary.LittleEndian, v.seq)
+func (v *Version) encodeFiles(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, v.flushedSeq); err != nil {
+		return err
+	}
 	for level := range DefaultLevels {
 		numFiles := len(v.files[level])
-		binary.Write(w, binary.LittleEndian, int32(numFiles))
+		if err := binary.Write(w, binary.LittleEndian, int32(numFiles)); err != nil {
+			return err
+		}
 		for i := 0; i < numFiles; i++ {
-			v.files[level][i].EncodeTo(w)
+			if err := v.files[level][i].EncodeTo(w); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
-func (v *Version) decodeFrom(r io.Reader) error {
-	binary.Read(r, binary.LittleEndian, &v.nextFileNumber)
-	binary.Read(r, binary.LittleEndian, &v.seq)
+func (v *Version) decodeFiles(r io.Reader) {
+	binary.Read(r, binary.LittleEndian, &v.flushedSeq)
 	var numFiles int32
 	for level := range DefaultLevels {
 		binary.Read(r, binary.LittleEndian, &numFiles)
 		v.files[level] = make([]*FileMetaData, numFiles)
 		for i := range int(numFiles) {
+			v.files[level][i] = &FileMetaData{
+				fs:       v.option.FS,
+				keys:     v.option.KeyProvider,
+				ucmp:     v.option.Comparator,
+				smallest: new(key.InternalKey),
+				largest:  new(key.InternalKey),
+			}
 			v.files[level][i].DecodeFrom(r)
 		}
 	}
-	return nil
 }
 
 // add a sstable file to level
@@ -218,7 +337,7 @@ func (v *Version) addFile(level int, f *FileMetaData) {
 		v.files[level] = append(v.files[level], f)
 	} else {
 		idx := sort.Search(len(v.files[level]), func(i int) bool {
-			return key.InternalKeyCompareFunc(v.files[level][i].smallest.EncodeTo(), f.smallest.EncodeTo()) >= 0
+			return v.icmp(v.files[level][i].smallest.EncodeTo(), f.smallest.EncodeTo()) >= 0
 		})
 		v.files[level] = slices.Insert(v.files[level], idx, f)
 	}
@@ -234,58 +353,128 @@ func (v *Version) deleteFile(level int, f *FileMetaData) {
 
 // when a memtable is full, write it to sstable at level 0
 func (v *Version) WriteLevel0Table(imm *memtable.Memtable) error {
+	meta, err := v.BuildTable(imm)
+	if err != nil || meta == nil {
+		return err
+	}
+	v.ApplyFlush(meta)
+	return nil
+}
+
+// 将 memtable 写入新的 sstable, 但不加入 version
+// 空的 memtable 不产生 sstable, 此时返回 nil
+func (v *Version) BuildTable(imm *memtable.Memtable) (*FileMetaData, error) {
+	iter := imm.Iterator()
+	iter.SeekToFirst()
+	tombstones := imm.RangeTombstones()
+	if !iter.Valid() && len(tombstones) == 0 {
+		return nil, nil
+	}
+
 	meta := FileMetaData{
-		dbName:   v.dbName,
-		number:   v.nextFileNumber,
-		fileSize: 0,
-		smallest: new(key.InternalKey),
-		largest:  new(key.InternalKey),
+		allowSeeks: 1 << 30,
+		dbName:     v.dbName,
+		number:     v.newFileNumber(),
+		fileSize:   0,
+		createdAt:  v.now().UnixNano(),
+		fs:         v.option.FS,
+		keys:       v.option.KeyProvider,
+		ucmp:       v.option.Comparator,
 	}
-	v.nextFileNumber++
 
 	// convert memtable to sstable
-	builder, err := sstable.NewTableBuilder(util.SstableFileName(v.dbName, meta.number))
+	builder, err := sstable.NewTableBuilder(meta.fs, util.SstableFileName(v.dbName, meta.number), meta.keys)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	iter := imm.Iterator()
-	iter.SeekToFirst()
-	if iter.Valid() {
-		meta.smallest.DecodeFrom(iter.Key())
-		for ; iter.Valid(); iter.Next() {
-			key := iter.Key()
-			meta.largest.DecodeFrom(key)
-			builder.Add(key, nil)
-		}
-		if err := builder.Finish(); err != nil {
-			return err
+	for ; iter.Valid(); iter.Next() {
+		var ik key.InternalKey
+		ik.DecodeFrom(iter.Key())
+		meta.extend(ik)
+		meta.maxSeq = max(meta.maxSeq, ik.Seq)
+		if err := builder.Add(iter.Key(), nil); err != nil {
+			builder.Abandon()
+			return nil, err
 		}
-		meta.fileSize = builder.FileSize()
 	}
+	// 文件的范围需要包含 range tombstone, 否则查找时会跳过该文件
+	for _, t := range tombstones {
+		meta.extend(t.SmallestKey())
+		meta.extend(t.LargestKey())
+		meta.maxSeq = max(meta.maxSeq, t.Seq)
+		builder.AddRangeTombstone(t)
+	}
+	if err := builder.Finish(); err != nil {
+		builder.Abandon()
+		return nil, err
+	}
+	meta.fileSize = builder.FileSize()
+	return &meta, nil
+}
 
-	v.addFile(0, &meta)
-	return nil
+// 将 BuildTable 生成的文件加入 level 0
+func (v *Version) ApplyFlush(meta *FileMetaData) {
+	v.addFile(0, meta)
+	v.flushedSeq = max(v.flushedSeq, meta.maxSeq)
+}
+
+func (v *Version) FlushedSeq() uint64 {
+	return v.flushedSeq
 }
 
 func (v *Version) Get(userKey []byte, seq uint64) ([]byte, bool) {
+	ctx := merge.NewGetContext(v.option.MergeOperator, userKey)
+	ctx.SetNow(v.now())
+	v.Lookup(ctx, seq)
+	return ctx.Result()
+}
+
+// 按从新到旧的顺序在各层查找 ctx.UserKey(), 直到 ctx 得到结果
+// 与 Find 不同, 遇到 merge operand 时会继续查找更旧的记录
+func (v *Version) Lookup(ctx *merge.GetContext, seq uint64) bool {
+	userKey := ctx.UserKey()
+	for i := len(v.files[0]) - 1; i >= 0; i-- {
+		f := v.files[0][i]
+		if !v.overlapUserKey(f, userKey) {
+			continue
+		}
+		if f.lookup(ctx, seq) {
+			return true
+		}
+	}
+
+	lookupKey := key.NewLookupKey(userKey, seq)
+	for level := 1; level < DefaultLevels; level++ {
+		// 按 InternalKey 比较, range tombstone 的终点(不包含)与下一个文件的起点可能是同一个 userKey
+		idx := sort.Search(len(v.files[level]), func(i int) bool {
+			return v.icmp(v.files[level][i].largest.EncodeTo(), lookupKey.EncodeTo()) >= 0
+		})
+		if idx == len(v.files[level]) {
+			continue
+		}
+		if v.files[level][idx].lookup(ctx, seq) {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回 userKey 在 <= seq 时的最新记录,包括删除记录
+// 找到删除记录时即停止查找,避免读到更旧的数据
+func (v *Version) Find(userKey []byte, seq uint64) (*key.InternalKey, bool) {
 	// 获取最新的 value
 	lookupKey := key.NewLookupKey(userKey, seq)
 
 	// level 0 不是全局有序，且存在重合,需要全局扫描
-	for _, f := range v.files[0] {
-		if bytes.Compare(userKey, f.smallest.UserKey) < 0 || bytes.Compare(userKey, f.largest.UserKey) > 0 {
+	// 新文件追加在末尾,从后往前查找以保证先读到较新的数据
+	for i := len(v.files[0]) - 1; i >= 0; i-- {
+		f := v.files[0][i]
+		if !v.overlapUserKey(f, userKey) {
 			continue
 		}
 
-		sstable, err := f.Load()
-		if err != nil {
-			logrus.Errorf("load sstable %d error:%v", f.number, err)
-			return nil, false
-		}
-
-		value, ok := sstable.Get(lookupKey)
-		if ok {
-			return value, true
+		if ik, ok := f.find(lookupKey); ok {
+			return ik, true
 		}
 	}
 
@@ -298,28 +487,49 @@ func (v *Version) Get(userKey []byte, seq uint64) ([]byte, bool) {
 
 		// 二分查找
 		idx := sort.Search(len(v.files[level]), func(i int) bool {
-			return bytes.Compare(v.files[level][i].largest.UserKey, userKey) >= 0
+			return v.icmp(v.files[level][i].largest.EncodeTo(), lookupKey.EncodeTo()) >= 0
 		})
 
 		if idx == len(v.files[level]) {
 			continue
 		}
 
-		sstable, err := v.files[level][idx].Load()
-		if err != nil {
-			logrus.Errorf("load sstable %d error:%v", v.files[level][idx].number, err)
-			return nil, false
-		}
-
-		value, ok := sstable.Get(lookupKey)
-		if ok {
-			return value, true
+		if ik, ok := v.files[level][idx].find(lookupKey); ok {
+			return ik, true
 		}
 	}
 
 	return nil, false
 }
 
+// 打开所有 sstable 并返回它们的迭代器与 range tombstone, 使用完毕后需调用 release 关闭文件
+func (v *Version) NewIterators() (iters []InternalIterator, tombstones key.RangeTombstones, release func(), err error) {
+	tables := make([]*sstable.SSTable, 0)
+	release = func() {
+		for _, st := range tables {
+			st.Close()
+		}
+	}
+	for level := range DefaultLevels {
+		for _, f := range v.files[level] {
+			st, err := f.Load()
+			if err != nil {
+				release()
+				return nil, nil, nil, err
+			}
+			tables = append(tables, st)
+			ts, err := st.RangeTombstones()
+			if err != nil {
+				release()
+				return nil, nil, nil, err
+			}
+			tombstones = append(tombstones, ts...)
+			iters = append(iters, st.NewIterator())
+		}
+	}
+	return iters, tombstones, release, nil
+}
+
 func (v *Version) Debug() string {
 	var sb strings.Builder
 
@@ -335,20 +545,82 @@ func (v *Version) Debug() string {
 	return sb.String()
 }
 
+// user key 的排序方式, 与创建 version 时的 Option.Comparator 相同
+func (v *Version) Comparator() comparator.Comparator {
+	return v.option.Comparator
+}
+
+// 比较编码后的 InternalKey
+func (v *Version) icmp(a, b []byte) int {
+	return key.CompareInternalKey(v.option.Comparator.Compare, a, b)
+}
+
+// userKey 是否在 f 的 user key 范围内
+func (v *Version) overlapUserKey(f *FileMetaData, userKey []byte) bool {
+	ucmp := v.option.Comparator
+	return ucmp.Compare(userKey, f.smallest.UserKey) >= 0 && ucmp.Compare(userKey, f.largest.UserKey) <= 0
+}
+
+func (v *Version) now() time.Time {
+	if v.option.Clock != nil {
+		return v.option.Clock()
+	}
+	return time.Now()
+}
+
+// 分配新的文件编号, 并发的 flush 与 (sub)compaction 会同时调用
+func (v *Version) newFileNumber() uint64 {
+	return v.counter.nextFileNumber.Add(1) - 1
+}
+
+// 下一个将被分配的文件编号
+// 后台任务开始前记录该值, 任务期间产生的文件编号都不小于它
+func (v *Version) NextFileNumber() uint64 {
+	return v.counter.nextFileNumber.Load()
+}
+
 func (v *Version) NextSeq() uint64 {
-	v.seq++
-	return v.seq
+	return v.counter.seq.Add(1)
+}
+
+func (v *Version) LastSeq() uint64 {
+	return v.counter.seq.Load()
+}
+
+// 从 wal 恢复时使用
+func (v *Version) SetLastSeq(seq uint64) {
+	v.counter.seq.Store(seq)
 }
 
 func (v *Version) NumLevelFiles(l int) int {
 	return len(v.files[l])
 }
 
+// 将 version 引用的所有 sstable 文件编号加入 live
+func (v *Version) AddLiveFiles(live map[uint64]struct{}) {
+	for level := range DefaultLevels {
+		for _, f := range v.files[level] {
+			live[f.number] = struct{}{}
+		}
+	}
+}
+
+// 返回 level 中的文件, 供 CompactionPicker 使用, 调用方不应修改
+func (v *Version) LevelFiles(l int) []*FileMetaData {
+	return v.files[l]
+}
+
 func (v *Version) Copy() *Version {
 	var c Version
 
-	c.nextFileNumber = v.nextFileNumber
-	c.seq = v.seq
+	c.dbName = v.dbName
+	c.maxFileSize = v.maxFileSize
+	c.option = v.option
+	c.counter = v.counter
+	c.flushedSeq = v.flushedSeq
+	for level := range DefaultLevels {
+		c.compactPointer[level] = v.compactPointer[level]
+	}
 	for level := 0; level < DefaultLevels; level++ {
 		c.files[level] = make([]*FileMetaData, len(v.files[level]))
 		copy(c.files[level], v.files[level])
@@ -1,14 +1,21 @@
 package version
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"lsm/internal/key"
 	"lsm/pkg/memtable"
+	"lsm/pkg/merge"
 	"lsm/pkg/sstable"
+	"lsm/pkg/vfs"
 	"math"
 	"math/rand/v2"
 	"os"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -20,7 +27,7 @@ import (
 func TestMergeIteratorBasic(t *testing.T) {
 	sbs := make([]*sstable.TableBuilder, 3)
 	for i := range 3 {
-		sbs[i], _ = sstable.NewTableBuilder(fmt.Sprintf("TestMergeIteratorBasic%d.sst", i))
+		sbs[i], _ = sstable.NewTableBuilder(vfs.Default, fmt.Sprintf("TestMergeIteratorBasic%d.sst", i), nil)
 	}
 	defer func() {
 		for i := range 3 {
@@ -54,13 +61,13 @@ func TestMergeIteratorBasic(t *testing.T) {
 	// load sst file and create iter
 	iters := make([]*sstable.SSTableIterator, 3)
 	for i := range 3 {
-		table, err := sstable.Open(fmt.Sprintf("TestMergeIteratorBasic%d.sst", i))
+		table, err := sstable.Open(vfs.Default, fmt.Sprintf("TestMergeIteratorBasic%d.sst", i), nil, nil)
 		assert.Nil(t, err)
 		iters[i] = table.NewIterator()
 	}
 
 	// create merge iter
-	mi := NewMergeIterator(iters)
+	mi := NewMergeIterator(iters, key.InternalKeyCompareFunc)
 	idx := 0
 	for ; mi.Valid(); mi.Next() {
 		assert.Equal(t, internalKeys[idx].EncodeTo(), mi.Key())
@@ -73,7 +80,7 @@ func TestWriteLevel0(t *testing.T) {
 	const dbName = "TestWriteLevel0"
 	// 1KB
 	imm := memtable.NewMemtable(1024)
-	v := New(dbName)
+	v := New(dbName, DefaultOptions)
 	defer os.RemoveAll(dbName)
 
 	idx := 0
@@ -86,7 +93,7 @@ func TestWriteLevel0(t *testing.T) {
 		}
 		idx++
 	}
-	t.Logf("insert %d keys,deleted=%v,seq=%d", idx, deleted, v.seq)
+	t.Logf("insert %d keys,deleted=%v,seq=%d", idx, deleted, v.LastSeq())
 
 	err := v.WriteLevel0Table(imm)
 	assert.Nil(t, err)
@@ -108,3 +115,618 @@ func TestWriteLevel0(t *testing.T) {
 func TestCompact(t *testing.T) {
 	// TODO
 }
+
+// 生成一个包含 [0,keyN) 的 level 0 文件, value 中记录 round
+func writeLevel0Round(t *testing.T, v *Version, keyN int, round int) {
+	imm := memtable.NewMemtable(math.MaxUint64)
+	for i := range keyN {
+		imm.Add(v.NextSeq(), key.KTypeValue, fmt.Appendf(nil, "userkey-%10d", i), fmt.Appendf(nil, "uservalue-%10d-%d", i, round))
+	}
+	assert.Nil(t, v.WriteLevel0Table(imm))
+}
+
+func TestUniversalCompaction(t *testing.T) {
+	const dbName = "TestUniversalCompaction"
+	picker := NewUniversalCompactionPicker(DefaultUniversalOptions)
+	v := New(dbName, Option{CompactionPicker: picker})
+	defer os.RemoveAll(dbName)
+
+	// 大小相近的 sorted run 会被一起合并
+	for round := range L0_CompactionTrigger - 1 {
+		writeLevel0Round(t, v, 100, round)
+	}
+	assert.Nil(t, picker.PickCompaction(v))
+
+	writeLevel0Round(t, v, 100, L0_CompactionTrigger-1)
+	c := picker.PickCompaction(v)
+	assert.NotNil(t, c)
+	assert.Equal(t, L0_CompactionTrigger, len(c.inputs[0]))
+	assert.Equal(t, 0, c.outputLevel)
+
+	assert.True(t, v.Compact())
+	assert.Equal(t, 1, v.NumLevelFiles(0))
+	for level := 1; level < DefaultLevels; level++ {
+		assert.Equal(t, 0, v.NumLevelFiles(level))
+	}
+	for i := range 100 {
+		value, ok := v.Get(fmt.Appendf(nil, "userkey-%10d", i), math.MaxUint64)
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Appendf(nil, "uservalue-%10d-%d", i, L0_CompactionTrigger-1), value)
+	}
+
+	// 较小的新 run 不会与较大的旧 run 合并
+	oldest := v.files[0][0].number
+	for round := range L0_CompactionTrigger - 1 {
+		writeLevel0Round(t, v, 10, L0_CompactionTrigger+round)
+	}
+	c = picker.PickCompaction(v)
+	assert.NotNil(t, c)
+	assert.Equal(t, L0_CompactionTrigger-1, len(c.inputs[0]))
+	for _, f := range c.inputs[0] {
+		assert.NotEqual(t, oldest, f.number)
+	}
+
+	assert.True(t, v.Compact())
+	assert.Equal(t, 2, v.NumLevelFiles(0))
+	for i := range 100 {
+		round := L0_CompactionTrigger - 1
+		if i < 10 {
+			round = 2*L0_CompactionTrigger - 2
+		}
+		value, ok := v.Get(fmt.Appendf(nil, "userkey-%10d", i), math.MaxUint64)
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Appendf(nil, "uservalue-%10d-%d", i, round), value)
+	}
+}
+
+func TestFIFOCompaction(t *testing.T) {
+	const dbName = "TestFIFOCompaction"
+	defer os.RemoveAll(dbName)
+
+	t.Run("ttl", func(t *testing.T) {
+		now := time.Unix(1_000_000, 0)
+		picker := NewFIFOCompactionPicker(FIFOOption{TTL: 330 * time.Minute})
+		v := New(dbName, Option{CompactionPicker: picker, Clock: func() time.Time { return now }})
+		// 每小时生成一个文件
+		for round := range 5 {
+			writeLevel0Round(t, v, 10, round)
+			now = now.Add(time.Hour)
+		}
+		assert.Equal(t, time.Unix(1_000_000, 0), v.files[0][0].CreatedAt())
+		assert.Nil(t, picker.PickCompaction(v))
+
+		// 最旧的两个文件过期
+		now = now.Add(2 * time.Hour)
+		expired := []uint64{v.files[0][0].number, v.files[0][1].number}
+		c := picker.PickCompaction(v)
+		assert.NotNil(t, c)
+		assert.True(t, c.deletionCompaction)
+		assert.Equal(t, expired, []uint64{c.inputs[0][0].number, c.inputs[0][1].number})
+
+		assert.True(t, v.Compact())
+		assert.Equal(t, 3, v.NumLevelFiles(0))
+		assert.Nil(t, picker.PickCompaction(v))
+	})
+
+	t.Run("size", func(t *testing.T) {
+		v := New(dbName, DefaultOptions)
+		for round := range 5 {
+			writeLevel0Round(t, v, 10, round)
+		}
+		newest := slices.Clone(v.files[0][3:])
+		picker := NewFIFOCompactionPicker(FIFOOption{MaxTableFilesSize: totalFileSize(newest)})
+		v.option.CompactionPicker = picker
+
+		assert.True(t, v.Compact())
+		assert.Equal(t, newest, v.files[0])
+		assert.False(t, v.Compact())
+
+		// 只保留最新的数据
+		for i := range 10 {
+			value, ok := v.Get(fmt.Appendf(nil, "userkey-%10d", i), math.MaxUint64)
+			assert.True(t, ok)
+			assert.Equal(t, fmt.Appendf(nil, "uservalue-%10d-%d", i, 4), value)
+		}
+	})
+}
+
+func TestConcurrentCompactionPick(t *testing.T) {
+	const dbName = "TestConcurrentCompactionPick"
+	defer os.RemoveAll(dbName)
+
+	t.Run("leveled", func(t *testing.T) {
+		os.RemoveAll(dbName)
+		v := New(dbName, DefaultOptions)
+		for round := range L0_CompactionTrigger + 1 {
+			writeLevel0Round(t, v, 100, round)
+		}
+
+		// level 0 正在 compaction 时不能再次选中
+		c := v.PickCompaction()
+		assert.NotNil(t, c)
+		assert.Equal(t, 0, c.level)
+		assert.Nil(t, v.PickCompaction())
+
+		c.Release()
+		c = v.PickCompaction()
+		assert.NotNil(t, c)
+		c.Release()
+	})
+
+	t.Run("universal", func(t *testing.T) {
+		os.RemoveAll(dbName)
+		v := New(dbName, Option{CompactionPicker: NewUniversalCompactionPicker(DefaultUniversalOptions)})
+		for round := range L0_CompactionTrigger {
+			writeLevel0Round(t, v, 100, round)
+		}
+		c1 := v.PickCompaction()
+		assert.NotNil(t, c1)
+		assert.Nil(t, v.PickCompaction())
+
+		// 只会选中比正在 compaction 的 run 更新的 run
+		for round := range L0_CompactionTrigger {
+			writeLevel0Round(t, v, 100, L0_CompactionTrigger+round)
+		}
+		c2 := v.PickCompaction()
+		assert.NotNil(t, c2)
+		assert.Equal(t, v.files[0][L0_CompactionTrigger:], c2.inputs[0])
+
+		outputs1, err := v.RunCompaction(c1)
+		assert.Nil(t, err)
+		outputs2, err := v.RunCompaction(c2)
+		assert.Nil(t, err)
+
+		// 较新的 compaction 先完成, 较旧的输出仍然排在前面
+		v.ApplyCompaction(c2, outputs2)
+		c2.Release()
+		v.ApplyCompaction(c1, outputs1)
+		c1.Release()
+		assert.Equal(t, append(outputs1, outputs2...), v.files[0])
+
+		for i := range 100 {
+			value, ok := v.Get(fmt.Appendf(nil, "userkey-%10d", i), math.MaxUint64)
+			assert.True(t, ok)
+			assert.Equal(t, fmt.Appendf(nil, "uservalue-%10d-%d", i, 2*L0_CompactionTrigger-1), value)
+		}
+	})
+}
+
+func TestCompactionFilter(t *testing.T) {
+	const dbName = "TestCompactionFilter"
+	defer os.RemoveAll(dbName)
+
+	// 删除偶数 key, 改写 3 的倍数 key 的 value
+	var contexts []CompactionFilterContext
+	filter := CompactionFilterFunc(func(ctx CompactionFilterContext, userKey, value []byte) (CompactionFilterDecision, []byte) {
+		contexts = append(contexts, ctx)
+		var i int
+		fmt.Sscanf(string(userKey), "userkey-%10d", &i)
+		if i%2 == 0 {
+			return CompactionFilterRemove, nil
+		} else if i%3 == 0 {
+			return CompactionFilterChangeValue, []byte("changed")
+		}
+		return CompactionFilterKeep, nil
+	})
+
+	for _, withSnapshot := range []bool{false, true} {
+		t.Run(fmt.Sprintf("snapshot=%t", withSnapshot), func(t *testing.T) {
+			os.RemoveAll(dbName)
+			contexts = nil
+			option := DefaultOptions
+			option.CompactionFilter = filter
+			v := New(dbName, option)
+
+			writeLevel0Round(t, v, 100, 0)
+			snapshot := v.LastSeq()
+			for round := 1; round <= L0_CompactionTrigger; round++ {
+				writeLevel0Round(t, v, 100, round)
+			}
+
+			c := v.PickCompaction()
+			assert.NotNil(t, c)
+			if withSnapshot {
+				c.SetSnapshots([]uint64{snapshot})
+			}
+			outputs, err := v.RunCompaction(c)
+			assert.Nil(t, err)
+			v.ApplyCompaction(c, outputs)
+			c.Release()
+
+			assert.Equal(t, 100, len(contexts))
+			assert.Equal(t, CompactionFilterContext{Level: 0, Bottommost: true}, contexts[0])
+
+			for i := range 100 {
+				userKey := fmt.Appendf(nil, "userkey-%10d", i)
+				value, ok := v.Get(userKey, math.MaxUint64)
+				if i%2 == 0 {
+					assert.False(t, ok)
+				} else if i%3 == 0 {
+					assert.True(t, ok)
+					assert.Equal(t, []byte("changed"), value)
+				} else {
+					assert.True(t, ok)
+					assert.Equal(t, fmt.Appendf(nil, "uservalue-%10d-%d", i, L0_CompactionTrigger), value)
+				}
+
+				// snapshot 可见的旧版本不受 filter 影响
+				value, ok = v.Get(userKey, snapshot)
+				if withSnapshot {
+					assert.True(t, ok)
+					assert.Equal(t, fmt.Appendf(nil, "uservalue-%10d-%d", i, 0), value)
+				} else {
+					assert.False(t, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeCompaction(t *testing.T) {
+	const dbName = "TestMergeCompaction"
+	defer os.RemoveAll(dbName)
+
+	// 读取输出文件中的所有记录
+	readAll := func(files []*FileMetaData) []key.InternalKey {
+		var records []key.InternalKey
+		for _, f := range files {
+			st, err := f.Load()
+			assert.Nil(t, err)
+			for iter := st.NewIterator(); iter.Valid(); iter.Next() {
+				var ik key.InternalKey
+				ik.DecodeFrom(iter.Key())
+				records = append(records, ik)
+			}
+			st.Close()
+		}
+		return records
+	}
+
+	for _, withSnapshot := range []bool{false, true} {
+		t.Run(fmt.Sprintf("snapshot=%t", withSnapshot), func(t *testing.T) {
+			os.RemoveAll(dbName)
+			option := DefaultOptions
+			option.MergeOperator = merge.UInt64AddOperator{}
+			v := New(dbName, option)
+
+			// 每个 key 只有 operand, 没有 value
+			var snapshot uint64
+			for round := range L0_CompactionTrigger + 1 {
+				imm := memtable.NewMemtable(math.MaxUint64)
+				for i := range 100 {
+					imm.Add(v.NextSeq(), key.KTypeMerge, fmt.Appendf(nil, "userkey-%10d", i), binary.LittleEndian.AppendUint64(nil, 1))
+				}
+				assert.Nil(t, v.WriteLevel0Table(imm))
+				if round == 1 {
+					snapshot = v.LastSeq()
+				}
+			}
+
+			c := v.PickCompaction()
+			assert.NotNil(t, c)
+			if withSnapshot {
+				c.SetSnapshots([]uint64{snapshot})
+			}
+			outputs, err := v.RunCompaction(c)
+			assert.Nil(t, err)
+			v.ApplyCompaction(c, outputs)
+			c.Release()
+
+			// 没有更旧的数据, operand 被折叠为 value
+			// 有 snapshot 时, snapshot 两侧各保留一条记录,
+			// 较新的一侧只能将 operand 合并为一个
+			records := readAll(outputs)
+			if withSnapshot {
+				assert.Equal(t, 200, len(records))
+				for i := 0; i < len(records); i += 2 {
+					assert.Equal(t, key.KTypeMerge, records[i].Type)
+					assert.Equal(t, uint64(L0_CompactionTrigger-1), binary.LittleEndian.Uint64(records[i].UserValue))
+					assert.Equal(t, key.KTypeValue, records[i+1].Type)
+				}
+			} else {
+				assert.Equal(t, 100, len(records))
+				for _, record := range records {
+					assert.Equal(t, key.KTypeValue, record.Type)
+				}
+			}
+
+			for i := range 100 {
+				userKey := fmt.Appendf(nil, "userkey-%10d", i)
+				value, ok := v.Get(userKey, math.MaxUint64)
+				assert.True(t, ok)
+				assert.Equal(t, uint64(L0_CompactionTrigger+1), binary.LittleEndian.Uint64(value))
+				if withSnapshot {
+					value, ok = v.Get(userKey, snapshot)
+					assert.True(t, ok)
+					assert.Equal(t, uint64(2), binary.LittleEndian.Uint64(value))
+				}
+			}
+		})
+	}
+}
+
+func TestSubcompaction(t *testing.T) {
+	const dbName = "TestSubcompaction"
+	defer os.RemoveAll(dbName)
+
+	// 每个文件包含 [round*50, round*50+100), 相邻文件部分重叠
+	writeRounds := func(v *Version) {
+		for round := range L0_CompactionTrigger + 1 {
+			imm := memtable.NewMemtable(math.MaxUint64)
+			for i := round * 50; i < round*50+100; i++ {
+				imm.Add(v.NextSeq(), key.KTypeValue, fmt.Appendf(nil, "userkey-%10d", i), fmt.Appendf(nil, "uservalue-%10d-%d", i, round))
+			}
+			assert.Nil(t, v.WriteLevel0Table(imm))
+		}
+	}
+
+	serial := New(dbName+"/serial", DefaultOptions)
+	writeRounds(serial)
+	assert.True(t, serial.Compact())
+	assert.Equal(t, 1, serial.NumLevelFiles(1))
+
+	option := DefaultOptions
+	option.MaxSubcompactions = 4
+	v := New(dbName+"/parallel", option)
+	writeRounds(v)
+	assert.Equal(t, 4, len(v.subcompactionRanges(v.option.CompactionPicker.PickCompaction(v.Copy()))))
+
+	assert.True(t, v.Compact())
+	assert.Equal(t, 0, v.NumLevelFiles(0))
+	assert.Equal(t, 4, v.NumLevelFiles(1))
+
+	// level 1 的文件有序且互不重叠
+	for i := 1; i < len(v.files[1]); i++ {
+		assert.Less(t, string(v.files[1][i-1].largest.UserKey), string(v.files[1][i].smallest.UserKey))
+	}
+
+	// 与串行 compaction 的结果一致
+	last := L0_CompactionTrigger*50 + 100
+	for i := range last {
+		userKey := fmt.Appendf(nil, "userkey-%10d", i)
+		expected, ok := serial.Get(userKey, math.MaxUint64)
+		assert.True(t, ok)
+		actual, ok := v.Get(userKey, math.MaxUint64)
+		assert.True(t, ok)
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func TestCompactionOutputCleanup(t *testing.T) {
+	const dbName = "TestCompactionOutputCleanup"
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	option := DefaultOptions
+	option.FS = fs
+	option.MaxSubcompactions = 4
+	v := New(dbName, option)
+
+	numTables := func() int {
+		names, err := fs.List(dbName)
+		assert.Nil(t, err)
+		n := 0
+		for _, name := range names {
+			if strings.HasSuffix(name, ".ldb") {
+				n++
+			}
+		}
+		return n
+	}
+
+	for round := range L0_CompactionTrigger + 1 {
+		imm := memtable.NewMemtable(math.MaxUint64)
+		for i := round * 50; i < round*50+100; i++ {
+			imm.Add(v.NextSeq(), key.KTypeValue, fmt.Appendf(nil, "userkey-%10d", i), fmt.Appendf(nil, "uservalue-%10d-%d", i, round))
+		}
+		assert.Nil(t, v.WriteLevel0Table(imm))
+	}
+	assert.Equal(t, L0_CompactionTrigger+1, numTables())
+
+	// 写入失败时, compaction 与 flush 都不留下未完成的文件
+	fs.InjectWriteError(errors.New("injected"))
+	assert.False(t, v.Compact())
+	assert.Equal(t, L0_CompactionTrigger+1, numTables())
+
+	imm := memtable.NewMemtable(math.MaxUint64)
+	imm.Add(v.NextSeq(), key.KTypeValue, []byte("userkey"), []byte("uservalue"))
+	assert.NotNil(t, v.WriteLevel0Table(imm))
+	assert.Equal(t, L0_CompactionTrigger+1, numTables())
+
+	// 恢复后 compaction 可以正常完成, 输入文件由 db 负责删除
+	fs.InjectWriteError(nil)
+	assert.True(t, v.Compact())
+	assert.Equal(t, 0, v.NumLevelFiles(0))
+	assert.Equal(t, L0_CompactionTrigger+1+v.NumLevelFiles(1), numTables())
+}
+
+func TestRangeDeletionCompaction(t *testing.T) {
+	const dbName = "TestRangeDeletionCompaction"
+	defer os.RemoveAll(dbName)
+
+	userKey := func(i int) []byte {
+		return fmt.Appendf(nil, "userkey-%10d", i)
+	}
+
+	for _, withSnapshot := range []bool{false, true} {
+		t.Run(fmt.Sprintf("snapshot=%t", withSnapshot), func(t *testing.T) {
+			os.RemoveAll(dbName)
+			v := New(dbName, DefaultOptions)
+
+			writeLevel0Round(t, v, 100, 0)
+			snapshot := v.LastSeq()
+
+			// 只包含 range tombstone 的文件, 删除 [10, 20)
+			imm := memtable.NewMemtable(math.MaxUint64)
+			imm.Add(v.NextSeq(), key.KTypeRangeDeletion, userKey(10), userKey(20))
+			assert.Nil(t, v.WriteLevel0Table(imm))
+
+			// compaction 之前, tombstone 同样对 Get 生效
+			_, ok := v.Get(userKey(15), math.MaxUint64)
+			assert.False(t, ok)
+			_, ok = v.Get(userKey(15), snapshot)
+			assert.True(t, ok)
+
+			// 后续写入不与 tombstone 重叠
+			for round := 1; round < L0_CompactionTrigger; round++ {
+				writeLevel0Round(t, v, 5, round)
+			}
+
+			c := v.PickCompaction()
+			assert.NotNil(t, c)
+			assert.True(t, c.bottommost)
+			if withSnapshot {
+				c.SetSnapshots([]uint64{snapshot})
+			}
+			outputs, err := v.RunCompaction(c)
+			assert.Nil(t, err)
+			v.ApplyCompaction(c, outputs)
+			c.Release()
+
+			for i := range 100 {
+				_, ok := v.Get(userKey(i), math.MaxUint64)
+				assert.Equal(t, i < 10 || i >= 20, ok)
+
+				// 被删除或覆盖的旧版本只为 snapshot 保留
+				value, ok := v.Get(userKey(i), snapshot)
+				if (i < 5 || i >= 10 && i < 20) && !withSnapshot {
+					assert.False(t, ok)
+				} else {
+					assert.True(t, ok)
+					assert.Equal(t, fmt.Appendf(nil, "uservalue-%10d-%d", i, 0), value)
+				}
+			}
+
+			// 最底层没有 snapshot 需要时, tombstone 本身也会被丢弃
+			var tombstones key.RangeTombstones
+			for _, f := range v.LevelFiles(c.outputLevel) {
+				st, err := f.Load()
+				assert.Nil(t, err)
+				ts, err := st.RangeTombstones()
+				assert.Nil(t, err)
+				tombstones = append(tombstones, ts...)
+			}
+			if withSnapshot {
+				assert.Equal(t, 1, len(tombstones))
+				assert.Equal(t, userKey(10), tombstones[0].Start)
+				assert.Equal(t, userKey(20), tombstones[0].End)
+			} else {
+				assert.Empty(t, tombstones)
+			}
+		})
+	}
+}
+
+func TestTTLCompaction(t *testing.T) {
+	const dbName = "TestTTLCompaction"
+	defer os.RemoveAll(dbName)
+
+	now := time.Unix(1000, 0)
+	option := DefaultOptions
+	option.Clock = func() time.Time { return now }
+	v := New(dbName, option)
+
+	// 偶数 key 在 10s 后过期
+	for round := range L0_CompactionTrigger + 1 {
+		imm := memtable.NewMemtable(math.MaxUint64)
+		for i := range 100 {
+			ik := key.New(fmt.Appendf(nil, "userkey-%10d", i), fmt.Appendf(nil, "uservalue-%10d-%d", i, round), v.NextSeq(), key.KTypeValue)
+			if i%2 == 0 {
+				ik.ExpireAt = now.Add(10 * time.Second).UnixNano()
+			}
+			imm.Insert(&ik)
+		}
+		assert.Nil(t, v.WriteLevel0Table(imm))
+	}
+
+	_, ok := v.Get(fmt.Appendf(nil, "userkey-%10d", 0), math.MaxUint64)
+	assert.True(t, ok)
+
+	now = now.Add(10 * time.Second)
+	assert.True(t, v.Compact())
+
+	// 过期的记录被物理删除, 最底层也不需要保留删除记录
+	n := 0
+	for _, f := range v.LevelFiles(1) {
+		st, err := f.Load()
+		assert.Nil(t, err)
+		for iter := st.NewIterator(); iter.Valid(); iter.Next() {
+			var ik key.InternalKey
+			ik.DecodeFrom(iter.Key())
+			var i int
+			fmt.Sscanf(string(ik.UserKey), "userkey-%10d", &i)
+			assert.Equal(t, 1, i%2)
+			assert.Equal(t, key.KTypeValue, ik.Type)
+			n++
+		}
+		st.Close()
+	}
+	assert.Equal(t, 50, n)
+
+	for i := range 100 {
+		_, ok := v.Get(fmt.Appendf(nil, "userkey-%10d", i), math.MaxUint64)
+		assert.Equal(t, i%2 == 1, ok)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	const dbName = "TestManifest"
+	defer os.RemoveAll(dbName)
+
+	v := New(dbName, DefaultOptions)
+	sibling := v.NewSibling(DefaultOptions)
+	writeLevel0Round(t, v, 10, 0)
+	writeLevel0Round(t, sibling, 10, 0)
+	writeLevel0Round(t, sibling, 10, 1)
+
+	number, err := SaveManifest(dbName, []Family{
+		{ID: 0, Name: "default", Version: v},
+		{ID: 3, Name: "sibling", Version: sibling},
+	})
+	assert.Nil(t, err)
+
+	var names []string
+	families, err := LoadManifest(vfs.Default, dbName, number, nil, func(name string) Option {
+		names = append(names, name)
+		return DefaultOptions
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"default", "sibling"}, names)
+	assert.Equal(t, 2, len(families))
+	assert.Equal(t, uint32(3), families[1].ID)
+	assert.Equal(t, 1, families[0].Version.NumLevelFiles(0))
+	assert.Equal(t, 2, families[1].Version.NumLevelFiles(0))
+	assert.Equal(t, v.LastSeq(), families[1].Version.LastSeq())
+
+	// 恢复后的 version 依然共享计数器
+	assert.Equal(t, families[0].Version.NextSeq()+1, families[1].Version.NextSeq())
+
+	value, ok := families[1].Version.Get(fmt.Appendf(nil, "userkey-%10d", 0), math.MaxUint64)
+	assert.True(t, ok)
+	assert.Equal(t, fmt.Appendf(nil, "uservalue-%10d-%d", 0, 1), value)
+}
+
+func TestManifestWriteError(t *testing.T) {
+	const dbName = "TestManifestWriteError"
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	option := DefaultOptions
+	option.FS = fs
+	v := New(dbName, option)
+	writeLevel0Round(t, v, 10, 0)
+
+	// 写入失败时返回错误, 且不留下不完整的 manifest
+	injected := errors.New("injected")
+	fs.InjectWriteError(injected)
+	_, err := SaveManifest(dbName, []Family{{ID: 0, Name: "default", Version: v}})
+	assert.ErrorIs(t, err, injected)
+	names, err := fs.List(dbName)
+	assert.Nil(t, err)
+	for _, name := range names {
+		assert.False(t, strings.HasPrefix(name, "MANIFEST"), name)
+	}
+
+	fs.InjectWriteError(nil)
+	number, err := SaveManifest(dbName, []Family{{ID: 0, Name: "default", Version: v}})
+	assert.Nil(t, err)
+	families, err := LoadManifest(fs, dbName, number, nil, func(string) Option { return option })
+	assert.Nil(t, err)
+	assert.Equal(t, 1, families[0].Version.NumLevelFiles(0))
+}
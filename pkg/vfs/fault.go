@@ -0,0 +1,305 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var ErrCrashed = errors.New("simulated crash")
+
+// FaultFS 包装另一个 FS, 用于测试崩溃一致性:
+//   - InjectWriteError / InjectSyncError 使之后的写入或 sync 失败
+//   - Crash 模拟进程崩溃, 之后所有修改操作返回 ErrCrashed, 读取不受影响
+//   - Restart 丢弃崩溃前所有未 sync 的数据, 模拟机器重启
+//
+// 只有通过 FaultFS 写入的文件会丢失数据, rename 与 remove 视为立即持久化
+type FaultFS struct {
+	base FS
+
+	mu       sync.Mutex
+	writeErr error
+	syncErr  error
+	crashed  bool
+	// 通过 FaultFS 写入过的文件, rename 时随文件移动
+	files map[string]*faultState
+	// 未释放的锁, 崩溃后由 Restart 释放
+	locks map[io.Closer]struct{}
+}
+
+type faultState struct {
+	// 最后一次 sync 时的大小
+	synced int64
+	// 从未 sync 过的新文件在崩溃后不存在
+	everSynced bool
+}
+
+type faultFile struct {
+	File
+	fs    *FaultFS
+	state *faultState
+}
+
+func NewFaultFS(base FS) *FaultFS {
+	return &FaultFS{
+		base:  base,
+		files: make(map[string]*faultState),
+		locks: make(map[io.Closer]struct{}),
+	}
+}
+
+// 之后的写入返回 err, err 为 nil 时恢复正常
+func (fs *FaultFS) InjectWriteError(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.writeErr = err
+}
+
+// 之后的 sync 返回 err, err 为 nil 时恢复正常
+func (fs *FaultFS) InjectSyncError(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.syncErr = err
+}
+
+// 模拟崩溃, 之后写入、sync、创建、rename 与删除等修改都返回 ErrCrashed, 直到调用 Restart
+// 读取仍然可以进行, 崩溃前已经开始的读取不会因此出错
+func (fs *FaultFS) Crash() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.crashed = true
+}
+
+// 将所有文件恢复到最后一次 sync 时的状态, 释放所有锁, 并清除注入的错误
+func (fs *FaultFS) Restart() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for name, state := range fs.files {
+		if !state.everSynced {
+			if err := fs.base.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		f, err := fs.base.OpenAppend(name)
+		if err != nil {
+			return err
+		}
+		if err := f.Truncate(state.synced); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	for l := range fs.locks {
+		l.Close()
+	}
+	clear(fs.files)
+	clear(fs.locks)
+	fs.writeErr, fs.syncErr, fs.crashed = nil, nil, false
+	return nil
+}
+
+func (fs *FaultFS) check() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.crashed {
+		return ErrCrashed
+	}
+	return nil
+}
+
+func (fs *FaultFS) Create(name string) (File, error) {
+	if err := fs.check(); err != nil {
+		return nil, err
+	}
+	f, err := fs.base.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	state := &faultState{}
+	fs.files[filepath.Clean(name)] = state
+	return &faultFile{File: f, fs: fs, state: state}, nil
+}
+
+func (fs *FaultFS) Open(name string) (File, error) {
+	f, err := fs.base.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: f, fs: fs}, nil
+}
+
+func (fs *FaultFS) OpenAppend(name string) (File, error) {
+	if err := fs.check(); err != nil {
+		return nil, err
+	}
+	existed := false
+	if f, err := fs.base.Open(name); err == nil {
+		existed = true
+		f.Close()
+	}
+	f, err := fs.base.OpenAppend(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = filepath.Clean(name)
+	state, ok := fs.files[name]
+	if !ok {
+		// 已有的内容视为已经持久化, 新创建的文件在 sync 之前不存在
+		size, err := f.Size()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		state = &faultState{synced: size, everSynced: existed}
+		fs.files[name] = state
+	}
+	return &faultFile{File: f, fs: fs, state: state}, nil
+}
+
+func (fs *FaultFS) Rename(oldname, newname string) error {
+	if err := fs.check(); err != nil {
+		return err
+	}
+	if err := fs.base.Rename(oldname, newname); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	if state, ok := fs.files[oldname]; ok {
+		delete(fs.files, oldname)
+		fs.files[newname] = state
+	} else {
+		delete(fs.files, newname)
+	}
+	return nil
+}
+
+func (fs *FaultFS) Remove(name string) error {
+	if err := fs.check(); err != nil {
+		return err
+	}
+	if err := fs.base.Remove(name); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.files, filepath.Clean(name))
+	return nil
+}
+
+func (fs *FaultFS) MkdirAll(dir string, perm os.FileMode) error {
+	if err := fs.check(); err != nil {
+		return err
+	}
+	return fs.base.MkdirAll(dir, perm)
+}
+
+func (fs *FaultFS) List(dir string) ([]string, error) {
+	return fs.base.List(dir)
+}
+
+type faultLock struct {
+	io.Closer
+	fs *FaultFS
+}
+
+func (fs *FaultFS) Lock(name string) (io.Closer, error) {
+	if err := fs.check(); err != nil {
+		return nil, err
+	}
+	l, err := fs.base.Lock(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.locks[l] = struct{}{}
+	return &faultLock{Closer: l, fs: fs}, nil
+}
+
+func (l *faultLock) Close() error {
+	l.fs.mu.Lock()
+	_, held := l.fs.locks[l.Closer]
+	delete(l.fs.locks, l.Closer)
+	l.fs.mu.Unlock()
+	// 已经被 Restart 释放
+	if !held {
+		return nil
+	}
+	return l.Closer.Close()
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	err := f.fs.writeErr
+	if f.fs.crashed {
+		err = ErrCrashed
+	}
+	f.fs.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if err := f.fs.check(); err != nil {
+		return err
+	}
+	if err := f.File.Truncate(size); err != nil {
+		return err
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.state != nil {
+		f.state.synced = min(f.state.synced, size)
+	}
+	return nil
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	err := f.fs.syncErr
+	if f.fs.crashed {
+		err = ErrCrashed
+	}
+	f.fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// 先取得大小, sync 期间并发写入的数据不一定被持久化
+	size, err := f.File.Size()
+	if err != nil {
+		return err
+	}
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.state != nil {
+		f.state.synced = size
+		f.state.everSynced = true
+	}
+	return nil
+}
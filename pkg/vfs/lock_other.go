@@ -0,0 +1,40 @@
+//go:build !unix
+
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// 没有 flock 的平台上只在进程内互斥
+var locked sync.Map
+
+type processLock struct {
+	*os.File
+	path string
+}
+
+func lockFile(name string) (io.Closer, error) {
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, loaded := locked.LoadOrStore(path, struct{}{}); loaded {
+		return nil, fmt.Errorf("lock %s: %w", name, ErrLocked)
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		locked.Delete(path)
+		return nil, err
+	}
+	return &processLock{File: f, path: path}, nil
+}
+
+func (l *processLock) Close() error {
+	locked.Delete(l.path)
+	return l.File.Close()
+}
@@ -0,0 +1,282 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrFileClosed = errors.New("file already closed")
+
+// MemFS 是内存中的文件系统, 用于测试
+// 路径按 filepath.Clean 后比较, 创建文件前其所在的目录必须存在
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]struct{}
+	locks map[string]struct{}
+}
+
+// 文件的内容, rename 后打开的 File 仍然指向同一个 memNode
+type memNode struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+type memFile struct {
+	name     string
+	node     *memNode
+	readOnly bool
+	closed   atomic.Bool
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memNode),
+		dirs:  map[string]struct{}{".": {}, "/": {}},
+		locks: make(map[string]struct{}),
+	}
+}
+
+func (fs *MemFS) Create(name string) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if err := fs.checkParent("create", name); err != nil {
+		return nil, err
+	}
+	node := &memNode{}
+	fs.files[name] = node
+	return &memFile{name: name, node: node}, nil
+}
+
+func (fs *MemFS) Open(name string) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	node, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return &memFile{name: name, node: node, readOnly: true}, nil
+}
+
+func (fs *MemFS) OpenAppend(name string) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	node, ok := fs.files[name]
+	if !ok {
+		if err := fs.checkParent("open", name); err != nil {
+			return nil, err
+		}
+		node = &memNode{}
+		fs.files[name] = node
+	}
+	return &memFile{name: name, node: node}, nil
+}
+
+func (fs *MemFS) Rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	node, ok := fs.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if err := fs.checkParent("rename", newname); err != nil {
+		return err
+	}
+	delete(fs.files, oldname)
+	fs.files[newname] = node
+	return nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+	if _, ok := fs.dirs[name]; ok {
+		if len(fs.list(name)) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+		delete(fs.dirs, name)
+		return nil
+	}
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFS) MkdirAll(dir string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+		if _, ok := fs.files[dir]; ok {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		if _, ok := fs.dirs[dir]; ok {
+			return nil
+		}
+		fs.dirs[dir] = struct{}{}
+	}
+}
+
+func (fs *MemFS) List(dir string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir = filepath.Clean(dir)
+	if _, ok := fs.dirs[dir]; !ok {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	return fs.list(dir), nil
+}
+
+func (fs *MemFS) list(dir string) []string {
+	var names []string
+	for name := range fs.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	for name := range fs.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (fs *MemFS) checkParent(op, name string) error {
+	if _, ok := fs.dirs[filepath.Dir(name)]; !ok {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	if _, ok := fs.dirs[name]; ok {
+		return &os.PathError{Op: op, Path: name, Err: errors.New("is a directory")}
+	}
+	return nil
+}
+
+type memLock struct {
+	fs   *MemFS
+	name string
+	once sync.Once
+}
+
+func (fs *MemFS) Lock(name string) (io.Closer, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := fs.locks[name]; ok {
+		return nil, fmt.Errorf("lock %s: %w", name, ErrLocked)
+	}
+	if err := fs.checkParent("lock", name); err != nil {
+		return nil, err
+	}
+	if _, ok := fs.files[name]; !ok {
+		fs.files[name] = &memNode{}
+	}
+	fs.locks[name] = struct{}{}
+	return &memLock{fs: fs, name: name}, nil
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.fs.mu.Lock()
+		delete(l.fs.locks, l.name)
+		l.fs.mu.Unlock()
+	})
+	return nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed.Load() {
+		return 0, ErrFileClosed
+	}
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed.Load() {
+		return 0, ErrFileClosed
+	}
+	if f.readOnly {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	f.node.data = append(f.node.data, p...)
+	return len(p), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if f.closed.Load() {
+		return ErrFileClosed
+	}
+	if f.readOnly {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrPermission}
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	return nil
+}
+
+func (f *memFile) Size() (int64, error) {
+	if f.closed.Load() {
+		return 0, ErrFileClosed
+	}
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+	return int64(len(f.node.data)), nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed.Load() {
+		return ErrFileClosed
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed.Swap(true) {
+		return ErrFileClosed
+	}
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
@@ -0,0 +1,86 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+var ErrLocked = errors.New("file is locked by another process")
+
+// File 只支持追加写入与随机读取, 与 lsm 中各类文件的使用方式一致
+type File interface {
+	io.ReaderAt
+	// 追加写入到文件末尾
+	io.Writer
+	io.Closer
+	Sync() error
+	// 截断到 size, 之后的写入从 size 处开始
+	Truncate(size int64) error
+	// 文件当前的大小
+	Size() (int64, error)
+	Name() string
+}
+
+// FS 封装 lsm 使用的所有文件操作, 便于在测试中替换为内存文件系统或注入错误
+type FS interface {
+	// 创建文件, 已存在时清空
+	Create(name string) (File, error)
+	// 以只读方式打开已有的文件
+	Open(name string) (File, error)
+	// 以追加方式打开文件, 不存在时创建
+	OpenAppend(name string) (File, error)
+	Rename(oldname, newname string) error
+	// 删除文件或空目录
+	Remove(name string) error
+	MkdirAll(dir string, perm os.FileMode) error
+	// 返回 dir 下的文件与目录名(不包括 dir), 按名称升序
+	List(dir string) ([]string, error)
+	// 对 name 加锁, 防止多个实例同时打开同一个 db, 已被锁住时返回 ErrLocked
+	// 调用返回值的 Close 释放锁
+	Lock(name string) (io.Closer, error)
+}
+
+// 读取整个文件
+func ReadFile(fs FS, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return data, nil
+}
+
+// 创建文件并写入 data, 返回前 sync
+func WriteFile(fs FS, name string, data []byte) error {
+	f, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// 为 nil 时返回 Default
+func OrDefault(fs FS) FS {
+	if fs == nil {
+		return Default
+	}
+	return fs
+}
@@ -0,0 +1,148 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testFS(t *testing.T, fs FS, dir string) {
+	assert.Nil(t, fs.MkdirAll(filepath.Join(dir, "sub"), 0755))
+
+	name := filepath.Join(dir, "a")
+	f, err := fs.Create(name)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("hello "))
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("world"))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Sync())
+	assert.Nil(t, f.Close())
+
+	data, err := ReadFile(fs, name)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello world"), data)
+
+	// 追加写入与截断
+	f, err = fs.OpenAppend(name)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Truncate(5))
+	_, err = f.Write([]byte("!"))
+	assert.Nil(t, err)
+	size, err := f.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), size)
+	buf := make([]byte, 10)
+	n, err := f.ReadAt(buf, 0)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []byte("hello!"), buf[:n])
+	assert.Nil(t, f.Close())
+
+	assert.Nil(t, WriteFile(fs, filepath.Join(dir, "b"), []byte("b")))
+	names, err := fs.List(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b", "sub"}, names)
+
+	assert.Nil(t, fs.Rename(filepath.Join(dir, "b"), filepath.Join(dir, "sub", "c")))
+	data, err = ReadFile(fs, filepath.Join(dir, "sub", "c"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b"), data)
+	_, err = fs.Open(filepath.Join(dir, "b"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	assert.Nil(t, fs.Remove(name))
+	names, err = fs.List(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sub"}, names)
+
+	// 锁释放前不能重复加锁
+	lock, err := fs.Lock(filepath.Join(dir, "LOCK"))
+	assert.Nil(t, err)
+	_, err = fs.Lock(filepath.Join(dir, "LOCK"))
+	assert.ErrorIs(t, err, ErrLocked)
+	assert.Nil(t, lock.Close())
+	lock, err = fs.Lock(filepath.Join(dir, "LOCK"))
+	assert.Nil(t, err)
+	assert.Nil(t, lock.Close())
+}
+
+func TestFS(t *testing.T) {
+	t.Run("os", func(t *testing.T) {
+		testFS(t, Default, t.TempDir())
+	})
+	t.Run("mem", func(t *testing.T) {
+		fs := NewMemFS()
+		testFS(t, fs, "db")
+
+		_, err := fs.Create("missing/a")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+	t.Run("fault", func(t *testing.T) {
+		testFS(t, NewFaultFS(NewMemFS()), "db")
+	})
+}
+
+func TestFaultFS(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	assert.Nil(t, fs.MkdirAll("db", 0755))
+	write := func(f File, data string) {
+		_, err := f.Write([]byte(data))
+		assert.Nil(t, err)
+	}
+
+	synced, err := fs.Create("db/synced")
+	assert.Nil(t, err)
+	write(synced, "durable")
+	assert.Nil(t, synced.Sync())
+	write(synced, "-lost")
+
+	unsynced, err := fs.Create("db/unsynced")
+	assert.Nil(t, err)
+	write(unsynced, "lost")
+
+	// rename 后仍然按原来的文件计算已 sync 的部分
+	assert.Nil(t, WriteFile(fs, "db/tmp", []byte("current")))
+	assert.Nil(t, fs.Rename("db/tmp", "db/CURRENT"))
+
+	// 注入的错误
+	injected := errors.New("injected")
+	fs.InjectWriteError(injected)
+	_, err = synced.Write([]byte("x"))
+	assert.ErrorIs(t, err, injected)
+	fs.InjectWriteError(nil)
+	fs.InjectSyncError(injected)
+	assert.ErrorIs(t, synced.Sync(), injected)
+	fs.InjectSyncError(nil)
+
+	lock, err := fs.Lock("db/LOCK")
+	assert.Nil(t, err)
+
+	fs.Crash()
+	_, err = synced.Write([]byte("x"))
+	assert.ErrorIs(t, err, ErrCrashed)
+	assert.ErrorIs(t, synced.Sync(), ErrCrashed)
+	_, err = fs.Create("db/new")
+	assert.ErrorIs(t, err, ErrCrashed)
+
+	assert.Nil(t, fs.Restart())
+	data, err := ReadFile(fs, "db/synced")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("durable"), data)
+	_, err = fs.Open("db/unsynced")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	data, err = ReadFile(fs, "db/CURRENT")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("current"), data)
+
+	// 崩溃时持有的锁已经释放
+	lock2, err := fs.Lock("db/LOCK")
+	assert.Nil(t, err)
+	assert.Nil(t, lock.Close())
+	_, err = fs.Lock("db/LOCK")
+	assert.ErrorIs(t, err, ErrLocked)
+	assert.Nil(t, lock2.Close())
+}
@@ -0,0 +1,75 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// 记录的压缩方式
+// 压缩后的记录以 1 字节的 Compression 开头, 并在 chunk header 的 chunkType 中设置 chunkCompressed 标记,
+// 未设置标记的记录按原样读取, 因此开启压缩前写入的 segment 仍然可读
+type Compression byte
+
+const (
+	NoCompression Compression = iota
+	// compress/flate, 默认压缩级别
+	FlateCompression
+)
+
+var ErrUnknownCompression = errors.New("unknown compression")
+
+var flateWriterPool = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// 压缩 data, 压缩后没有变小时返回 false, 此时应写入原始数据
+func compress(c Compression, data []byte) ([]byte, bool, error) {
+	switch c {
+	case NoCompression:
+		return data, false, nil
+	case FlateCompression:
+	default:
+		return nil, false, fmt.Errorf("%w: %d", ErrUnknownCompression, c)
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(data)/2 + 1)
+	buf.WriteByte(byte(c))
+
+	fw := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(fw)
+	fw.Reset(&buf)
+	if _, err := fw.Write(data); err != nil {
+		return nil, false, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, false, err
+	}
+
+	if buf.Len() >= len(data) {
+		return data, false, nil
+	}
+	return buf.Bytes(), true, nil
+}
+
+// 解压带有 chunkCompressed 标记的记录
+func decompress(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: empty compressed record", ErrUnknownCompression)
+	}
+	switch c := Compression(data[0]); c {
+	case FlateCompression:
+		fr := flate.NewReader(bytes.NewReader(data[1:]))
+		defer fr.Close()
+		return io.ReadAll(fr)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCompression, c)
+	}
+}
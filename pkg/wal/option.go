@@ -1,13 +1,39 @@
 package wal
 
+import (
+	"lsm/pkg/encryption"
+	"lsm/pkg/vfs"
+	"time"
+)
+
 // TODO 设置 segment 文件的数量
 type Option struct {
 	Dir         string
 	SegmentSize uint64
 
-	// 是否在每次写入后都 sync
+	// segment 所在的文件系统, 为 nil 时使用 vfs.Default
+	FS vfs.FS
+
+	// 是否在每次写入后都 sync, 同时等待 sync 的写入会合并为一次 sync
 	// 设置为 false 会提高性能,但不能保证持久性
 	Sync bool
+
+	// 后台 sync 的时间间隔, 0 表示不按时间 sync
+	// Sync 为 false 时, 崩溃最多丢失最近一个间隔内的写入
+	SyncInterval time.Duration
+
+	// 累计写入该字节数后在后台 sync, 0 表示不按字节数 sync
+	// 避免大量脏页在一次 sync 中集中写回
+	BytesPerSync uint64
+
+	// 写入记录时使用的压缩方式, 读取时根据记录自身的标记解压, 与该选项无关
+	Compression Compression
+
+	// 不为 nil 时加密新创建的 segment, 未加密的 segment 仍然可以读取
+	KeyProvider encryption.KeyProvider
+
+	// Open 时如何处理损坏的记录, 默认忽略末尾损坏的记录
+	RecoveryMode RecoveryMode
 }
 
 var DefaultOptions = Option{
@@ -0,0 +1,205 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Open 时如何处理损坏的记录, 参考 rocksdb 的 WALRecoveryMode
+// 损坏位于末尾是指之后没有任何完整的记录, 一般由写入时崩溃导致
+type RecoveryMode int
+
+const (
+	// 忽略末尾损坏的记录, 其它位置的损坏返回 ErrCorrupted, 为默认值
+	TolerateCorruptedTailRecords RecoveryMode = iota
+	// 任何损坏都返回 ErrCorrupted, 包括末尾写入一半的记录
+	AbsoluteConsistency
+	// 恢复到第一处损坏之前的状态, 之后的记录全部丢弃
+	PointInTimeRecovery
+	// 跳过所有损坏的记录, 保留其它完整的记录
+	SkipAnyCorruptedRecords
+)
+
+var ErrCorrupted = errors.New("wal is corrupted")
+
+// Open 时丢弃的数据
+type RecoveryReport struct {
+	// 丢弃的字节数, 包括损坏的部分与 PointInTimeRecovery 丢弃的完整记录
+	DroppedBytes uint64
+	// 丢弃的记录数, 一段连续损坏的数据无法区分记录的边界, 按一条计算
+	DroppedRecords int
+	// 第一处损坏的位置, 没有损坏时为 nil
+	FirstCorruption *ChunkPosition
+}
+
+// segment 中 [start, end) 的范围
+type span struct {
+	start, end uint64
+}
+
+func (s span) size() uint64 {
+	return s.end - s.start
+}
+
+// 逐个 chunk 检查 segment, 返回所有完整且校验通过的记录, 以及它们之间损坏的部分
+// 遇到损坏的 chunk 时, 该 block 剩余的内容无法解析, 从下一个 block 开始重新查找记录
+func (s *segment) scan() (records []span, corrupted []span, err error) {
+	size := s.Size()
+	block := getBlock()
+	defer putBlock(block)
+
+	var (
+		recordStart uint64
+		inRecord    bool
+	)
+	for blockStart := uint64(0); blockStart < size; blockStart += blockSize {
+		n := min(blockSize, size-blockStart)
+		if _, err := s.fd.ReadAt(block[:n], int64(blockStart)); err != nil {
+			return nil, nil, err
+		}
+
+		for offset := uint64(0); offset+chunkHeaderSize <= n; {
+			header := block[offset : offset+chunkHeaderSize]
+			length := uint64(binary.BigEndian.Uint16(header[4:6]))
+			chunkType := ChunkType(header[6] & chunkTypeMask)
+			end := offset + chunkHeaderSize + length
+			if end > n || chunkType > ChunkTypeLast ||
+				crc32.ChecksumIEEE(block[offset+4:end]) != binary.BigEndian.Uint32(header[:4]) {
+				inRecord = false
+				break
+			}
+
+			pos := blockStart + offset
+			switch chunkType {
+			case ChunkTypeFull:
+				records = append(records, span{pos, blockStart + end})
+				inRecord = false
+			case ChunkTypeFirst:
+				recordStart, inRecord = pos, true
+			case ChunkTypeLast:
+				// 没有 first 的 last 属于之前损坏的记录
+				if inRecord {
+					records = append(records, span{recordStart, blockStart + end})
+				}
+				inRecord = false
+			}
+			offset = end
+		}
+	}
+
+	// 记录之间除 block 末尾的 padding 外, 都是损坏的数据
+	prev := uint64(0)
+	for _, r := range append(records, span{size, size}) {
+		gap := span{prev, r.start}
+		isPadding := gap.end%blockSize == 0 && gap.size() <= chunkHeaderSize && gap.end != size
+		if gap.size() > 0 && !isPadding {
+			corrupted = append(corrupted, gap)
+		}
+		prev = r.end
+	}
+	return records, corrupted, nil
+}
+
+// 检查所有 segment, 按 mode 处理损坏的记录, segments 按 id 升序
+// 末尾损坏的数据会被截断, 使之后的写入紧接在最后一条完整的记录之后
+func (w *WAL) recover(segments []*segment) error {
+	type segmentScan struct {
+		seg       *segment
+		records   []span
+		corrupted []span
+	}
+	scans := make([]segmentScan, len(segments))
+	lastRecord := -1
+	for i, seg := range segments {
+		records, corrupted, err := seg.scan()
+		if err != nil {
+			return err
+		}
+		scans[i] = segmentScan{seg, records, corrupted}
+		if len(records) > 0 {
+			lastRecord = i
+		}
+	}
+
+	// 损坏位于末尾: 之后没有完整的记录
+	isTail := func(i int, c span) bool {
+		if i < lastRecord {
+			return false
+		}
+		records := scans[i].records
+		return len(records) == 0 || c.start >= records[len(records)-1].end
+	}
+
+	report := &w.report
+	drop := func(c span) {
+		report.DroppedBytes += c.size()
+		report.DroppedRecords++
+	}
+	for i, scan := range scans {
+		seg := scan.seg
+		for _, c := range scan.corrupted {
+			pos := seg.position(c.start)
+			if report.FirstCorruption == nil {
+				report.FirstCorruption = pos
+			}
+			logrus.Warnf("wal segment %d is corrupted at [%d, %d), recovery mode %d", seg.id, c.start, c.end, w.option.RecoveryMode)
+
+			switch w.option.RecoveryMode {
+			case AbsoluteConsistency:
+				return fmt.Errorf("%w: segment %d offset %d", ErrCorrupted, seg.id, c.start)
+
+			case TolerateCorruptedTailRecords, SkipAnyCorruptedRecords:
+				if isTail(i, c) {
+					drop(c)
+					if err := seg.truncate(c.start); err != nil {
+						return err
+					}
+					continue
+				}
+				if w.option.RecoveryMode == TolerateCorruptedTailRecords {
+					return fmt.Errorf("%w: segment %d offset %d", ErrCorrupted, seg.id, c.start)
+				}
+				// reader 读取时跳过
+				drop(c)
+				seg.corrupted = append(seg.corrupted, c)
+
+			case PointInTimeRecovery:
+				// 丢弃损坏位置之后的所有数据, 包括之后的 segment
+				drop(c)
+				for _, r := range scan.records {
+					if r.start > c.start {
+						report.DroppedRecords++
+					}
+				}
+				report.DroppedBytes += seg.Size() - c.end
+				if err := seg.truncate(c.start); err != nil {
+					return err
+				}
+				for _, later := range scans[i+1:] {
+					report.DroppedRecords += len(later.records)
+					report.DroppedBytes += later.seg.Size()
+					if err := later.seg.Remove(); err != nil {
+						return err
+					}
+					delete(w.segments, later.seg.id)
+				}
+				return nil
+
+			default:
+				return fmt.Errorf("unknown wal recovery mode %d", w.option.RecoveryMode)
+			}
+		}
+	}
+	return nil
+}
+
+// Open 时丢弃的数据
+func (w *WAL) RecoveryReport() RecoveryReport {
+	w.RLock()
+	defer w.RUnlock()
+	return w.report
+}
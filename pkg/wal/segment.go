@@ -7,8 +7,9 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"lsm/pkg/encryption"
+	"lsm/pkg/vfs"
 	"math"
-	"os"
 	"path/filepath"
 
 	"github.com/sirupsen/logrus"
@@ -47,18 +48,21 @@ const (
 	// 4 + 2 + 1
 	chunkHeaderSize = 7
 
+	// chunkType 的最高位, 标记该 chunk 所属的记录经过压缩, 见 Compression
+	chunkCompressed = 0x80
+	chunkTypeMask   = 0x7f
+
 	maxChunkSize = math.MaxUint16
 
 	blockSize = 32 * KB
 
-	fileModePerm = 0644
-
 	fileNameFormat = "%016d.seg"
 )
 
 type segment struct {
 	id SegmentID
-	fd *os.File
+	fs vfs.FS
+	fd *encryption.File
 
 	// currentBlockN * blockSize + currentBlockSize 即为待写入的位置
 	currentBlockN    uint32
@@ -71,6 +75,9 @@ type segment struct {
 
 	// 是否正在写入
 	active bool
+
+	// SkipAnyCorruptedRecords 模式下 Open 时发现的损坏部分, reader 读取时跳过
+	corrupted []span
 }
 
 // BlockN * blockSize + BlockOffset 即为该 chunk 在文件中的偏移量
@@ -85,25 +92,19 @@ func segmentFileName(id SegmentID) string {
 	return fmt.Sprintf(fileNameFormat, id)
 }
 
-func openSegment(dir string, id SegmentID, active bool) (*segment, error) {
+// keys 不为 nil 时, 新创建的 segment 会被加密
+func openSegment(fs vfs.FS, dir string, id SegmentID, active bool, keys encryption.KeyProvider) (*segment, error) {
 	filename := filepath.Join(dir, segmentFileName(id))
-	fd, err := os.OpenFile(
-		filename,
-		os.O_CREATE|os.O_RDWR|os.O_APPEND,
-		fileModePerm,
-	)
-
+	fd, err := encryption.OpenAppend(fs, filename, keys)
 	if err != nil {
 		return nil, err
 	}
 
-	offset, err := fd.Seek(0, io.SeekEnd)
-	if err != nil {
-		return nil, fmt.Errorf("seek file %s end failed: %w", filename, err)
-	}
+	offset := fd.Size()
 
 	return &segment{
 		id:               id,
+		fs:               fs,
 		fd:               fd,
 		header:           make([]byte, chunkHeaderSize),
 		currentBlockN:    uint32(offset / blockSize),
@@ -112,13 +113,16 @@ func openSegment(dir string, id SegmentID, active bool) (*segment, error) {
 	}, nil
 }
 
-func (s *segment) appendToBuffer(chunkBuffer *bytes.Buffer, data []byte, chunkType ChunkType) error {
+func (s *segment) appendToBuffer(chunkBuffer *bytes.Buffer, data []byte, chunkType ChunkType, compressed bool) error {
 	if len(data) > maxChunkSize {
 		return ErrChunkTooBig
 	}
 
 	binary.BigEndian.PutUint16(s.header[4:6], uint16(len(data)))
 	s.header[6] = byte(chunkType)
+	if compressed {
+		s.header[6] |= chunkCompressed
+	}
 
 	checksum := crc32.ChecksumIEEE(s.header[4:])
 	checksum = crc32.Update(checksum, crc32.IEEETable, data)
@@ -132,7 +136,8 @@ func (s *segment) appendToBuffer(chunkBuffer *bytes.Buffer, data []byte, chunkTy
 
 // 将 data 写入 chunkBuffer,并更新 s 的 currentBlockN 等字段
 // 后续会将 chunkBuffer 写入到 s.fd 中
-func (s *segment) writeToBuffer(data []byte, chunkBuffer *bytes.Buffer) (*ChunkPosition, error) {
+// compressed 表示 data 是压缩后的记录, 记录的每个 chunk 都会带上 chunkCompressed 标记
+func (s *segment) writeToBuffer(data []byte, compressed bool, chunkBuffer *bytes.Buffer) (*ChunkPosition, error) {
 	if s.closed {
 		return nil, ErrClosed
 	}
@@ -166,7 +171,7 @@ func (s *segment) writeToBuffer(data []byte, chunkBuffer *bytes.Buffer) (*ChunkP
 
 	dataSize := uint32(len(data))
 	if s.currentBlockSize+chunkHeaderSize+dataSize <= blockSize {
-		s.appendToBuffer(chunkBuffer, data, ChunkTypeFull)
+		s.appendToBuffer(chunkBuffer, data, ChunkTypeFull, compressed)
 		pos.Size = chunkHeaderSize + dataSize
 
 		logrus.Debugf("write full chunk to buffer")
@@ -190,7 +195,7 @@ func (s *segment) writeToBuffer(data []byte, chunkBuffer *bytes.Buffer) (*ChunkP
 				chunkType = ChunkTypeMiddle
 			}
 
-			s.appendToBuffer(chunkBuffer, data[start:end], chunkType)
+			s.appendToBuffer(chunkBuffer, data[start:end], chunkType, compressed)
 
 			logrus.Debugf("write data[%d:%d] to buffer[blockN=%d, currentBlockSize=%d], chunkType=%s, ", start, end, blockN, currentBlockSize, chunkType)
 
@@ -225,7 +230,11 @@ func (s *segment) writeBufferToFile(chunkBuffer *bytes.Buffer) error {
 	return nil
 }
 
-func (s *segment) Write(data []byte) (pos *ChunkPosition, err error) {
+func (s *segment) Write(data []byte) (*ChunkPosition, error) {
+	return s.write(data, false)
+}
+
+func (s *segment) write(data []byte, compressed bool) (pos *ChunkPosition, err error) {
 	if s.closed {
 		return nil, ErrClosed
 	}
@@ -248,7 +257,7 @@ func (s *segment) Write(data []byte) (pos *ChunkPosition, err error) {
 		putBuffer(chunkBuffer)
 	}()
 
-	pos, err = s.writeToBuffer(data, chunkBuffer)
+	pos, err = s.writeToBuffer(data, compressed, chunkBuffer)
 	if err != nil {
 		return
 	}
@@ -286,13 +295,16 @@ func (s *segment) Read(blockN uint32, blockOffset uint64) ([]byte, error) {
 			return nil, err
 		}
 
-		data, _, end, err := readBlock(block, currentBlockOffset)
+		data, _, end, compressed, err := readBlock(block, currentBlockOffset)
 		if err != nil {
 			return nil, err
 		}
 		result = append(result, data...)
 
 		if end {
+			if compressed {
+				return decompress(result)
+			}
 			break
 		}
 
@@ -319,38 +331,37 @@ func (s *segment) NewReader() *segmentReader {
 
 // 从 offset 处尝试读取一个完整的 chunk, 直到 block 末尾
 // 返回读取的 data(不包括 header), size(包括 header ), 如果 chunk 未结束,  返回 false
-func readBlock(block []byte, offset uint64) ([]byte, uint64, bool, error) {
-	size := uint64(0)
-	data := make([]byte, 0, len(block)-int(offset))
+// compressed 表示 chunk 所属的记录是否经过压缩
+func readBlock(block []byte, offset uint64) (data []byte, size uint64, end bool, compressed bool, err error) {
+	data = make([]byte, 0, len(block)-int(offset))
 
 	for {
 		if offset+chunkHeaderSize > uint64(len(block)) {
-			return data, size, false, nil
+			return data, size, false, compressed, nil
 		}
 
 		header := block[offset : offset+chunkHeaderSize]
 		savedChecksum := binary.BigEndian.Uint32(header[:4])
 		length := binary.BigEndian.Uint16(header[4:6])
-		chunkType := ChunkType(header[6])
+		chunkType := ChunkType(header[6] & chunkTypeMask)
+		compressed = header[6]&chunkCompressed != 0
 
 		checksumEnd := offset + chunkHeaderSize + uint64(length)
 		checksum := crc32.ChecksumIEEE(block[offset+4 : checksumEnd])
 		logrus.Debugf("block[%d:%d] -> chunk{checksum=%x, length=%d, chunkType=%s}", offset, checksumEnd, savedChecksum, length, chunkType)
 		if checksum != savedChecksum {
 			logrus.Debugf("checksum failed: saved=%x, calculated=%x", savedChecksum, checksum)
-			return nil, 0, false, ErrInvalidCRC
+			return nil, 0, false, false, ErrInvalidCRC
 		}
 
 		size += chunkHeaderSize + uint64(length)
 		data = append(data, block[offset+chunkHeaderSize:checksumEnd]...)
 
 		if chunkType == ChunkTypeFull || chunkType == ChunkTypeLast {
-			return data, size, true, nil
+			return data, size, true, compressed, nil
 		}
 		offset += chunkHeaderSize + uint64(length)
 	}
-
-	panic("unreachable")
 }
 
 // Next 返回当前 chunk 的 data 和 对应的 chunk position
@@ -361,10 +372,25 @@ func (sr *segmentReader) Next() ([]byte, *ChunkPosition, error) {
 		return nil, nil, ErrClosed
 	}
 
+	// 上次读取时 block 的剩余空间是 padding, 但之后的记录尚未写入
+	// 写入方会从下一个 block 开始写
+	if sr.blockOffset+chunkHeaderSize >= blockSize {
+		sr.blockN++
+		sr.blockOffset = 0
+	}
+	// 跳过损坏的部分, 其末尾是下一条完整记录的开头
+	for _, c := range sr.segment.corrupted {
+		if offset := uint64(sr.blockN)*blockSize + uint64(sr.blockOffset); offset >= c.start && offset < c.end {
+			sr.blockN = uint32(c.end / blockSize)
+			sr.blockOffset = uint32(c.end % blockSize)
+		}
+	}
+
 	var (
-		result []byte
-		block  = getBlock()
-		chunk  = &ChunkPosition{
+		result     []byte
+		compressed bool
+		block      = getBlock()
+		chunk      = &ChunkPosition{
 			SegmentID:   sr.segment.id,
 			BlockN:      sr.blockN,
 			BlockOffset: sr.blockOffset,
@@ -392,14 +418,15 @@ func (sr *segmentReader) Next() ([]byte, *ChunkPosition, error) {
 			return nil, nil, err
 		}
 
-		data, totSize, end, err := readBlock(block, uint64(currentBlockOffset))
-		logrus.Debugf("len(data）=%d, totSize=%d, end=%t, err=%v", len(data), totSize, end, err)
+		data, totSize, end, isCompressed, err := readBlock(block, uint64(currentBlockOffset))
+		logrus.Debugf("len(data）=%d, totSize=%d, end=%t, compressed=%t, err=%v", len(data), totSize, end, isCompressed, err)
 		if err != nil {
 			return nil, nil, err
 		}
 		chunk.Size += uint32(totSize)
 		currentBlockOffset += uint32(totSize)
 		result = append(result, data...)
+		compressed = isCompressed
 
 		if end {
 			break
@@ -414,6 +441,12 @@ func (sr *segmentReader) Next() ([]byte, *ChunkPosition, error) {
 	if chunk.Size != uint32(currentBlockN*blockSize+currentBlockOffset)-uint32(chunk.BlockN*blockSize+chunk.BlockOffset) {
 		panic("read size not match")
 	}
+	if compressed {
+		var err error
+		if result, err = decompress(result); err != nil {
+			return nil, nil, err
+		}
+	}
 
 	// 读取结束后, reader 移动至下一个 chunk 的起始位置
 	// 需要考虑 padding
@@ -459,7 +492,7 @@ func (s *segment) Remove() error {
 		}
 	}
 
-	return os.Remove(s.fd.Name())
+	return s.fs.Remove(s.fd.Name())
 }
 
 // 截断 blockN * blockSize + blockOffset 之后的内容
@@ -478,12 +511,23 @@ func (s *segment) Truncate(blockN uint32, blockOffset uint64) error {
 	if uint64(blockN)*blockSize+blockOffset > s.Size() {
 		return fmt.Errorf("invalid blockN or blockOffset")
 	}
+	return s.truncate(offset)
+}
 
+// 截断 offset 之后的内容, 不检查 segment 是否 active
+func (s *segment) truncate(offset uint64) error {
 	if err := s.fd.Truncate(int64(offset)); err != nil {
 		return err
 	}
-	s.fd.Seek(int64(offset), io.SeekStart)
-	s.currentBlockN = blockN
-	s.currentBlockSize = uint32(blockOffset)
+	s.currentBlockN = uint32(offset / blockSize)
+	s.currentBlockSize = uint32(offset % blockSize)
 	return nil
 }
+
+func (s *segment) position(offset uint64) *ChunkPosition {
+	return &ChunkPosition{
+		SegmentID:   s.id,
+		BlockN:      uint32(offset / blockSize),
+		BlockOffset: uint32(offset % blockSize),
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"lsm/pkg/vfs"
 	"os"
 	"strings"
 	"testing"
@@ -13,7 +14,7 @@ import (
 
 func TestSegment_Size(t *testing.T) {
 	dir, _ := os.MkdirTemp("./", "test_seg_size")
-	seg, err := openSegment(dir, 1, true)
+	seg, err := openSegment(vfs.Default, dir, 1, true, nil)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -26,7 +27,7 @@ func TestSegment_Size(t *testing.T) {
 	_, err = seg.Write(b1)
 	assert.Nil(t, err)
 
-	info, err := seg.fd.Stat()
+	info, err := os.Stat(seg.fd.Name())
 	assert.Nil(t, err)
 
 	assert.Equal(t, uint64(info.Size()), seg.Size())
@@ -34,7 +35,7 @@ func TestSegment_Size(t *testing.T) {
 
 func TestSegment_Write_Full_1(t *testing.T) {
 	dir, _ := os.MkdirTemp("./", "test_seg_write_full_1")
-	s, err := openSegment(dir, 1, true)
+	s, err := openSegment(vfs.Default, dir, 1, true, nil)
 	assert.Nil(t, err)
 	defer func() {
 		_ = s.Remove()
@@ -70,7 +71,7 @@ func TestSegment_Write_Full_1(t *testing.T) {
 
 func TestSegment_Write_Full_2(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "test_seg_write_full_2")
-	seg, err := openSegment(dir, 1, true)
+	seg, err := openSegment(vfs.Default, dir, 1, true, nil)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -99,7 +100,7 @@ func TestSegment_Write_Full_2(t *testing.T) {
 
 func TestSegment_Write_Padding(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "seg-test-padding")
-	seg, err := openSegment(dir, 1, true)
+	seg, err := openSegment(vfs.Default, dir, 1, true, nil)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -122,7 +123,7 @@ func TestSegment_Write_Padding(t *testing.T) {
 
 func TestSegment_Write_Not_Full(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "test_seg_write_not_full")
-	seg, err := openSegment(dir, 1, true)
+	seg, err := openSegment(vfs.Default, dir, 1, true, nil)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -161,7 +162,7 @@ func TestSegment_Write_Not_Full(t *testing.T) {
 
 func TestSegment_Read_FULL(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "test_seg_read_full")
-	seg, err := openSegment(dir, 1, true)
+	seg, err := openSegment(vfs.Default, dir, 1, true, nil)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -194,7 +195,7 @@ func TestSegment_Read_FULL(t *testing.T) {
 
 func TestSegment_Read_Padding(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "test_seg_read_padding")
-	seg, err := openSegment(dir, 1, true)
+	seg, err := openSegment(vfs.Default, dir, 1, true, nil)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -226,7 +227,7 @@ func TestSegment_Read_Padding(t *testing.T) {
 
 func TestSegment_Read_Not_Full(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "test_seg_read_not_full")
-	seg, err := openSegment(dir, 1, true)
+	seg, err := openSegment(vfs.Default, dir, 1, true, nil)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -274,7 +275,7 @@ func TestSegment_Read_Not_Full(t *testing.T) {
 
 func TestSegment_Read_ManyChunks_Full(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "test_seg_read_manychunks_full")
-	seg, err := openSegment(dir, 1, true)
+	seg, err := openSegment(vfs.Default, dir, 1, true, nil)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -307,7 +308,7 @@ func TestSegment_Read_ManyChunks_Full(t *testing.T) {
 
 func TestSegment_Read_ManyChunks_NotFull(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "test_seg_read_many_chunks_not_full")
-	seg, err := openSegment(dir, 1, true)
+	seg, err := openSegment(vfs.Default, dir, 1, true, nil)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
@@ -353,7 +354,7 @@ func TestSegment_Write_LargeSize(t *testing.T) {
 
 func testSegmentReaderLargeSize(t *testing.T, size int, count int) {
 	dir, _ := os.MkdirTemp("", fmt.Sprintf("seg-test-reader-ManyChunks_large_size_%d_%d", size, count))
-	seg, err := openSegment(dir, 1, true)
+	seg, err := openSegment(vfs.Default, dir, 1, true, nil)
 	assert.Nil(t, err)
 	defer func() {
 		_ = seg.Remove()
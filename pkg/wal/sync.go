@@ -0,0 +1,113 @@
+package wal
+
+import (
+	"cmp"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// wal 中的一个位置, 用于记录已经 sync 到哪里
+type syncPoint struct {
+	segmentID SegmentID
+	offset    uint64
+}
+
+func (p syncPoint) compare(other syncPoint) int {
+	return cmp.Or(cmp.Compare(p.segmentID, other.segmentID), cmp.Compare(p.offset, other.offset))
+}
+
+// pos 对应的记录结束的位置
+func endOf(pos *ChunkPosition) syncPoint {
+	return syncPoint{pos.SegmentID, uint64(pos.BlockN)*blockSize + uint64(pos.BlockOffset) + uint64(pos.Size)}
+}
+
+// 确保 pos 及之前的记录都已持久化
+//
+// 同时等待的写入会合并为一次 sync: 同一时刻只有一个 goroutine 执行 sync,
+// 它会 sync 到当前写入的末尾, 完成后唤醒所有等待者, 被覆盖的写入一起返回
+func (w *WAL) SyncTo(pos *ChunkPosition) error {
+	return w.syncTo(endOf(pos))
+}
+
+func (w *WAL) syncTo(target syncPoint) error {
+	w.syncMu.Lock()
+	for w.synced.compare(target) < 0 && w.syncing {
+		w.syncCond.Wait()
+	}
+	if w.synced.compare(target) >= 0 {
+		w.syncMu.Unlock()
+		return nil
+	}
+	w.syncing = true
+	w.syncMu.Unlock()
+
+	// 之前的 segment 在 cycle 时已经 sync, 只需要 sync active segment
+	// sync 期间不持有 w 的锁, 其它写入可以继续进行;
+	// 通过 inflight 使 Close、Delete 与 TruncateBefore 等待 sync 完成后再关闭 segment
+	w.RLock()
+	seg := w.activeSegment
+	var end syncPoint
+	if seg != nil {
+		end = syncPoint{seg.id, seg.Size()}
+		w.inflight.Add(1)
+	}
+	w.RUnlock()
+
+	err := ErrClosed
+	if seg != nil {
+		err = seg.fd.Sync()
+		w.inflight.Done()
+	}
+
+	w.syncMu.Lock()
+	w.syncing = false
+	if err == nil && w.synced.compare(end) < 0 {
+		w.synced = end
+	}
+	w.syncCond.Broadcast()
+	w.syncMu.Unlock()
+	return err
+}
+
+// 按时间间隔或写入的字节数在后台 sync
+func (w *WAL) backgroundSync() {
+	defer w.syncWorker.Done()
+
+	var tick <-chan time.Time
+	if w.option.SyncInterval > 0 {
+		ticker := time.NewTicker(w.option.SyncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-w.stopSync:
+			return
+		case <-tick:
+		case <-w.syncRequest:
+		}
+
+		w.RLock()
+		seg := w.activeSegment
+		var end syncPoint
+		if seg != nil {
+			end = syncPoint{seg.id, seg.Size()}
+		}
+		w.RUnlock()
+		if seg == nil {
+			return
+		}
+		if err := w.syncTo(end); err != nil {
+			logrus.Errorf("background wal sync failed, err:%v", err)
+		}
+	}
+}
+
+// 停止后台 sync, 可以重复调用
+func (w *WAL) stopBackgroundSync() {
+	w.stopOnce.Do(func() {
+		close(w.stopSync)
+	})
+	w.syncWorker.Wait()
+}
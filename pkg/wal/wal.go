@@ -1,10 +1,11 @@
 package wal
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"lsm/pkg/vfs"
 	"sort"
 	"sync"
 
@@ -15,69 +16,121 @@ const (
 	initialSegmentID = 1
 )
 
-// TODO 实现 截取功能
 type WAL struct {
 	sync.RWMutex
 
 	activeSegment *segment
 	segments      map[SegmentID]*segment
 	option        Option
+
+	// 每次写入后关闭并替换, 唤醒等待新记录的 Reader
+	appended chan struct{}
+
+	// Open 时丢弃的数据
+	report RecoveryReport
+
+	// 以下字段由 syncMu 保护, 用于合并并发的 sync
+	syncMu   sync.Mutex
+	syncCond *sync.Cond
+	// 已持久化的位置
+	synced  syncPoint
+	syncing bool
+	// 正在进行的 fsync, 在 w.RLock 下增加, 关闭或删除 segment 前需要等待其完成
+	inflight sync.WaitGroup
+
+	// 上次触发后台 sync 后写入的字节数, 由 w.Lock 保护
+	unsynced    uint64
+	syncRequest chan struct{}
+	stopSync    chan struct{}
+	stopOnce    sync.Once
+	syncWorker  sync.WaitGroup
 }
 
 type Reader struct {
+	wal            *WAL
 	segmentReaders []*segmentReader
 	currentReader  int
 }
 
 func Open(option Option) (*WAL, error) {
+	option.FS = vfs.OrDefault(option.FS)
 	wal := &WAL{
-		option:   option,
-		segments: make(map[SegmentID]*segment),
+		option:      option,
+		segments:    make(map[SegmentID]*segment),
+		appended:    make(chan struct{}),
+		syncRequest: make(chan struct{}, 1),
+		stopSync:    make(chan struct{}),
 	}
-
-	if err := os.MkdirAll(option.Dir, 0777); err != nil {
+	wal.syncCond = sync.NewCond(&wal.syncMu)
+	if err := wal.open(); err != nil {
 		return nil, err
 	}
 
-	entries, err := os.ReadDir(option.Dir)
+	// 已有的数据视为已持久化
+	wal.synced = syncPoint{wal.activeSegment.id, wal.activeSegment.Size()}
+	if option.SyncInterval > 0 || option.BytesPerSync > 0 {
+		wal.syncWorker.Add(1)
+		go wal.backgroundSync()
+	}
+	return wal, nil
+}
+
+func (w *WAL) open() error {
+	option := w.option
+
+	if err := option.FS.MkdirAll(option.Dir, 0777); err != nil {
+		return err
+	}
+
+	names, err := option.FS.List(option.Dir)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	segmentIDs := make([]int, 0, len(entries))
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
+	segmentIDs := make([]int, 0, len(names))
+	for _, name := range names {
 		var id uint32
-		if _, err := fmt.Sscanf(entry.Name(), fileNameFormat, &id); err != nil {
+		if _, err := fmt.Sscanf(name, fileNameFormat, &id); err != nil {
 			continue
 		}
 		segmentIDs = append(segmentIDs, int(id))
 	}
 
 	if len(segmentIDs) == 0 {
-		seg, err := openSegment(option.Dir, initialSegmentID, true)
+		seg, err := openSegment(option.FS, option.Dir, initialSegmentID, true, option.KeyProvider)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		seg.active = true
-		wal.activeSegment = seg
-		wal.segments[initialSegmentID] = seg
-		return wal, nil
+		w.activeSegment = seg
+		w.segments[initialSegmentID] = seg
+		return nil
 	}
 
 	sort.Ints(segmentIDs)
+	segments := make([]*segment, 0, len(segmentIDs))
 	for _, id := range segmentIDs {
-		seg, err := openSegment(option.Dir, SegmentID(id), false)
+		seg, err := openSegment(option.FS, option.Dir, SegmentID(id), false, option.KeyProvider)
 		if err != nil {
-			return nil, err
+			w.Close()
+			return err
 		}
-		wal.segments[SegmentID(id)] = seg
+		w.segments[SegmentID(id)] = seg
+		segments = append(segments, seg)
 	}
-	wal.activeSegment = wal.segments[SegmentID(segmentIDs[len(segmentIDs)-1])]
-	wal.activeSegment.active = true
-	return wal, nil
+	if err := w.recover(segments); err != nil {
+		w.Close()
+		return err
+	}
+
+	// PointInTimeRecovery 可能删除了之后的 segment
+	for _, seg := range segments {
+		if _, ok := w.segments[seg.id]; ok {
+			w.activeSegment = seg
+		}
+	}
+	w.activeSegment.active = true
+	return nil
 }
 
 // start 为 nil 时从最开始读,否则从第一个 >= start 的位置开始读
@@ -103,7 +156,7 @@ func (w *WAL) NewReaderWithStart(start *ChunkPosition) (*Reader, error) {
 		}
 	}
 
-	var currentReaderIndex int
+	currentReaderIndex := len(readers)
 	for i, reader := range readers {
 		if reader.segment.id >= start.SegmentID {
 			currentReaderIndex = i
@@ -128,56 +181,82 @@ func (w *WAL) NewReaderWithStart(start *ChunkPosition) (*Reader, error) {
 
 	currentReader := readers[currentReaderIndex]
 	startOffset := uint64(start.BlockN)*blockSize + uint64(start.BlockOffset)
-	currentOffset := uint64(0)
-	logrus.Debugf("startOffset: %d, currentOffset: %d", startOffset, currentOffset)
-	for currentOffset < startOffset {
-		_, chunk, err := currentReader.Next()
-		if err != nil {
+	logrus.Debugf("startOffset: %d", startOffset)
+	// 按 reader 的实际位置比较, chunk 之间可能有 padding
+	for uint64(currentReader.blockN)*blockSize+uint64(currentReader.blockOffset) < startOffset {
+		if _, _, err := currentReader.Next(); err != nil {
 			if errors.Is(err, io.EOF) {
 				break
 			}
 			return nil, err
 		}
-
-		currentOffset += uint64(chunk.Size)
 	}
 	logrus.Debugf("currentReader:{id:%d, blockN:%d, blockOffset:%d}", currentReader.segment.id, currentReader.blockN, currentReader.blockOffset)
 	return &Reader{
+		wal:            w,
 		segmentReaders: readers,
 		currentReader:  currentReaderIndex,
 	}, nil
 }
 
+// option.Sync 为 true 时, 等待记录持久化后返回, 并发写入的 sync 会合并
 func (w *WAL) Write(data []byte) (*ChunkPosition, error) {
+	// 在锁外压缩, 不阻塞其它写入
+	data, compressed, err := compress(w.option.Compression, data)
+	if err != nil {
+		return nil, err
+	}
+	chunkPos, err := w.write(data, compressed)
+	if err != nil {
+		return nil, err
+	}
+	if w.option.Sync {
+		if err := w.SyncTo(chunkPos); err != nil {
+			return nil, err
+		}
+	}
+	return chunkPos, nil
+}
+
+func (w *WAL) write(data []byte, compressed bool) (*ChunkPosition, error) {
 	w.Lock()
 	defer w.Unlock()
 
+	if w.activeSegment == nil {
+		return nil, ErrClosed
+	}
 	if w.isFull(uint64(len(data))) {
 		if err := w.cycle(); err != nil {
 			return nil, err
 		}
 	}
 
-	chunkPos, err := w.activeSegment.Write(data)
+	chunkPos, err := w.activeSegment.write(data, compressed)
 	if err != nil {
 		return nil, err
 	}
-
-	// sync 失败时可以根据该记录进行回滚
 	logrus.Debugf("write chunk position: %+v", chunkPos)
-	if w.option.Sync {
-		if err := w.activeSegment.Sync(); err != nil {
-			logrus.Debugf("sync failed, truncate to %+v", chunkPos)
-			if err1 := w.activeSegment.Truncate(chunkPos.BlockN, uint64(chunkPos.BlockOffset)); err1 != nil {
-				return nil, err1
-			}
-			return nil, err
+
+	w.unsynced += uint64(chunkPos.Size)
+	if w.option.BytesPerSync > 0 && w.unsynced >= w.option.BytesPerSync {
+		w.unsynced = 0
+		// 已有未处理的请求时不需要重复通知
+		select {
+		case w.syncRequest <- struct{}{}:
+		default:
 		}
 	}
 
+	w.notifyAppended()
 	return chunkPos, nil
 }
 
+// 调用前需持有 w.Lock
+func (w *WAL) notifyAppended() {
+	close(w.appended)
+	w.appended = make(chan struct{})
+}
+
 func (w *WAL) Read(pos *ChunkPosition) ([]byte, error) {
 	w.RLock()
 	defer w.RUnlock()
@@ -188,23 +267,62 @@ func (w *WAL) Read(pos *ChunkPosition) ([]byte, error) {
 	return seg.Read(pos.BlockN, uint64(pos.BlockOffset))
 }
 
+// 持久化当前已写入的所有记录
 func (w *WAL) Sync() error {
-	w.Lock()
-	defer w.Unlock()
-	return w.activeSegment.Sync()
+	w.RLock()
+	if w.activeSegment == nil {
+		w.RUnlock()
+		return ErrClosed
+	}
+	end := syncPoint{w.activeSegment.id, w.activeSegment.Size()}
+	w.RUnlock()
+	return w.syncTo(end)
 }
 
 func (w *WAL) Close() error {
+	w.stopBackgroundSync()
 	w.Lock()
 	defer w.Unlock()
 
+	w.inflight.Wait()
 	for _, seg := range w.segments {
 		if err := seg.Close(); err != nil {
 			return err
 		}
 	}
+	// Close 时已 sync 所有 segment, 之前写入的记录在关闭后 SyncTo 同样成功
+	if w.activeSegment != nil {
+		w.syncMu.Lock()
+		w.synced = syncPoint{w.activeSegment.id, w.activeSegment.Size()}
+		w.syncCond.Broadcast()
+		w.syncMu.Unlock()
+	}
 	w.segments = nil
 	w.activeSegment = nil
+	// 唤醒等待中的 Reader, 它们会返回 ErrClosed
+	w.notifyAppended()
+	return nil
+}
+
+// 关闭并删除完全位于 pos 之前的 segment, 即 id < pos.SegmentID 的 segment
+// active segment 不会被删除
+// 调用方需保证这些 segment 中的记录已经持久化到其它地方, 如 memtable 已经刷入 sstable
+func (w *WAL) TruncateBefore(pos ChunkPosition) error {
+	w.Lock()
+	defer w.Unlock()
+
+	// sync 期间可能发生了 cycle, 正在 sync 的 segment 可能就是要删除的 segment
+	w.inflight.Wait()
+	for id, seg := range w.segments {
+		if id >= pos.SegmentID || seg == w.activeSegment {
+			continue
+		}
+		logrus.Debugf("truncate wal, remove segment %d", id)
+		if err := seg.Remove(); err != nil {
+			return err
+		}
+		delete(w.segments, id)
+	}
 	return nil
 }
 
@@ -213,7 +331,7 @@ func (w *WAL) cycle() error {
 	if err := w.activeSegment.Sync(); err != nil {
 		return err
 	}
-	seg, err := openSegment(w.option.Dir, w.activeSegment.id+1, true)
+	seg, err := openSegment(w.option.FS, w.option.Dir, w.activeSegment.id+1, true, w.option.KeyProvider)
 	if err != nil {
 		return err
 	}
@@ -244,9 +362,11 @@ func (w *WAL) Empty() bool {
 }
 
 func (w *WAL) Delete() error {
+	w.stopBackgroundSync()
 	w.Lock()
 	defer w.Unlock()
 
+	w.inflight.Wait()
 	for _, seg := range w.segments {
 		if err := seg.Remove(); err != nil {
 			return err
@@ -254,6 +374,7 @@ func (w *WAL) Delete() error {
 	}
 	w.segments = nil
 	w.activeSegment = nil
+	w.notifyAppended()
 	return nil
 }
 
@@ -270,6 +391,68 @@ func (r *Reader) Next() ([]byte, *ChunkPosition, error) {
 	return data, pos, err
 }
 
+// 与 Next 相同, 但读到 active segment 的末尾时阻塞, 直到有新的记录写入或 ctx 结束
+// 会跟随 wal 切换到之后创建的 segment, 可用于 change data capture 等持续消费 wal 的场景
+//
+// 消费方可以在每次 NextWait 返回后保存 CurrentChunkPosition,
+// 之后将其传给 NewReaderWithStart 从下一条记录继续读取
+// 尚未读取的 segment 被 TruncateBefore 删除, 或 wal 被关闭时返回 ErrClosed
+func (r *Reader) NextWait(ctx context.Context) ([]byte, *ChunkPosition, error) {
+	for {
+		// 与写入互斥, 避免读到 segment 写入一半的状态
+		r.wal.RLock()
+		if r.wal.activeSegment == nil {
+			r.wal.RUnlock()
+			return nil, nil, ErrClosed
+		}
+		appended := r.wal.appended
+		data, pos, err := r.nextFollowing()
+		r.wal.RUnlock()
+		if !errors.Is(err, io.EOF) {
+			return data, pos, err
+		}
+
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// 读到最后一个 segment 的末尾时, 加入创建 reader 之后新建的 segment
+// 调用前需持有 r.wal.RLock
+func (r *Reader) nextFollowing() ([]byte, *ChunkPosition, error) {
+	// Next 读取结束后 currentReader 会越过最后一个 segment
+	r.currentReader = min(r.currentReader, len(r.segmentReaders)-1)
+	for {
+		data, pos, err := r.segmentReaders[r.currentReader].Next()
+		if !errors.Is(err, io.EOF) {
+			return data, pos, err
+		}
+		if r.currentReader+1 == len(r.segmentReaders) && !r.addNewSegments() {
+			return nil, nil, io.EOF
+		}
+		r.currentReader++
+	}
+}
+
+// 调用前需持有 r.wal.RLock
+func (r *Reader) addNewSegments() bool {
+	last := r.segmentReaders[len(r.segmentReaders)-1].segment.id
+	var added []*segmentReader
+	for id, seg := range r.wal.segments {
+		if id > last {
+			added = append(added, seg.NewReader())
+		}
+	}
+	sort.Slice(added, func(i, j int) bool {
+		return added[i].segment.id < added[j].segment.id
+	})
+	r.segmentReaders = append(r.segmentReaders, added...)
+	return len(added) > 0
+}
+
 func (r *Reader) CurrentChunkPosition() *ChunkPosition {
 	cr := r.segmentReaders[r.currentReader]
 	return &ChunkPosition{
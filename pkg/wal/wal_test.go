@@ -1,11 +1,21 @@
 package wal
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"math/rand/v2"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"lsm/pkg/vfs"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -236,3 +246,513 @@ func TestWAL_ReaderWithStart(t *testing.T) {
 	}
 	assert.Equal(t, i, count)
 }
+
+func TestWAL_TruncateBefore(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "wal-test-truncate-before")
+	opts := Option{
+		Dir:         dir,
+		SegmentSize: 64 * KB,
+	}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { removeWAL(wal) }()
+
+	b := []byte(strings.Repeat("wal", 1024))
+	positions := make([]*ChunkPosition, 100)
+	for i := range positions {
+		positions[i], err = wal.Write(b)
+		assert.Nil(t, err)
+	}
+	last := positions[len(positions)-1].SegmentID
+	assert.Greater(t, last, SegmentID(3))
+
+	// 位于 pos 所在 segment 之前的 segment 被删除, pos 之后的记录仍然可以读取
+	pos := positions[50]
+	assert.Nil(t, wal.TruncateBefore(*pos))
+	assert.Len(t, wal.segments, int(last-pos.SegmentID+1))
+	_, err = wal.Read(positions[0])
+	assert.NotNil(t, err)
+
+	reader, err := wal.NewReaderWithStart(nil)
+	assert.Nil(t, err)
+	first := -1
+	for {
+		data, p, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, b, data)
+		if first < 0 {
+			first = slices.IndexFunc(positions, func(q *ChunkPosition) bool { return *q == *p })
+		}
+	}
+	assert.LessOrEqual(t, first, 50)
+	assert.Equal(t, pos.SegmentID, positions[first].SegmentID)
+
+	// active segment 不会被删除
+	assert.Nil(t, wal.TruncateBefore(ChunkPosition{SegmentID: last + 1}))
+	assert.Len(t, wal.segments, 1)
+	_, err = wal.Write(b)
+	assert.Nil(t, err)
+
+	// 重新打开后只剩余未删除的 segment
+	assert.Nil(t, wal.Close())
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Len(t, wal.segments, 1)
+	assert.Equal(t, last, wal.activeSegment.id)
+}
+
+func TestWAL_TailReader(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "wal-test-tail-reader")
+	wal, err := Open(Option{
+		Dir:         dir,
+		SegmentSize: 64 * KB,
+	})
+	assert.Nil(t, err)
+	defer removeWAL(wal)
+
+	// 写入方并发写入, 期间多次切换 segment, 长度不同的记录会产生 padding
+	const N = 500
+	record := func(i int) []byte {
+		return []byte(strings.Repeat(strconv.Itoa(i), i%300+1))
+	}
+	positions := make(chan *ChunkPosition, N)
+	go func() {
+		for i := range N {
+			pos, err := wal.Write(record(i))
+			assert.Nil(t, err)
+			positions <- pos
+		}
+	}()
+
+	reader, err := wal.NewReaderWithStart(nil)
+	assert.Nil(t, err)
+	var checkpoint *ChunkPosition
+	for i := range N {
+		data, pos, err := reader.NextWait(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, record(i), data)
+		assert.Equal(t, <-positions, pos)
+		if i == N/2 {
+			checkpoint = reader.CurrentChunkPosition()
+		}
+	}
+	assert.Greater(t, wal.activeSegment.id, SegmentID(2))
+
+	// 没有新的记录时阻塞, 直到 ctx 结束
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = reader.NextWait(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// 从保存的位置继续读取
+	resumed, err := wal.NewReaderWithStart(checkpoint)
+	assert.Nil(t, err)
+	for i := N/2 + 1; i < N; i++ {
+		data, _, err := resumed.NextWait(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, record(i), data)
+	}
+
+	// 关闭 wal 时唤醒等待中的 reader
+	done := make(chan error)
+	go func() {
+		_, _, err := resumed.NextWait(context.Background())
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, wal.Close())
+	assert.Equal(t, ErrClosed, <-done)
+}
+
+func TestWAL_Recovery(t *testing.T) {
+	const N = 2000
+	record := func(i int) []byte {
+		return []byte(strings.Repeat(strconv.Itoa(i%10), 100+i%50))
+	}
+
+	// 写入 N 条记录后关闭, 返回每条记录的位置
+	setup := func(t *testing.T, opts Option) []*ChunkPosition {
+		wal, err := Open(opts)
+		assert.Nil(t, err)
+		positions := make([]*ChunkPosition, N)
+		for i := range N {
+			positions[i], err = wal.Write(record(i))
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, wal.Close())
+		return positions
+	}
+	// 修改记录 i 的一个字节
+	corrupt := func(t *testing.T, dir string, pos *ChunkPosition) {
+		fd, err := os.OpenFile(filepath.Join(dir, segmentFileName(pos.SegmentID)), os.O_RDWR, 0)
+		assert.Nil(t, err)
+		defer fd.Close()
+		_, err = fd.WriteAt([]byte{'x'}, int64(pos.BlockN)*blockSize+int64(pos.BlockOffset)+chunkHeaderSize)
+		assert.Nil(t, err)
+	}
+	// 末尾追加写入一半的记录
+	tornTail := func(t *testing.T, dir string, pos *ChunkPosition) {
+		fd, err := os.OpenFile(filepath.Join(dir, segmentFileName(pos.SegmentID)), os.O_WRONLY|os.O_APPEND, 0)
+		assert.Nil(t, err)
+		defer fd.Close()
+		_, err = fd.Write([]byte{1, 2, 3, 4, 0, 100, 0, 'a', 'b'})
+		assert.Nil(t, err)
+	}
+	readAll := func(t *testing.T, wal *WAL) []string {
+		reader, err := wal.NewReaderWithStart(nil)
+		assert.Nil(t, err)
+		var records []string
+		for {
+			data, _, err := reader.Next()
+			if errors.Is(err, io.EOF) {
+				return records
+			}
+			if !assert.Nil(t, err) {
+				return records
+			}
+			records = append(records, string(data))
+		}
+	}
+	expected := func(indexes ...int) []string {
+		var records []string
+		for _, i := range indexes {
+			records = append(records, string(record(i)))
+		}
+		return records
+	}
+	all := make([]int, N)
+	for i := range all {
+		all[i] = i
+	}
+
+	for _, tc := range []struct {
+		name   string
+		mode   RecoveryMode
+		middle bool
+		check  func(t *testing.T, wal *WAL, err error, positions []*ChunkPosition)
+	}{
+		{"tail/tolerate", TolerateCorruptedTailRecords, false, func(t *testing.T, wal *WAL, err error, _ []*ChunkPosition) {
+			assert.Nil(t, err)
+			assert.Equal(t, expected(all...), readAll(t, wal))
+			assert.Equal(t, RecoveryReport{DroppedBytes: 9, DroppedRecords: 1, FirstCorruption: wal.RecoveryReport().FirstCorruption}, wal.RecoveryReport())
+		}},
+		{"tail/absolute", AbsoluteConsistency, false, func(t *testing.T, _ *WAL, err error, _ []*ChunkPosition) {
+			assert.ErrorIs(t, err, ErrCorrupted)
+		}},
+		{"middle/tolerate", TolerateCorruptedTailRecords, true, func(t *testing.T, _ *WAL, err error, _ []*ChunkPosition) {
+			assert.ErrorIs(t, err, ErrCorrupted)
+		}},
+		{"middle/pointInTime", PointInTimeRecovery, true, func(t *testing.T, wal *WAL, err error, positions []*ChunkPosition) {
+			assert.Nil(t, err)
+			assert.Equal(t, expected(all[:N/4]...), readAll(t, wal))
+			report := wal.RecoveryReport()
+			// 损坏的 block 中之后的记录无法区分, 按一条计算
+			assert.LessOrEqual(t, report.DroppedRecords, N-N/4)
+			assert.Greater(t, report.DroppedRecords, N/2)
+			first := *positions[N/4]
+			first.Size = 0
+			assert.Equal(t, &first, report.FirstCorruption)
+			// 之后的 segment 已被删除
+			assert.Equal(t, positions[N/4].SegmentID, wal.activeSegment.id)
+		}},
+		{"middle/skip", SkipAnyCorruptedRecords, true, func(t *testing.T, wal *WAL, err error, positions []*ChunkPosition) {
+			assert.Nil(t, err)
+			// 损坏记录所在 block 中之后的记录也无法解析
+			var kept []int
+			for i, pos := range positions {
+				if i < N/4 || pos.SegmentID != positions[N/4].SegmentID || pos.BlockN > positions[N/4].BlockN {
+					kept = append(kept, i)
+				}
+			}
+			assert.Equal(t, expected(kept...), readAll(t, wal))
+			report := wal.RecoveryReport()
+			assert.Equal(t, 1, report.DroppedRecords)
+			assert.Greater(t, report.DroppedBytes, uint64(0))
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, _ := os.MkdirTemp("", "wal-test-recovery")
+			defer os.RemoveAll(dir)
+			opts := Option{
+				Dir:          dir,
+				SegmentSize:  128 * KB,
+				RecoveryMode: tc.mode,
+			}
+			positions := setup(t, opts)
+			if tc.middle {
+				corrupt(t, dir, positions[N/4])
+			} else {
+				tornTail(t, dir, positions[N-1])
+			}
+
+			wal, err := Open(opts)
+			tc.check(t, wal, err, positions)
+			if err != nil {
+				return
+			}
+
+			// 末尾损坏的部分已被截断, 之后的写入可以正常读取
+			pos, err := wal.Write([]byte("new"))
+			assert.Nil(t, err)
+			assert.Nil(t, wal.Close())
+			wal, err = Open(opts)
+			assert.Nil(t, err)
+			defer wal.Close()
+			data, err := wal.Read(pos)
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("new"), data)
+			if !tc.middle {
+				assert.Equal(t, RecoveryReport{}, wal.RecoveryReport())
+			}
+		})
+	}
+	// 记录结束于 block 末尾前 chunkHeaderSize 字节处, 剩余部分由 writer 填充为 padding
+	for _, mode := range []RecoveryMode{TolerateCorruptedTailRecords, SkipAnyCorruptedRecords, PointInTimeRecovery, AbsoluteConsistency} {
+		t.Run(fmt.Sprintf("padding/%d", mode), func(t *testing.T) {
+			dir, _ := os.MkdirTemp("", "wal-test-recovery")
+			defer os.RemoveAll(dir)
+			opts := Option{
+				Dir:          dir,
+				SegmentSize:  128 * KB,
+				RecoveryMode: mode,
+			}
+			records := []string{strings.Repeat("a", blockSize-2*chunkHeaderSize), "b"}
+			wal, err := Open(opts)
+			assert.Nil(t, err)
+			for _, r := range records {
+				_, err = wal.Write([]byte(r))
+				assert.Nil(t, err)
+			}
+			assert.Nil(t, wal.Close())
+
+			wal, err = Open(opts)
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer wal.Close()
+			assert.Equal(t, records, readAll(t, wal))
+			assert.Equal(t, RecoveryReport{}, wal.RecoveryReport())
+		})
+	}
+}
+
+func TestWAL_Sync(t *testing.T) {
+	open := func(t *testing.T, opts Option) *WAL {
+		opts.Dir, _ = os.MkdirTemp("", "wal-test-sync")
+		opts.SegmentSize = 32 * MB
+		wal, err := Open(opts)
+		assert.Nil(t, err)
+		t.Cleanup(func() { removeWAL(wal) })
+		return wal
+	}
+	synced := func(wal *WAL, pos *ChunkPosition) bool {
+		wal.syncMu.Lock()
+		defer wal.syncMu.Unlock()
+		return wal.synced.compare(endOf(pos)) >= 0
+	}
+
+	t.Run("group", func(t *testing.T) {
+		wal := open(t, Option{Sync: true})
+		// 模拟正在进行的 sync, 之后的写入都等待它完成
+		wal.syncMu.Lock()
+		wal.syncing = true
+		wal.syncMu.Unlock()
+
+		const N = 10
+		done := make(chan *ChunkPosition, N)
+		for i := range N {
+			go func() {
+				pos, err := wal.Write([]byte(strconv.Itoa(i)))
+				assert.Nil(t, err)
+				done <- pos
+			}()
+		}
+		time.Sleep(50 * time.Millisecond)
+		assert.Len(t, done, 0)
+
+		// sync 覆盖了所有写入, 等待者一起返回
+		wal.RLock()
+		end := syncPoint{wal.activeSegment.id, wal.activeSegment.Size()}
+		wal.RUnlock()
+		wal.syncMu.Lock()
+		wal.syncing = false
+		wal.synced = end
+		wal.syncCond.Broadcast()
+		wal.syncMu.Unlock()
+		for range N {
+			pos := <-done
+			assert.True(t, synced(wal, pos))
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		wal := open(t, Option{Sync: true})
+		var wg sync.WaitGroup
+		for i := range 50 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pos, err := wal.Write([]byte(strings.Repeat("x", i*100)))
+				assert.Nil(t, err)
+				assert.True(t, synced(wal, pos))
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		wal := open(t, Option{SyncInterval: 10 * time.Millisecond})
+		pos, err := wal.Write([]byte("hello"))
+		assert.Nil(t, err)
+		assert.Eventually(t, func() bool { return synced(wal, pos) }, time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		wal := open(t, Option{BytesPerSync: 4 * KB})
+		pos, err := wal.Write([]byte("hello"))
+		assert.Nil(t, err)
+		time.Sleep(20 * time.Millisecond)
+		assert.False(t, synced(wal, pos))
+
+		pos, err = wal.Write(make([]byte, 4*KB))
+		assert.Nil(t, err)
+		assert.Eventually(t, func() bool { return synced(wal, pos) }, time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("explicit", func(t *testing.T) {
+		wal := open(t, Option{})
+		pos, err := wal.Write([]byte("hello"))
+		assert.Nil(t, err)
+		assert.False(t, synced(wal, pos))
+		assert.Nil(t, wal.SyncTo(pos))
+		assert.True(t, synced(wal, pos))
+	})
+
+	t.Run("close", func(t *testing.T) {
+		wal := open(t, Option{Sync: true, SyncInterval: time.Millisecond, FS: slowSyncFS{vfs.NewMemFS()}})
+		var wg sync.WaitGroup
+		for i := range 50 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 20 {
+					pos, err := wal.Write([]byte(strings.Repeat("x", i*10)))
+					if err != nil {
+						assert.ErrorIs(t, err, ErrClosed)
+						return
+					}
+					assert.True(t, synced(wal, pos))
+				}
+			}()
+		}
+		// Close 等待正在进行的 sync, 不会在 sync 期间关闭文件
+		time.Sleep(10 * time.Millisecond)
+		assert.Nil(t, wal.Close())
+		wg.Wait()
+	})
+}
+
+// sync 前等待一段时间, 使 sync 与其它操作重叠
+type slowSyncFS struct {
+	vfs.FS
+}
+
+type slowSyncFile struct {
+	vfs.File
+}
+
+func (fs slowSyncFS) Create(name string) (vfs.File, error) {
+	f, err := fs.FS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return slowSyncFile{f}, nil
+}
+
+func (fs slowSyncFS) OpenAppend(name string) (vfs.File, error) {
+	f, err := fs.FS.OpenAppend(name)
+	if err != nil {
+		return nil, err
+	}
+	return slowSyncFile{f}, nil
+}
+
+func (f slowSyncFile) Sync() error {
+	time.Sleep(5 * time.Millisecond)
+	return f.File.Sync()
+}
+
+func TestWAL_Compression(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "wal-test-compression")
+	opts := Option{Dir: dir, SegmentSize: 32 * MB}
+	wal, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { removeWAL(wal) }()
+
+	record := func(i int) []byte {
+		return fmt.Appendf(nil, `{"id":%d,"name":"user-%d","tags":[%s]}`, i, i, strings.Repeat(`"tag",`, i%2000)+`"end"`)
+	}
+
+	// 开启压缩前写入的记录
+	var positions []*ChunkPosition
+	for i := range 100 {
+		pos, err := wal.Write(record(i))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	assert.Nil(t, wal.Close())
+
+	opts.Compression = FlateCompression
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 100; i < 200; i++ {
+		pos, err := wal.Write(record(i))
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+		// 可压缩的记录占用的空间更小, 跨 block 的大记录也会被压缩
+		if len(record(i)) > 100 {
+			assert.Less(t, int(pos.Size), len(record(i)))
+		}
+	}
+	// 不可压缩的记录按原样写入
+	random := make([]byte, 1000)
+	for i := range random {
+		random[i] = byte(rand.IntN(256))
+	}
+	pos, err := wal.Write(random)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(chunkHeaderSize+len(random)), pos.Size)
+
+	check := func(wal *WAL) {
+		for i, pos := range positions {
+			data, err := wal.Read(pos)
+			assert.Nil(t, err)
+			assert.Equal(t, record(i), data)
+		}
+		reader, err := wal.NewReaderWithStart(nil)
+		assert.Nil(t, err)
+		for i := range positions {
+			data, pos, err := reader.Next()
+			assert.Nil(t, err)
+			assert.Equal(t, record(i), data)
+			assert.Equal(t, positions[i], pos)
+		}
+		data, _, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, random, data)
+		_, _, err = reader.Next()
+		assert.Equal(t, io.EOF, err)
+	}
+	check(wal)
+
+	// 关闭压缩后, 之前压缩的记录仍然可读
+	assert.Nil(t, wal.Close())
+	opts.Compression = NoCompression
+	wal, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, wal.RecoveryReport().FirstCorruption)
+	check(wal)
+}
@@ -0,0 +1,10 @@
+package lsm
+
+// Snapshot 表示创建时刻 db 的只读视图
+type Snapshot struct {
+	seq uint64
+}
+
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
@@ -0,0 +1,154 @@
+package lsm
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+type TransactionDBOption struct {
+	// 锁的分片数量, 分片越多, 不同 key 的加锁越不容易互相阻塞
+	NumStripes int
+
+	// 等待锁的超时时间, <= 0 表示一直等待
+	LockTimeout time.Duration
+
+	// 死锁检测时沿 wait-for 图查找的最大深度, <= 0 表示不检测死锁, 只依赖超时
+	DeadlockDetectDepth int
+}
+
+var DefaultTransactionDBOptions = TransactionDBOption{
+	NumStripes:          16,
+	LockTimeout:         time.Second,
+	DeadlockDetectDepth: 50,
+}
+
+// TransactionDB 在 Db 之上提供悲观事务
+//
+// 事务写入或通过 GetForUpdate 读取 key 之前先获取该 key 的排他锁, 直到提交或回滚才释放,
+// 提交时不会发生冲突, 适用于热点 key 上乐观事务频繁重试的场景
+type TransactionDB struct {
+	db        *Db
+	locks     *lockManager
+	nextTxnID atomic.Uint64
+}
+
+func NewTransactionDB(db *Db, option TransactionDBOption) *TransactionDB {
+	return &TransactionDB{
+		db:    db,
+		locks: newLockManager(option.NumStripes, option.LockTimeout, option.DeadlockDetectDepth),
+	}
+}
+
+func (tdb *TransactionDB) Db() *Db {
+	return tdb.db
+}
+
+// 开始一个悲观事务, 结束时需调用 Commit 或 Rollback 释放持有的锁
+func (tdb *TransactionDB) BeginTransaction() *PessimisticTxn {
+	return &PessimisticTxn{
+		tdb:    tdb,
+		id:     tdb.nextTxnID.Add(1),
+		batch:  NewWriteBatch(),
+		writes: make(map[string][]byte),
+		locked: make(map[string]struct{}),
+	}
+}
+
+// PessimisticTxn 是 TransactionDB 中的事务
+//
+// 获取锁失败(超时或死锁)时返回 ErrLockTimeout 或 ErrDeadlock, 事务本身仍然有效,
+// 调用方可以重试该操作或回滚整个事务
+//
+// PessimisticTxn 不是并发安全的
+type PessimisticTxn struct {
+	tdb   *TransactionDB
+	id    uint64
+	batch *WriteBatch
+	// 事务自身的写入, nil 表示删除
+	writes map[string][]byte
+	// 持有锁的 key
+	locked map[string]struct{}
+	done   bool
+}
+
+// 优先返回事务自身的写入, 否则读取最新的数据, 不加锁
+func (txn *PessimisticTxn) Get(userKey []byte) ([]byte, bool) {
+	if txn.done {
+		return nil, false
+	}
+	if value, ok := txn.writes[string(userKey)]; ok {
+		return value, value != nil
+	}
+	return txn.tdb.db.Get(userKey, math.MaxUint64)
+}
+
+// 获取 key 的锁后读取, 事务结束前其它事务不能修改该 key
+func (txn *PessimisticTxn) GetForUpdate(userKey []byte) ([]byte, bool, error) {
+	if err := txn.lock(userKey); err != nil {
+		return nil, false, err
+	}
+	value, ok := txn.Get(userKey)
+	return value, ok, nil
+}
+
+func (txn *PessimisticTxn) Put(userKey, userValue []byte) error {
+	if err := txn.lock(userKey); err != nil {
+		return err
+	}
+	txn.batch.Put(userKey, userValue)
+	// 与删除区分
+	if userValue == nil {
+		userValue = []byte{}
+	}
+	txn.writes[string(userKey)] = userValue
+	return nil
+}
+
+func (txn *PessimisticTxn) Delete(userKey []byte) error {
+	if err := txn.lock(userKey); err != nil {
+		return err
+	}
+	txn.batch.Delete(userKey)
+	txn.writes[string(userKey)] = nil
+	return nil
+}
+
+// 通过 WriteBatch 原子地写入 Db, 然后释放所有锁
+func (txn *PessimisticTxn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	defer txn.finish()
+	return txn.tdb.db.Write(txn.batch)
+}
+
+// 丢弃事务的所有写入并释放锁
+func (txn *PessimisticTxn) Rollback() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.finish()
+	return nil
+}
+
+func (txn *PessimisticTxn) lock(userKey []byte) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	if _, ok := txn.locked[string(userKey)]; ok {
+		return nil
+	}
+	if err := txn.tdb.locks.lock(txn.id, string(userKey)); err != nil {
+		return err
+	}
+	txn.locked[string(userKey)] = struct{}{}
+	return nil
+}
+
+func (txn *PessimisticTxn) finish() {
+	txn.done = true
+	for userKey := range txn.locked {
+		txn.tdb.locks.unlock(txn.id, userKey)
+	}
+}
@@ -0,0 +1,129 @@
+package lsm
+
+import "errors"
+
+var (
+	ErrConflict = errors.New("transaction conflict")
+	ErrTxnDone  = errors.New("transaction has been committed or rolled back")
+)
+
+// Txn 是乐观事务, 读取事务开始时的 snapshot 以及事务自身的写入
+//
+// 写入先缓存在 WriteBatch 中, Commit 时检查读写过的 key 在 snapshot 之后是否被其它写入修改,
+// 没有冲突才原子地写入, 否则返回 ErrConflict, 由调用方重试
+//
+// GetCF/PutCF/DeleteCF 读写任意 column family, 冲突按 column family 与 key 分别检查
+//
+// Txn 不是并发安全的
+type Txn struct {
+	db       *Db
+	snapshot *Snapshot
+	batch    *WriteBatch
+	// 事务自身的写入, nil 表示删除
+	writes map[txnKey][]byte
+	// 读取过的 key
+	reads map[txnKey]struct{}
+	done  bool
+}
+
+// 不同 column family 中的同名 key 互不相关, 需要分别记录
+type txnKey struct {
+	cf      *ColumnFamilyHandle
+	userKey string
+}
+
+// 开始一个乐观事务, 结束时需调用 Commit 或 Rollback
+func (db *Db) BeginTransaction() *Txn {
+	return &Txn{
+		db:       db,
+		snapshot: db.GetSnapshot(),
+		batch:    NewWriteBatch(),
+		writes:   make(map[txnKey][]byte),
+		reads:    make(map[txnKey]struct{}),
+	}
+}
+
+// 优先返回事务自身的写入, 否则读取事务开始时的数据
+func (txn *Txn) Get(userKey []byte) ([]byte, bool) {
+	return txn.GetCF(txn.db.defaultCF, userKey)
+}
+
+func (txn *Txn) GetCF(cf *ColumnFamilyHandle, userKey []byte) ([]byte, bool) {
+	if txn.done {
+		return nil, false
+	}
+	k := txnKey{cf: cf, userKey: string(userKey)}
+	if value, ok := txn.writes[k]; ok {
+		return value, value != nil
+	}
+	txn.reads[k] = struct{}{}
+	return txn.db.GetCF(cf, userKey, txn.snapshot.Seq())
+}
+
+func (txn *Txn) Put(userKey, userValue []byte) error {
+	return txn.PutCF(txn.db.defaultCF, userKey, userValue)
+}
+
+func (txn *Txn) PutCF(cf *ColumnFamilyHandle, userKey, userValue []byte) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.batch.PutCF(cf, userKey, userValue)
+	// 与删除区分
+	if userValue == nil {
+		userValue = []byte{}
+	}
+	txn.writes[txnKey{cf: cf, userKey: string(userKey)}] = userValue
+	return nil
+}
+
+func (txn *Txn) Delete(userKey []byte) error {
+	return txn.DeleteCF(txn.db.defaultCF, userKey)
+}
+
+func (txn *Txn) DeleteCF(cf *ColumnFamilyHandle, userKey []byte) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.batch.DeleteCF(cf, userKey)
+	txn.writes[txnKey{cf: cf, userKey: string(userKey)}] = nil
+	return nil
+}
+
+// 检查冲突并提交, 冲突时返回 ErrConflict, 事务的写入全部丢弃
+// 无论成功与否, 事务都会结束
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	defer txn.finish()
+
+	db := txn.db
+	return db.writeBatch(txn.batch, db.option.Sync, func() error {
+		for k := range txn.reads {
+			if db.latestSeq(k.cf, []byte(k.userKey)) > txn.snapshot.Seq() {
+				return ErrConflict
+			}
+		}
+		for k := range txn.writes {
+			if db.latestSeq(k.cf, []byte(k.userKey)) > txn.snapshot.Seq() {
+				return ErrConflict
+			}
+		}
+		return nil
+	})
+}
+
+// 丢弃事务的所有写入
+func (txn *Txn) Rollback() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.finish()
+	return nil
+}
+
+func (txn *Txn) finish() {
+	txn.done = true
+	txn.db.ReleaseSnapshot(txn.snapshot)
+}
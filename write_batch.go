@@ -0,0 +1,123 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"lsm/internal/key"
+	"lsm/internal/util"
+)
+
+var ErrCorruptedBatch = errors.New("corrupted write batch")
+
+type batchRecord struct {
+	// nil 表示 default column family
+	cf *ColumnFamilyHandle
+	ik key.InternalKey
+}
+
+// WriteBatch 收集多个写操作, 由 Db.Write 原子地写入, 可以跨越多个 column family
+//
+// 同一个 batch 中的记录写入同一条 wal 记录, 恢复时要么全部重放, 要么全部丢弃
+type WriteBatch struct {
+	records []batchRecord
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (b *WriteBatch) Put(userKey, userValue []byte) {
+	b.PutCF(nil, userKey, userValue)
+}
+
+func (b *WriteBatch) PutCF(cf *ColumnFamilyHandle, userKey, userValue []byte) {
+	b.add(cf, key.KTypeValue, userKey, userValue)
+}
+
+func (b *WriteBatch) Delete(userKey []byte) {
+	b.DeleteCF(nil, userKey)
+}
+
+func (b *WriteBatch) DeleteCF(cf *ColumnFamilyHandle, userKey []byte) {
+	b.add(cf, key.KTypeDeletion, userKey, nil)
+}
+
+// 需要 start < end, 否则 Db.Write 返回 ErrInvalidRange
+func (b *WriteBatch) DeleteRange(start, end []byte) {
+	b.DeleteRangeCF(nil, start, end)
+}
+
+func (b *WriteBatch) DeleteRangeCF(cf *ColumnFamilyHandle, start, end []byte) {
+	b.add(cf, key.KTypeRangeDeletion, start, end)
+}
+
+// cf 未设置 MergeOperator 时, Db.Write 返回 ErrNoMergeOperator
+func (b *WriteBatch) Merge(userKey, operand []byte) {
+	b.MergeCF(nil, userKey, operand)
+}
+
+func (b *WriteBatch) MergeCF(cf *ColumnFamilyHandle, userKey, operand []byte) {
+	b.add(cf, key.KTypeMerge, userKey, operand)
+}
+
+func (b *WriteBatch) Count() int {
+	return len(b.records)
+}
+
+func (b *WriteBatch) Clear() {
+	b.records = b.records[:0]
+}
+
+func (b *WriteBatch) add(cf *ColumnFamilyHandle, tp key.KeyType, userKey, userValue []byte) {
+	b.addKey(cf, key.New(userKey, userValue, 0, tp))
+}
+
+// seq 在 Db.Write 时分配
+func (b *WriteBatch) addKey(cf *ColumnFamilyHandle, ik key.InternalKey) {
+	b.records = append(b.records, batchRecord{cf: cf, ik: ik})
+}
+
+// 编码为一条 wal 记录
+// count(4B) | [cfID(4B) | len(4B) | internalKey]...
+func encodeBatchRecords(records []batchRecord) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(len(records)))
+	for _, r := range records {
+		binary.Write(&buf, binary.LittleEndian, r.cf.id)
+		buf.Write(util.LenPrefixSlice(r.ik.EncodeTo()))
+	}
+	return buf.Bytes()
+}
+
+// 解码 wal 记录, 返回每条记录所属的 column family id 与 InternalKey
+func decodeBatchRecords(data []byte) ([]uint32, []key.InternalKey, error) {
+	if len(data) < 4 {
+		return nil, nil, ErrCorruptedBatch
+	}
+	count := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+
+	ids := make([]uint32, 0, count)
+	iks := make([]key.InternalKey, 0, count)
+	for range count {
+		if len(data) < 8 {
+			return nil, nil, ErrCorruptedBatch
+		}
+		id := binary.LittleEndian.Uint32(data)
+		n := binary.LittleEndian.Uint32(data[4:])
+		data = data[8:]
+		if uint32(len(data)) < n {
+			return nil, nil, ErrCorruptedBatch
+		}
+		var ik key.InternalKey
+		ik.DecodeFrom(data[:n])
+		data = data[n:]
+		ids = append(ids, id)
+		iks = append(iks, ik)
+	}
+	if len(data) != 0 {
+		return nil, nil, ErrCorruptedBatch
+	}
+	return ids, iks, nil
+}
@@ -0,0 +1,194 @@
+package lsm
+
+import (
+	"lsm/internal/key"
+	"lsm/pkg/comparator"
+	"lsm/pkg/skiplist"
+	"math"
+)
+
+// WriteBatchWithIndex 在 WriteBatch 之外用 skiplist 索引尚未提交的写入,
+// 可以在提交之前读取 batch 与 db 叠加后的结果, 用于需要 read-your-own-writes 的多步更新
+//
+// 索引中的记录以在 batch 中的序号作为 seq, 同一个 key 的后一次写入排在前面
+//
+// WriteBatchWithIndex 不是并发安全的
+type WriteBatchWithIndex struct {
+	batch *WriteBatch
+	index *skiplist.Skiplist
+	ucmp  comparator.Comparator
+}
+
+// 按字节序索引, 用于默认 column family 使用 comparator.Bytewise 的 db
+func NewWriteBatchWithIndex() *WriteBatchWithIndex {
+	return NewWriteBatchWithIndexComparator(comparator.Bytewise)
+}
+
+// 按 ucmp 索引, ucmp 需要与 db 默认 column family 的 Comparator 相同
+func NewWriteBatchWithIndexComparator(ucmp comparator.Comparator) *WriteBatchWithIndex {
+	ucmp = comparator.OrDefault(ucmp)
+	return &WriteBatchWithIndex{
+		batch: NewWriteBatch(),
+		index: skiplist.New(skiplist.CompareFunc(key.InternalKeyComparer(ucmp.Compare))),
+		ucmp:  ucmp,
+	}
+}
+
+func (b *WriteBatchWithIndex) Put(userKey, userValue []byte) {
+	b.batch.Put(userKey, userValue)
+	b.addIndex(key.KTypeValue, userKey, userValue)
+}
+
+func (b *WriteBatchWithIndex) Delete(userKey []byte) {
+	b.batch.Delete(userKey)
+	b.addIndex(key.KTypeDeletion, userKey, nil)
+}
+
+func (b *WriteBatchWithIndex) Count() int {
+	return b.batch.Count()
+}
+
+// 返回底层的 WriteBatch, 通过 Db.Write 提交
+func (b *WriteBatchWithIndex) WriteBatch() *WriteBatch {
+	return b.batch
+}
+
+func (b *WriteBatchWithIndex) addIndex(tp key.KeyType, userKey, userValue []byte) {
+	ik := key.New(userKey, userValue, uint64(b.batch.Count()), tp)
+	b.index.Insert(ik.EncodeTo())
+}
+
+// 返回 batch 中 userKey 最后一次写入, 不存在时 ok 为 false
+func (b *WriteBatchWithIndex) find(userKey []byte) (ik key.InternalKey, ok bool) {
+	lookupKey := key.NewLookupKey(userKey, math.MaxUint64)
+	iter := b.index.Iterator()
+	iter.Seek(lookupKey.EncodeTo())
+	if !iter.Valid() {
+		return ik, false
+	}
+	ik.DecodeFrom(iter.Key())
+	return ik, b.ucmp.Compare(ik.UserKey, userKey) == 0
+}
+
+// 优先返回 batch 中的写入, batch 中没有该 key 时读取 db 的最新数据
+func (b *WriteBatchWithIndex) GetFromBatchAndDB(db *Db, userKey []byte) ([]byte, bool) {
+	if ik, ok := b.find(userKey); ok {
+		return ik.UserValue, ik.Type == key.KTypeValue
+	}
+	return db.Get(userKey, math.MaxUint64)
+}
+
+// 返回将 batch 叠加在 base 之上的迭代器, 关闭时同时关闭 base
+// batch 在迭代期间不能修改
+func (b *WriteBatchWithIndex) NewIteratorWithBase(base *Iterator) *BaseDeltaIterator {
+	return &BaseDeltaIterator{
+		base:  base,
+		delta: b.index.Iterator(),
+		ucmp:  b.ucmp,
+	}
+}
+
+// BaseDeltaIterator 按 Comparator 的顺序合并 db 的迭代器(base)与 batch 的索引(delta)
+// 同一个 key 以 delta 为准, delta 中删除的 key 会被跳过
+type BaseDeltaIterator struct {
+	base  *Iterator
+	delta *skiplist.Iterator
+	ucmp  comparator.Comparator
+
+	// 当前 key 是否来自 delta
+	fromDelta  bool
+	deltaEntry key.InternalKey
+	valid      bool
+}
+
+func (it *BaseDeltaIterator) SeekToFirst() {
+	it.base.SeekToFirst()
+	it.delta.SeekToFirst()
+	it.findNext()
+}
+
+// 定位到第一个 >= userKey 的 key
+func (it *BaseDeltaIterator) Seek(userKey []byte) {
+	it.base.Seek(userKey)
+	lookupKey := key.NewLookupKey(userKey, math.MaxUint64)
+	it.delta.Seek(lookupKey.EncodeTo())
+	it.findNext()
+}
+
+func (it *BaseDeltaIterator) Valid() bool {
+	return it.valid
+}
+
+// requires it.Valid()
+func (it *BaseDeltaIterator) Key() []byte {
+	if it.fromDelta {
+		return it.deltaEntry.UserKey
+	}
+	return it.base.Key()
+}
+
+// requires it.Valid()
+func (it *BaseDeltaIterator) Value() []byte {
+	if it.fromDelta {
+		return it.deltaEntry.UserValue
+	}
+	return it.base.Value()
+}
+
+func (it *BaseDeltaIterator) Next() {
+	if it.fromDelta {
+		it.skipDeltaKey()
+	} else {
+		it.base.Next()
+	}
+	it.findNext()
+}
+
+func (it *BaseDeltaIterator) Close() {
+	it.valid = false
+	it.base.Close()
+}
+
+// 跳过 delta 中当前 userKey 的所有(更旧的)记录
+func (it *BaseDeltaIterator) skipDeltaKey() {
+	userKey := it.deltaEntry.UserKey
+	for ; it.delta.Valid(); it.delta.Next() {
+		it.deltaEntry.DecodeFrom(it.delta.Key())
+		if it.ucmp.Compare(it.deltaEntry.UserKey, userKey) != 0 {
+			return
+		}
+	}
+}
+
+func (it *BaseDeltaIterator) findNext() {
+	for {
+		it.valid = it.base.Valid() || it.delta.Valid()
+		if !it.valid {
+			return
+		}
+		if !it.delta.Valid() {
+			it.fromDelta = false
+			return
+		}
+
+		// delta 总是停在某个 userKey 最新的记录上
+		it.deltaEntry.DecodeFrom(it.delta.Key())
+		c := -1
+		if it.base.Valid() {
+			c = it.ucmp.Compare(it.deltaEntry.UserKey, it.base.Key())
+		}
+		if c > 0 {
+			it.fromDelta = false
+			return
+		}
+		if c == 0 {
+			// base 中的 key 被 delta 覆盖
+			it.base.Next()
+		}
+		if it.deltaEntry.Type == key.KTypeValue {
+			it.fromDelta = true
+			return
+		}
+		it.skipDeltaKey()
+	}
+}